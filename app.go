@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/cyverse-de/app-exposer/external"
 	"github.com/cyverse-de/app-exposer/internal"
 	"github.com/gorilla/mux"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -25,48 +27,133 @@ type ExposerApp struct {
 
 // ExposerAppInit contains configuration settings for creating a new ExposerApp.
 type ExposerAppInit struct {
-	Namespace                     string // The namespace that the Ingress settings are added to.
-	ViceNamespace                 string // The namespace containing the running VICE apps.
-	PorklockImage                 string // The image containing the porklock tool
-	PorklockTag                   string // The docker tag for the image containing the porklock tool
-	InputPathListIdentifier       string // Header line for input path lists
-	TicketInputPathListIdentifier string // Header line for ticket input path lists
-	JobStatusURL                  string
-	ViceProxyImage                string
-	CASBaseURL                    string
-	FrontendBaseURL               string
-	ViceDefaultBackendService     string
-	ViceDefaultBackendServicePort int
-	GetAnalysisIDService          string
-	CheckResourceAccessService    string
-	VICEBackendNamespace          string
-	AppsServiceBaseURL            string
-	db                            *sql.DB
+	Namespace                      string // The namespace that the Ingress settings are added to.
+	ViceNamespace                  string // The namespace containing the running VICE apps.
+	PorklockImage                  string // The image containing the porklock tool
+	PorklockTag                    string // The docker tag for the image containing the porklock tool
+	InputPathListIdentifier        string // Header line for input path lists
+	TicketInputPathListIdentifier  string // Header line for ticket input path lists
+	JobStatusURL                   string
+	ViceProxyImage                 string
+	CASBaseURL                     string
+	FrontendBaseURL                string
+	ViceDefaultBackendService      string
+	ViceDefaultBackendServicePort  int
+	GetAnalysisIDService           string
+	CheckResourceAccessService     string
+	VICEBackendNamespace           string
+	AppsServiceBaseURL             string
+	LaunchQueueEnabled             bool                                // Whether launches over capacity are queued instead of rejected
+	LaunchQueueInterval            time.Duration                       // How often the launch queue is checked for launches that now fit
+	LaunchQueueGroupPriorities     map[string]int                      // Queue priorities for members of the listed groups
+	ResourceRequestRatio           float64                             // Fraction of the CPU and memory limits requested when the job sets no minimum
+	EphemeralStorageLimit          string                              // Ephemeral storage limit for the analysis container, e.g. 50Gi
+	GPUModels                      map[string]internal.GPUModel        // The GPU models users can select, by name
+	GPUDefaultModel                string                              // The GPU model used when the job doesn't pick one
+	SchedulingPolicyFile           string                              // Path to the scheduling policy file, may be blank
+	SchedulingPolicyReloadInterval time.Duration                       // How often the scheduling policy file is checked for changes
+	PriorityClassDefault           string                              // The PriorityClass used when none of the others apply
+	PriorityClassUserTiers         map[string]string                   // PriorityClasses for members of the listed groups
+	PriorityClassAppCategories     map[string]string                   // PriorityClasses for apps in the listed categories
+	TerminationGracePeriod         time.Duration                       // How long analysis pods get to shut down after they are told to stop
+	HomeVolumesEnabled             bool                                // Whether each user gets a persistent home volume
+	HomeVolumeMountPath            string                              // Where the home volume is mounted in the analysis container
+	HomeVolumeStorageClass         string                              // The StorageClass for home volumes, may be blank for the cluster default
+	HomeVolumeAccessMode           string                              // The access mode for home volumes, ReadWriteMany by default
+	HomeVolumeDefaultSize          string                              // The size of home volumes when the user's quota doesn't set one
+	HomeVolumeRetention            time.Duration                       // How long unused home volumes are kept, 0 keeps them forever
+	HomeVolumeCleanupInterval      time.Duration                       // How often unused home volumes are cleaned up
+	SecurityProfiles               map[string]internal.SecurityProfile // The security profiles analyses can use, by name
+	SecurityDefaultProfile         string                              // The security profile for apps that don't have one
+	SecurityAppProfiles            map[string]string                   // The security profile for each listed app ID
+	SecurityMinimumLevel           string                              // The least restrictive Pod Security Standard analyses may run at
+	NetworkPolicies                internal.NetworkPolicyConfig        // The settings for the NetworkPolicy created for each analysis
+	SecretsMountPath               string                              // Where user secrets mounted as files appear in the analysis container
+	AdminUsers                     []string                            // The users that can use the admin endpoints and views
+	Redaction                      internal.RedactionRules             // What's hidden in the listings unless an admin asks for the full view
+	OrphanGCEnabled                bool                                // Whether the resources of orphaned analyses are deleted automatically
+	OrphanGCInterval               time.Duration                       // How often orphaned analyses are looked for
+	OrphanGracePeriod              time.Duration                       // How long an analysis must be orphaned before its resources are deleted
+	ReconcileEnabled               bool                                // Whether the resources of running analyses are repaired automatically
+	ReconcileInterval              time.Duration                       // How often running analyses are checked for drift
+	OperatorEnabled                bool                                // Whether analyses are launched as VICEAnalysis custom resources
+	OperatorResyncInterval         time.Duration                       // How often every VICEAnalysis is synced with its resources
+	TransferTimeout                time.Duration                       // How long a file transfer can run before it's stopped
+	TransferRequestTimeout         time.Duration                       // How long each request to the file transfer service can take
+	TransferPollInterval           time.Duration                       // How often the progress of a file transfer is checked
+	CheckpointMinInterval          time.Duration                       // The shortest interval users can choose for the checkpoints of an analysis
+	CheckpointCheckInterval        time.Duration                       // How often app-exposer looks for checkpoints that are due
+	StorageBackends                map[string]internal.StorageBackend  // The storage backends file transfers can use, by name
+	StorageDefaultBackend          string                              // The storage backend for jobs that don't pick one
+	db                             *sql.DB
+	dynamicClient                  dynamic.Interface
 }
 
 // NewExposerApp creates and returns a newly instantiated *ExposerApp.
 func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Interface) *ExposerApp {
 	internalInit := &internal.Init{
-		ViceNamespace:                 init.ViceNamespace,
-		PorklockImage:                 init.PorklockImage,
-		PorklockTag:                   init.PorklockTag,
-		InputPathListIdentifier:       init.InputPathListIdentifier,
-		TicketInputPathListIdentifier: init.TicketInputPathListIdentifier,
-		ViceProxyImage:                init.ViceProxyImage,
-		CASBaseURL:                    init.CASBaseURL,
-		FrontendBaseURL:               init.FrontendBaseURL,
-		ViceDefaultBackendService:     init.ViceDefaultBackendService,
-		ViceDefaultBackendServicePort: init.ViceDefaultBackendServicePort,
-		GetAnalysisIDService:          init.GetAnalysisIDService,
-		CheckResourceAccessService:    init.CheckResourceAccessService,
-		VICEBackendNamespace:          init.VICEBackendNamespace,
-		AppsServiceBaseURL:            init.AppsServiceBaseURL,
-		JobStatusURL:                  init.JobStatusURL,
+		ViceNamespace:                  init.ViceNamespace,
+		PorklockImage:                  init.PorklockImage,
+		PorklockTag:                    init.PorklockTag,
+		InputPathListIdentifier:        init.InputPathListIdentifier,
+		TicketInputPathListIdentifier:  init.TicketInputPathListIdentifier,
+		ViceProxyImage:                 init.ViceProxyImage,
+		CASBaseURL:                     init.CASBaseURL,
+		FrontendBaseURL:                init.FrontendBaseURL,
+		ViceDefaultBackendService:      init.ViceDefaultBackendService,
+		ViceDefaultBackendServicePort:  init.ViceDefaultBackendServicePort,
+		GetAnalysisIDService:           init.GetAnalysisIDService,
+		CheckResourceAccessService:     init.CheckResourceAccessService,
+		VICEBackendNamespace:           init.VICEBackendNamespace,
+		AppsServiceBaseURL:             init.AppsServiceBaseURL,
+		JobStatusURL:                   init.JobStatusURL,
+		LaunchQueueEnabled:             init.LaunchQueueEnabled,
+		LaunchQueueInterval:            init.LaunchQueueInterval,
+		LaunchQueueGroupPriorities:     init.LaunchQueueGroupPriorities,
+		ResourceRequestRatio:           init.ResourceRequestRatio,
+		EphemeralStorageLimit:          init.EphemeralStorageLimit,
+		GPUModels:                      init.GPUModels,
+		GPUDefaultModel:                init.GPUDefaultModel,
+		SchedulingPolicyFile:           init.SchedulingPolicyFile,
+		SchedulingPolicyReloadInterval: init.SchedulingPolicyReloadInterval,
+		PriorityClassDefault:           init.PriorityClassDefault,
+		PriorityClassUserTiers:         init.PriorityClassUserTiers,
+		PriorityClassAppCategories:     init.PriorityClassAppCategories,
+		TerminationGracePeriod:         init.TerminationGracePeriod,
+		HomeVolumesEnabled:             init.HomeVolumesEnabled,
+		HomeVolumeMountPath:            init.HomeVolumeMountPath,
+		HomeVolumeStorageClass:         init.HomeVolumeStorageClass,
+		HomeVolumeAccessMode:           init.HomeVolumeAccessMode,
+		HomeVolumeDefaultSize:          init.HomeVolumeDefaultSize,
+		HomeVolumeRetention:            init.HomeVolumeRetention,
+		HomeVolumeCleanupInterval:      init.HomeVolumeCleanupInterval,
+		SecurityProfiles:               init.SecurityProfiles,
+		SecurityDefaultProfile:         init.SecurityDefaultProfile,
+		SecurityAppProfiles:            init.SecurityAppProfiles,
+		SecurityMinimumLevel:           init.SecurityMinimumLevel,
+		NetworkPolicies:                init.NetworkPolicies,
+		SecretsMountPath:               init.SecretsMountPath,
+		AdminUsers:                     init.AdminUsers,
+		Redaction:                      init.Redaction,
+		OrphanGCEnabled:                init.OrphanGCEnabled,
+		OrphanGCInterval:               init.OrphanGCInterval,
+		OrphanGracePeriod:              init.OrphanGracePeriod,
+		ReconcileEnabled:               init.ReconcileEnabled,
+		ReconcileInterval:              init.ReconcileInterval,
+		OperatorEnabled:                init.OperatorEnabled,
+		OperatorResyncInterval:         init.OperatorResyncInterval,
+		TransferTimeout:                init.TransferTimeout,
+		TransferRequestTimeout:         init.TransferRequestTimeout,
+		TransferPollInterval:           init.TransferPollInterval,
+		CheckpointMinInterval:          init.CheckpointMinInterval,
+		CheckpointCheckInterval:        init.CheckpointCheckInterval,
+		StorageBackends:                init.StorageBackends,
+		StorageDefaultBackend:          init.StorageDefaultBackend,
 	}
 
 	app := &ExposerApp{
 		external:  external.New(cs, init.Namespace, ingressClass),
-		internal:  internal.New(internalInit, init.db, cs),
+		internal:  internal.New(internalInit, init.db, cs, init.dynamicClient),
 		namespace: init.Namespace,
 		clientset: cs,
 		router:    mux.NewRouter(),
@@ -75,6 +162,17 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 	app.router.HandleFunc("/", app.Greeting).Methods("GET")
 	app.router.HandleFunc("/vice/launch", app.internal.VICELaunchApp).Methods("POST")
 	app.router.HandleFunc("/vice/apply-labels", app.internal.ApplyAsyncLabelsHandler).Methods("POST")
+	app.router.HandleFunc("/vice/quota", app.internal.VICEQuota).Methods("GET")
+	app.router.HandleFunc("/vice/queue", app.internal.VICELaunchQueue).Methods("GET")
+	app.router.HandleFunc("/vice/home-volume", app.internal.VICEGetHomeVolume).Methods("GET")
+	app.router.HandleFunc("/vice/home-volume", app.internal.VICEDeleteHomeVolume).Methods("DELETE")
+	app.router.HandleFunc("/vice/workspaces", app.internal.VICEListWorkspaces).Methods("GET")
+	app.router.HandleFunc("/vice/secrets", app.internal.VICEListSecrets).Methods("GET")
+	app.router.HandleFunc("/vice/secrets/{name}", app.internal.VICEPutSecret).Methods("PUT")
+	app.router.HandleFunc("/vice/secrets/{name}", app.internal.VICEDeleteSecret).Methods("DELETE")
+	app.router.HandleFunc("/vice/scheduling-policy", app.internal.VICESchedulingPolicy).Methods("GET")
+	app.router.HandleFunc("/vice/admin/analyses", app.internal.AdminListAnalyses).Methods("GET")
+	app.router.HandleFunc("/vice/admin/reconciliation", app.internal.AdminReconciliation).Methods("GET")
 	app.router.HandleFunc("/vice/listing", app.internal.FilterableResources).Methods("GET")
 	app.router.HandleFunc("/vice/listing/deployments", app.internal.FilterableDeployments).Methods("GET")
 	app.router.HandleFunc("/vice/listing/pods", app.internal.FilterablePods).Methods("GET")
@@ -85,10 +183,22 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 	app.router.HandleFunc("/vice/{id}/save-output-files", app.internal.VICETriggerUploads).Methods("POST")
 	app.router.HandleFunc("/vice/{id}/exit", app.internal.VICEExit).Methods("POST")
 	app.router.HandleFunc("/vice/{id}/save-and-exit", app.internal.VICESaveAndExit).Methods("POST")
+	app.router.HandleFunc("/vice/{id}/operations/{op}", app.internal.VICEGetOperation).Methods("GET")
+	app.router.HandleFunc("/vice/{id}/transfers", app.internal.VICEListTransfers).Methods("GET")
+	app.router.HandleFunc("/vice/{id}/transfers/{uuid}", app.internal.VICEGetTransfer).Methods("GET")
+	app.router.HandleFunc("/vice/{id}/transfers/{uuid}", app.internal.VICECancelTransfer).Methods("DELETE")
+	app.router.HandleFunc("/vice/{id}/checkpoints", app.internal.VICEGetCheckpoints).Methods("GET")
+	app.router.HandleFunc("/vice/{id}/checkpoints", app.internal.VICEScheduleCheckpoints).Methods("PUT")
+	app.router.HandleFunc("/vice/{id}/checkpoints", app.internal.VICEUnscheduleCheckpoints).Methods("DELETE")
+	app.router.HandleFunc("/vice/{id}/suspend", app.internal.VICESuspend).Methods("POST")
+	app.router.HandleFunc("/vice/{id}/queue-position", app.internal.VICEQueuePosition).Methods("GET")
 	app.router.HandleFunc("/vice/{analysis-id}/pods", app.internal.VICEPods).Methods("GET")
 	app.router.HandleFunc("/vice/{analysis-id}/logs", app.internal.VICELogs).Methods("GET")
 	app.router.HandleFunc("/vice/{analysis-id}/time-limit", app.internal.VICETimeLimitUpdate).Methods("POST")
 	app.router.HandleFunc("/vice/{analysis-id}/time-limit", app.internal.VICEGetTimeLimit).Methods("GET")
+	app.router.HandleFunc("/vice/{analysis-id}/sharing", app.internal.VICEGetSharing).Methods("GET")
+	app.router.HandleFunc("/vice/{analysis-id}/sharing", app.internal.VICEShareAnalysis).Methods("POST")
+	app.router.HandleFunc("/vice/{analysis-id}/sharing/{shared-user}", app.internal.VICEUnshareAnalysis).Methods("DELETE")
 	app.router.HandleFunc("/vice/{host}/url-ready", app.internal.VICEStatus).Methods("GET")
 
 	app.router.HandleFunc("/service/{name}", app.external.CreateService).Methods("POST")
@@ -1,6 +1,10 @@
 package apps
 
-import "database/sql"
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
 
 // Apps provides an API for accessing information about apps.
 type Apps struct {
@@ -83,3 +87,104 @@ func (a *Apps) GetAnalysisStatus(analysisID string) (string, error) {
 	}
 	return status, nil
 }
+
+const getAppCategoriesQuery = `
+	SELECT c.name
+	  FROM app_categories c
+	  JOIN app_category_app aca ON aca.app_category_id = c.id
+	 WHERE aca.app_id::text = $1
+`
+
+// GetAppCategories returns the names of the categories that the app is in.
+func (a *Apps) GetAppCategories(appID string) ([]string, error) {
+	rows, err := a.DB.Query(getAppCategoriesQuery, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []string{}
+	for rows.Next() {
+		var category string
+		if err = rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+// Analysis contains the information about an analysis that's stored in the
+// database.
+type Analysis struct {
+	ID             string
+	ExternalID     string
+	Status         string
+	PlannedEndDate pq.NullTime
+	Username       string
+}
+
+const analysesByExternalIDsQuery = `
+	SELECT j.id, s.external_id, j.status, j.planned_end_date, u.username
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN users u ON j.user_id = u.id
+	 WHERE s.external_id = ANY($1)
+`
+
+// GetAnalysesByExternalIDs returns the analyses with the given external IDs,
+// keyed by external ID. External IDs without an analysis are left out.
+func (a *Apps) GetAnalysesByExternalIDs(externalIDs []string) (map[string]Analysis, error) {
+	analyses := map[string]Analysis{}
+	if len(externalIDs) == 0 {
+		return analyses, nil
+	}
+
+	rows, err := a.DB.Query(analysesByExternalIDsQuery, pq.Array(externalIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var analysis Analysis
+		if err = rows.Scan(&analysis.ID, &analysis.ExternalID, &analysis.Status, &analysis.PlannedEndDate, &analysis.Username); err != nil {
+			return nil, err
+		}
+		analyses[analysis.ExternalID] = analysis
+	}
+
+	return analyses, rows.Err()
+}
+
+const runningInteractiveAnalysesQuery = `
+	SELECT j.id, s.external_id, j.status, j.planned_end_date, u.username
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	  JOIN users u ON j.user_id = u.id
+	 WHERE j.status = 'Running'
+	   AND t.system_id = 'interactive'
+`
+
+// ListRunningInteractiveAnalyses returns the interactive analyses that are
+// marked as running in the database.
+func (a *Apps) ListRunningInteractiveAnalyses() ([]Analysis, error) {
+	rows, err := a.DB.Query(runningInteractiveAnalysesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	analyses := []Analysis{}
+	for rows.Next() {
+		var analysis Analysis
+		if err = rows.Scan(&analysis.ID, &analysis.ExternalID, &analysis.Status, &analysis.PlannedEndDate, &analysis.Username); err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	return analyses, rows.Err()
+}
@@ -0,0 +1,498 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The health of an analysis, as reported by the admin analyses endpoint.
+const (
+	healthPending  = "pending"
+	healthStarting = "starting"
+	healthReady    = "ready"
+	healthDegraded = "degraded"
+	healthOrphaned = "orphaned"
+)
+
+const (
+	defaultAnalysesLimit = 50
+	maxAnalysesLimit     = 500
+)
+
+// adminAnalysesParams are the query parameters of the admin analyses endpoint
+// that aren't label filters.
+var adminAnalysesParams = []string{"sort", "order", "limit", "offset", "health"}
+
+// terminalStatuses are the statuses of analyses that are no longer running.
+var terminalStatuses = []string{"Completed", "Failed", "Canceled"}
+
+// containerProblemReasons are the reasons a container can be waiting that
+// mean it won't start without intervention.
+var containerProblemReasons = []string{
+	"CrashLoopBackOff",
+	"ImagePullBackOff",
+	"ErrImagePull",
+	"CreateContainerConfigError",
+	"InvalidImageName",
+}
+
+// AnalysisSummary groups the k8s resources of a VICE analysis with what the
+// database knows about it and a summary of its health.
+type AnalysisSummary struct {
+	ExternalID     string           `json:"external_id"`
+	AnalysisID     string           `json:"analysis_id"`
+	AnalysisName   string           `json:"analysis_name"`
+	AppID          string           `json:"app_id"`
+	AppName        string           `json:"app_name"`
+	UserID         string           `json:"user_id"`
+	Username       string           `json:"username"`
+	Status         string           `json:"status"`
+	PlannedEndDate string           `json:"planned_end_date,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	Health         string           `json:"health"`
+	HealthReasons  []string         `json:"health_reasons"`
+	Deployments    []DeploymentInfo `json:"deployments"`
+	Pods           []PodInfo        `json:"pods"`
+	ConfigMaps     []ConfigMapInfo  `json:"config_maps"`
+	Services       []ServiceInfo    `json:"services"`
+	Ingresses      []IngressInfo    `json:"ingresses"`
+
+	inDatabase bool
+}
+
+// AnalysisSummaryPage is a page of analysis summaries.
+type AnalysisSummaryPage struct {
+	Total    int               `json:"total"`
+	Offset   int               `json:"offset"`
+	Limit    int               `json:"limit"`
+	Analyses []AnalysisSummary `json:"analyses"`
+}
+
+// summaryFor returns the summary for the external ID, adding it to the map if
+// it isn't there yet. The metadata is filled in from the first resource found.
+func summaryFor(summaries map[string]*AnalysisSummary, meta MetaInfo, created time.Time) *AnalysisSummary {
+	s, ok := summaries[meta.ExternalID]
+	if !ok {
+		s = &AnalysisSummary{
+			ExternalID:    meta.ExternalID,
+			AnalysisName:  meta.AnalysisName,
+			AppID:         meta.AppID,
+			AppName:       meta.AppName,
+			UserID:        meta.UserID,
+			Username:      meta.Username,
+			CreatedAt:     created,
+			HealthReasons: []string{},
+			Deployments:   []DeploymentInfo{},
+			Pods:          []PodInfo{},
+			ConfigMaps:    []ConfigMapInfo{},
+			Services:      []ServiceInfo{},
+			Ingresses:     []IngressInfo{},
+		}
+		summaries[meta.ExternalID] = s
+	}
+	if created.Before(s.CreatedAt) {
+		s.CreatedAt = created
+	}
+	return s
+}
+
+// groupAnalyses lists the VICE resources matching the filter and groups them
+// by the external ID of the analysis they belong to. Resources without an
+// external ID are skipped.
+func (i *Internal) groupAnalyses(filter map[string]string, r *redactor) (map[string]*AnalysisSummary, error) {
+	summaries := map[string]*AnalysisSummary{}
+
+	depList, err := i.deploymentList(i.ViceNamespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range depList.Items {
+		info := deploymentInfo(&dep)
+		if info.ExternalID == "" {
+			continue
+		}
+		if r != nil {
+			r.deploymentInfo(info)
+		}
+		s := summaryFor(summaries, info.MetaInfo, dep.CreationTimestamp.Time)
+		s.Deployments = append(s.Deployments, *info)
+	}
+
+	podList, err := i.podList(i.ViceNamespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range podList.Items {
+		info := podInfo(&pod)
+		if info.ExternalID == "" {
+			continue
+		}
+		if r != nil {
+			r.podInfo(info)
+		}
+		s := summaryFor(summaries, info.MetaInfo, pod.CreationTimestamp.Time)
+		s.Pods = append(s.Pods, *info)
+	}
+
+	cmList, err := i.configmapsList(i.ViceNamespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, cm := range cmList.Items {
+		info := configMapInfo(&cm)
+		if info.ExternalID == "" {
+			continue
+		}
+		if r != nil {
+			r.configMapInfo(info)
+		}
+		s := summaryFor(summaries, info.MetaInfo, cm.CreationTimestamp.Time)
+		s.ConfigMaps = append(s.ConfigMaps, *info)
+	}
+
+	svcList, err := i.serviceList(i.ViceNamespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range svcList.Items {
+		info := serviceInfo(&svc)
+		if info.ExternalID == "" {
+			continue
+		}
+		s := summaryFor(summaries, info.MetaInfo, svc.CreationTimestamp.Time)
+		s.Services = append(s.Services, *info)
+	}
+
+	ingList, err := i.ingressList(i.ViceNamespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, ingress := range ingList.Items {
+		info := ingressInfo(&ingress)
+		if info.ExternalID == "" {
+			continue
+		}
+		s := summaryFor(summaries, info.MetaInfo, ingress.CreationTimestamp.Time)
+		s.Ingresses = append(s.Ingresses, *info)
+	}
+
+	return summaries, nil
+}
+
+// joinAnalyses fills in the summaries with the information about the analyses
+// in the database.
+func joinAnalyses(summaries map[string]*AnalysisSummary, analyses map[string]apps.Analysis) {
+	for externalID, s := range summaries {
+		analysis, ok := analyses[externalID]
+		if !ok {
+			continue
+		}
+		s.inDatabase = true
+		s.AnalysisID = analysis.ID
+		s.Status = analysis.Status
+		if analysis.Username != "" {
+			s.Username = analysis.Username
+		}
+		if analysis.PlannedEndDate.Valid {
+			s.PlannedEndDate = analysis.PlannedEndDate.Time.UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// podProblems returns the reasons the containers in the pod won't start on
+// their own.
+func podProblems(pod *PodInfo) []string {
+	problems := []string{}
+	if pod.Phase == string(corev1.PodFailed) {
+		problems = append(problems, fmt.Sprintf("pod %s failed: %s", pod.Name, pod.Reason))
+	}
+	for _, statuses := range [][]corev1.ContainerStatus{pod.InitContainerStatuses, pod.ContainerStatuses} {
+		for _, cs := range statuses {
+			if cs.State.Waiting != nil && containsString(containerProblemReasons, cs.State.Waiting.Reason) {
+				problems = append(problems, fmt.Sprintf("container %s in pod %s is waiting: %s", cs.Name, pod.Name, cs.State.Waiting.Reason))
+			}
+		}
+	}
+	return problems
+}
+
+// podReady returns true if all of the containers in the pod are running and
+// ready.
+func podReady(pod *PodInfo) bool {
+	if pod.Phase != string(corev1.PodRunning) || len(pod.ContainerStatuses) == 0 {
+		return false
+	}
+	for _, cs := range pod.ContainerStatuses {
+		if !cs.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// podScheduled returns true if the pod has been placed on a node, which is
+// when its containers start getting statuses.
+func podScheduled(pod *PodInfo) bool {
+	return pod.Phase != string(corev1.PodPending) || len(pod.InitContainerStatuses) > 0 || len(pod.ContainerStatuses) > 0
+}
+
+// analysisHealth derives the health of the analysis from its resources and
+// its status in the database, along with the reasons for it.
+//
+// An analysis is orphaned if the database doesn't know about it, says that
+// it's finished, or if its Deployment is gone. It's degraded if its Service
+// or Ingress is missing or its pod can't start without intervention. It's
+// pending until its pod is scheduled, starting until all of the containers
+// are ready, and ready after that.
+func analysisHealth(s *AnalysisSummary) (string, []string) {
+	reasons := []string{}
+
+	if !s.inDatabase {
+		reasons = append(reasons, "the analysis was not found in the database")
+	} else if containsString(terminalStatuses, s.Status) {
+		reasons = append(reasons, fmt.Sprintf("the analysis is %s in the database", s.Status))
+	}
+	if len(s.Deployments) == 0 {
+		reasons = append(reasons, "the deployment is missing")
+	}
+	if len(reasons) > 0 {
+		return healthOrphaned, reasons
+	}
+
+	if len(s.Services) == 0 {
+		reasons = append(reasons, "the service is missing")
+	}
+	if len(s.Ingresses) == 0 {
+		reasons = append(reasons, "the ingress is missing")
+	}
+	for idx := range s.Pods {
+		reasons = append(reasons, podProblems(&s.Pods[idx])...)
+	}
+	if len(reasons) > 0 {
+		return healthDegraded, reasons
+	}
+
+	if len(s.Pods) == 0 {
+		return healthPending, []string{"the deployment has no pods"}
+	}
+
+	scheduled := false
+	for idx := range s.Pods {
+		if podReady(&s.Pods[idx]) {
+			return healthReady, reasons
+		}
+		if podScheduled(&s.Pods[idx]) {
+			scheduled = true
+		}
+	}
+
+	if !scheduled {
+		return healthPending, []string{"the pod has not been scheduled"}
+	}
+	return healthStarting, []string{"not all of the containers are ready"}
+}
+
+// healthOrder is used to sort analyses by health, worst first.
+var healthOrder = map[string]int{
+	healthOrphaned: 0,
+	healthDegraded: 1,
+	healthPending:  2,
+	healthStarting: 3,
+	healthReady:    4,
+}
+
+// sortAnalyses sorts the summaries by the field. Ties are broken by creation
+// time and then external ID so pages are stable.
+func sortAnalyses(summaries []AnalysisSummary, field string, desc bool) error {
+	var less func(a, b *AnalysisSummary) bool
+
+	switch field {
+	case "", "created_at":
+		less = func(a, b *AnalysisSummary) bool { return a.CreatedAt.Before(b.CreatedAt) }
+	case "username":
+		less = func(a, b *AnalysisSummary) bool { return a.Username < b.Username }
+	case "app_name":
+		less = func(a, b *AnalysisSummary) bool { return a.AppName < b.AppName }
+	case "analysis_name":
+		less = func(a, b *AnalysisSummary) bool { return a.AnalysisName < b.AnalysisName }
+	case "status":
+		less = func(a, b *AnalysisSummary) bool { return a.Status < b.Status }
+	case "planned_end_date":
+		less = func(a, b *AnalysisSummary) bool { return a.PlannedEndDate < b.PlannedEndDate }
+	case "health":
+		less = func(a, b *AnalysisSummary) bool { return healthOrder[a.Health] < healthOrder[b.Health] }
+	default:
+		return fmt.Errorf("analyses can't be sorted by %s", field)
+	}
+
+	sort.SliceStable(summaries, func(x, y int) bool {
+		a, b := &summaries[x], &summaries[y]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ExternalID < b.ExternalID
+	})
+
+	return nil
+}
+
+// paginateAnalyses returns the page of summaries starting at the offset.
+func paginateAnalyses(summaries []AnalysisSummary, offset, limit int) []AnalysisSummary {
+	if offset >= len(summaries) {
+		return []AnalysisSummary{}
+	}
+	end := offset + limit
+	if end > len(summaries) {
+		end = len(summaries)
+	}
+	return summaries[offset:end]
+}
+
+// intParam returns the value of the query parameter as a non-negative integer,
+// or the default if it's not set.
+func intParam(request *http.Request, name string, def int) (int, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, not %s", name, value)
+	}
+	return n, nil
+}
+
+// requireAdmin writes a 403 to the response and returns false if the user in
+// the request isn't an admin.
+func (i *Internal) requireAdmin(writer http.ResponseWriter, request *http.Request) bool {
+	if !i.isAdmin(request.URL.Query().Get("user")) {
+		http.Error(writer, "only admins can use this endpoint", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// AdminListAnalyses is the handler for the admin analyses endpoint. It groups
+// the k8s resources of each VICE analysis together, joins them with the
+// information in the database, and summarizes the health of the analysis.
+//
+// Query Parameters:
+//   user - Required. The user making the request, who must be an admin.
+//   view - Optional. Set to full to turn off redaction.
+//   health - Optional. Only include analyses with this health.
+//   sort - Optional. The field to sort by, defaults to created_at.
+//   order - Optional. asc or desc, defaults to desc.
+//   limit - Optional. The page size, defaults to 50.
+//   offset - Optional. The number of analyses to skip.
+//
+// All other query parameters are used as label filters, like the listing
+// endpoints.
+func (i *Internal) AdminListAnalyses(writer http.ResponseWriter, request *http.Request) {
+	if !i.requireAdmin(writer, request) {
+		return
+	}
+
+	query := request.URL.Query()
+
+	r, status, err := i.listingRedactor(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+
+	limit, err := intParam(request, "limit", defaultAnalysesLimit)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 || limit > maxAnalysesLimit {
+		limit = maxAnalysesLimit
+	}
+
+	offset, err := intParam(request, "offset", 0)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var desc bool
+	switch strings.ToLower(query.Get("order")) {
+	case "", "desc":
+		desc = true
+	case "asc":
+		desc = false
+	default:
+		http.Error(writer, fmt.Sprintf("order must be asc or desc, not %s", query.Get("order")), http.StatusBadRequest)
+		return
+	}
+
+	filter := listingFilter(request)
+	for _, p := range adminAnalysesParams {
+		delete(filter, p)
+	}
+
+	grouped, err := i.groupAnalyses(filter, r)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	externalIDs := []string{}
+	for externalID := range grouped {
+		externalIDs = append(externalIDs, externalID)
+	}
+
+	analyses, err := apps.NewApps(i.db).GetAnalysesByExternalIDs(externalIDs)
+	if err != nil {
+		http.Error(writer, errors.Wrap(err, "error looking up the analyses").Error(), http.StatusInternalServerError)
+		return
+	}
+	joinAnalyses(grouped, analyses)
+
+	healthFilter := query.Get("health")
+	summaries := []AnalysisSummary{}
+	for _, s := range grouped {
+		s.Health, s.HealthReasons = analysisHealth(s)
+		if healthFilter != "" && s.Health != healthFilter {
+			continue
+		}
+		summaries = append(summaries, *s)
+	}
+
+	if err = sortAnalyses(summaries, query.Get("sort"), desc); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf, err := json.Marshal(AnalysisSummaryPage{
+		Total:    len(summaries),
+		Offset:   offset,
+		Limit:    limit,
+		Analyses: paginateAnalyses(summaries, offset, limit),
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func testSummary(externalID string) *AnalysisSummary {
+	return &AnalysisSummary{
+		ExternalID:  externalID,
+		Status:      "Running",
+		Deployments: []DeploymentInfo{{}},
+		Services:    []ServiceInfo{{}},
+		Ingresses:   []IngressInfo{{}},
+		inDatabase:  true,
+	}
+}
+
+func TestAnalysisHealth(t *testing.T) {
+	ready := []corev1.ContainerStatus{{Name: "analysis", Ready: true}}
+
+	s := testSummary("a")
+	s.Pods = []PodInfo{{Phase: string(corev1.PodRunning), ContainerStatuses: ready}}
+	if health, reasons := analysisHealth(s); health != healthReady {
+		t.Errorf("a running analysis is %s: %v", health, reasons)
+	}
+
+	s = testSummary("a")
+	if health, _ := analysisHealth(s); health != healthPending {
+		t.Errorf("an analysis without pods is %s", health)
+	}
+
+	s.Pods = []PodInfo{{Phase: string(corev1.PodPending)}}
+	if health, _ := analysisHealth(s); health != healthPending {
+		t.Errorf("an unscheduled analysis is %s", health)
+	}
+
+	s.Pods[0].InitContainerStatuses = []corev1.ContainerStatus{{Name: fileTransfersInitContainerName}}
+	if health, _ := analysisHealth(s); health != healthStarting {
+		t.Errorf("an analysis downloading its inputs is %s", health)
+	}
+
+	s.Pods[0].ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  analysisContainerName,
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+	}}
+	if health, _ := analysisHealth(s); health != healthDegraded {
+		t.Errorf("an analysis that can't pull its image is %s", health)
+	}
+
+	s = testSummary("a")
+	s.Ingresses = nil
+	if health, _ := analysisHealth(s); health != healthDegraded {
+		t.Errorf("an analysis without an ingress is %s", health)
+	}
+
+	s = testSummary("a")
+	s.Status = "Completed"
+	if health, _ := analysisHealth(s); health != healthOrphaned {
+		t.Errorf("a completed analysis with resources is %s", health)
+	}
+
+	s = testSummary("a")
+	s.inDatabase = false
+	if health, _ := analysisHealth(s); health != healthOrphaned {
+		t.Errorf("an analysis missing from the database is %s", health)
+	}
+}
+
+func TestJoinAnalyses(t *testing.T) {
+	summaries := map[string]*AnalysisSummary{
+		"a": {ExternalID: "a", Username: "slug"},
+		"b": {ExternalID: "b"},
+	}
+
+	joinAnalyses(summaries, map[string]apps.Analysis{
+		"a": {ID: "1", ExternalID: "a", Status: "Running", Username: "user@example.org"},
+	})
+
+	if !summaries["a"].inDatabase || summaries["a"].AnalysisID != "1" || summaries["a"].Username != "user@example.org" {
+		t.Errorf("unexpected summary %+v", summaries["a"])
+	}
+	if summaries["b"].inDatabase {
+		t.Error("an analysis without a database record was joined")
+	}
+}
+
+func TestSortAndPaginateAnalyses(t *testing.T) {
+	now := time.Now()
+	summaries := []AnalysisSummary{
+		{ExternalID: "a", Username: "carol", Health: healthReady, CreatedAt: now.Add(-2 * time.Hour)},
+		{ExternalID: "b", Username: "alice", Health: healthOrphaned, CreatedAt: now},
+		{ExternalID: "c", Username: "bob", Health: healthDegraded, CreatedAt: now.Add(-time.Hour)},
+	}
+
+	order := func() string {
+		ids := ""
+		for _, s := range summaries {
+			ids += s.ExternalID
+		}
+		return ids
+	}
+
+	if err := sortAnalyses(summaries, "", true); err != nil || order() != "bca" {
+		t.Errorf("sorting by newest returned %s, %v", order(), err)
+	}
+	if err := sortAnalyses(summaries, "username", false); err != nil || order() != "bca" {
+		t.Errorf("sorting by username returned %s, %v", order(), err)
+	}
+	if err := sortAnalyses(summaries, "health", false); err != nil || order() != "bca" {
+		t.Errorf("sorting by health returned %s, %v", order(), err)
+	}
+	if err := sortAnalyses(summaries, "health", true); err != nil || order() != "acb" {
+		t.Errorf("sorting by health descending returned %s, %v", order(), err)
+	}
+	if err := sortAnalyses(summaries, "image", false); err == nil {
+		t.Error("sorting by an unknown field didn't fail")
+	}
+
+	if page := paginateAnalyses(summaries, 1, 1); len(page) != 1 || page[0].ExternalID != "c" {
+		t.Errorf("unexpected page %v", page)
+	}
+	if page := paginateAnalyses(summaries, 2, 5); len(page) != 1 {
+		t.Errorf("unexpected last page %v", page)
+	}
+	if page := paginateAnalyses(summaries, 5, 5); len(page) != 0 {
+		t.Errorf("unexpected page past the end %v", page)
+	}
+}
+
+func TestAdminListAnalysesRequiresAdmin(t *testing.T) {
+	i := &Internal{Init: Init{AdminUsers: []string{"admin"}}}
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/admin/analyses?user=someone", nil)
+	rec := httptest.NewRecorder()
+	i.AdminListAnalyses(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("a non-admin got a %d", rec.Code)
+	}
+}
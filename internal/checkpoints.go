@@ -0,0 +1,413 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// checkpointKind is the kind of the uploads started by checkpoints. It shows
+// up in the status updates for them.
+const checkpointKind = "checkpoint upload"
+
+// The outcomes of a checkpoint.
+const (
+	CheckpointCompleted = "completed"
+	CheckpointFailed    = "failed"
+	CheckpointSkipped   = "skipped"
+)
+
+// Checkpoint is the schedule for periodically uploading the output files of an
+// analysis, along with the outcome of the last checkpoint. Schedules are stored
+// in the database so that they survive app-exposer restarts.
+type Checkpoint struct {
+	ExternalID  string     `json:"external_id"`
+	Interval    string     `json:"interval"`
+	NextRunAt   time.Time  `json:"next_run_at"`
+	LastRunAt   *time.Time `json:"last_run_at,omitempty"`
+	LastStatus  string     `json:"last_status,omitempty"`
+	LastMessage string     `json:"last_message,omitempty"`
+
+	interval time.Duration
+}
+
+// CheckpointRequest is the body of a request to schedule checkpoints.
+type CheckpointRequest struct {
+	// How often the output files are uploaded, e.g. 30m or 2h.
+	Interval string `json:"interval"`
+}
+
+// $2 is typed as a bigint for both of its uses, since Postgres won't deduce
+// two different types for the same parameter.
+const upsertCheckpointSQL = `
+	INSERT INTO vice_checkpoints (external_id, interval_seconds, next_run_at)
+	VALUES ($1, $2::bigint, now() + make_interval(secs => $2::bigint::double precision))
+	    ON CONFLICT (external_id) DO UPDATE
+	   SET interval_seconds = EXCLUDED.interval_seconds,
+	       next_run_at = EXCLUDED.next_run_at
+`
+
+const getCheckpointSQL = `
+	SELECT external_id, interval_seconds, next_run_at, last_run_at,
+	       COALESCE(last_status, ''), COALESCE(last_message, '')
+	  FROM vice_checkpoints
+	 WHERE external_id = $1
+`
+
+const deleteCheckpointSQL = `
+	DELETE FROM vice_checkpoints WHERE external_id = $1
+`
+
+const recordCheckpointSQL = `
+	UPDATE vice_checkpoints
+	   SET last_run_at = now(), last_status = $2, last_message = $3
+	 WHERE external_id = $1
+`
+
+// Claiming a checkpoint moves its next run forward, so each checkpoint is only
+// run by one app-exposer instance.
+const claimDueCheckpointsSQL = `
+	UPDATE vice_checkpoints
+	   SET next_run_at = now() + make_interval(secs => interval_seconds::double precision)
+	 WHERE external_id IN (
+		SELECT external_id
+		  FROM vice_checkpoints
+		 WHERE next_run_at <= now()
+		   FOR UPDATE SKIP LOCKED
+	 )
+	RETURNING external_id, interval_seconds, next_run_at, last_run_at,
+	          COALESCE(last_status, ''), COALESCE(last_message, '')
+`
+
+// checkpointMinInterval returns the shortest interval users can choose.
+func (i *Internal) checkpointMinInterval() time.Duration {
+	if i.CheckpointMinInterval > 0 {
+		return i.CheckpointMinInterval
+	}
+	return 15 * time.Minute
+}
+
+// parseCheckpointInterval parses the interval chosen for an analysis's
+// checkpoints, which can't be shorter than the configured minimum.
+func (i *Internal) parseCheckpointInterval(interval string) (time.Duration, error) {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint interval %q", interval)
+	}
+
+	if min := i.checkpointMinInterval(); d < min {
+		return 0, fmt.Errorf("the checkpoint interval %s is shorter than the minimum of %s", d, min)
+	}
+
+	return d, nil
+}
+
+type checkpointScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCheckpoint(row checkpointScanner) (*Checkpoint, error) {
+	var (
+		cp      = &Checkpoint{}
+		seconds int64
+	)
+
+	err := row.Scan(&cp.ExternalID, &seconds, &cp.NextRunAt, &cp.LastRunAt, &cp.LastStatus, &cp.LastMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.interval = time.Duration(seconds) * time.Second
+	cp.Interval = cp.interval.String()
+	return cp, nil
+}
+
+// scheduleCheckpoints stores the checkpoint schedule for the analysis. The
+// first checkpoint happens one interval from now.
+func (i *Internal) scheduleCheckpoints(externalID string, interval time.Duration) (*Checkpoint, error) {
+	if _, err := i.db.Exec(upsertCheckpointSQL, externalID, int64(interval/time.Second)); err != nil {
+		return nil, errors.Wrapf(err, "error scheduling checkpoints for %s", externalID)
+	}
+	return i.getCheckpoint(externalID)
+}
+
+// getCheckpoint returns the checkpoint schedule for the analysis.
+func (i *Internal) getCheckpoint(externalID string) (*Checkpoint, error) {
+	return scanCheckpoint(i.db.QueryRow(getCheckpointSQL, externalID))
+}
+
+// unscheduleCheckpoints removes the checkpoint schedule for the analysis,
+// returning false if it didn't have one.
+func (i *Internal) unscheduleCheckpoints(externalID string) (bool, error) {
+	result, err := i.db.Exec(deleteCheckpointSQL, externalID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error removing the checkpoint schedule for %s", externalID)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// recordCheckpoint stores the outcome of a checkpoint and sends it to the job
+// status listener.
+func (i *Internal) recordCheckpoint(externalID, status, msg string) {
+	if _, err := i.db.Exec(recordCheckpointSQL, externalID, status, msg); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the checkpoint for %s", externalID))
+	}
+	i.publishRunning(externalID, msg)
+}
+
+// isRunning returns true if the transfer hasn't finished yet.
+func (t *Transfer) isRunning() bool {
+	switch t.Status {
+	case RequestedStatus, UploadingStatus, DownloadingStatus:
+		return true
+	default:
+		return false
+	}
+}
+
+// transferRunning returns true if any of the file transfer services for the
+// analysis has an upload or download that hasn't finished. The second return
+// value is false if the analysis doesn't have any file transfer services.
+func (i *Internal) transferRunning(ctx context.Context, externalID string) (bool, bool, error) {
+	svcs, err := i.transferServices(externalID)
+	if err != nil {
+		return false, false, err
+	}
+	if len(svcs) == 0 {
+		return false, false, nil
+	}
+
+	for _, svc := range svcs {
+		for _, tk := range transferKinds {
+			listed, err := i.listTransfers(ctx, svc, tk.reqpath)
+			if err != nil {
+				return false, true, err
+			}
+			for _, t := range listed {
+				if t.isRunning() {
+					return true, true, nil
+				}
+			}
+		}
+	}
+
+	return false, true, nil
+}
+
+// runCheckpoint uploads the output files of the analysis, unless a transfer is
+// already running. A failed checkpoint doesn't affect the analysis, which
+// keeps running until the next one. The schedule is removed if the analysis
+// is gone.
+//
+// A checkpoint is stopped if it's still running when the next one is due, so
+// an upload that's stuck doesn't keep the following checkpoints from running.
+func (i *Internal) runCheckpoint(cp *Checkpoint) {
+	id := cp.ExternalID
+
+	timeout := cp.interval
+	if timeout <= 0 {
+		timeout = i.checkpointMinInterval()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	running, found, err := i.transferRunning(ctx, id)
+	if err != nil {
+		msg := fmt.Sprintf("checkpoint failed for job %s: unable to check for running file transfers: %s", id, err.Error())
+		log.Error(msg)
+		i.recordCheckpoint(id, CheckpointFailed, msg)
+		return
+	}
+
+	if !found {
+		log.Infof("removing the checkpoint schedule for %s, which is no longer running", id)
+		if _, err = i.unscheduleCheckpoints(id); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if running {
+		msg := fmt.Sprintf("checkpoint skipped for job %s because a file transfer is already running", id)
+		log.Info(msg)
+		i.recordCheckpoint(id, CheckpointSkipped, msg)
+		return
+	}
+
+	log.Infof("starting %s transfers for job %s", checkpointKind, id)
+	err = i.transferAll(id, checkpointKind, false, func(svc apiv1.Service) error {
+		return i.runTransfer(ctx, svc, id, uploadBasePath, checkpointKind, nil)
+	})
+	if err != nil {
+		msg := fmt.Sprintf("checkpoint failed for job %s: %s", id, err.Error())
+		if ctx.Err() == context.DeadlineExceeded {
+			msg = fmt.Sprintf("checkpoint failed for job %s: the upload didn't finish within %s", id, timeout)
+		}
+		log.Error(msg)
+		i.recordCheckpoint(id, CheckpointFailed, msg)
+		return
+	}
+
+	i.recordCheckpoint(id, CheckpointCompleted, fmt.Sprintf("checkpoint saved the output files for job %s", id))
+}
+
+// claimDueCheckpoints returns the checkpoints whose time has come, moving their
+// next runs forward.
+func (i *Internal) claimDueCheckpoints() ([]*Checkpoint, error) {
+	rows, err := i.db.Query(claimDueCheckpointsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []*Checkpoint{}
+	for rows.Next() {
+		cp, err := scanCheckpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return checkpoints, nil
+}
+
+// runDueCheckpoints runs the checkpoints whose time has come. Each one runs in
+// its own goroutine.
+func (i *Internal) runDueCheckpoints() error {
+	checkpoints, err := i.claimDueCheckpoints()
+	if err != nil {
+		return err
+	}
+
+	for _, cp := range checkpoints {
+		go i.runCheckpoint(cp)
+	}
+
+	return nil
+}
+
+// RunCheckpoints fires up a goroutine that periodically runs the checkpoints
+// that are due.
+func (i *Internal) RunCheckpoints() {
+	go func() {
+		interval := i.CheckpointCheckInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := i.runDueCheckpoints(); err != nil {
+				log.Error(errors.Wrap(err, "error running checkpoints"))
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// VICEGetCheckpoints returns the checkpoint schedule for an analysis.
+func (i *Internal) VICEGetCheckpoints(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	cp, err := i.getCheckpoint(id)
+	if err == sql.ErrNoRows {
+		http.Error(writer, fmt.Sprintf("checkpoints aren't scheduled for analysis %s", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(buf)
+}
+
+// VICEScheduleCheckpoints sets how often the output files of a running
+// analysis are uploaded. The body is a CheckpointRequest.
+func (i *Internal) VICEScheduleCheckpoints(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	buf, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &CheckpointRequest{}
+	if err = json.Unmarshal(buf, req); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	interval, err := i.parseCheckpointInterval(req.Interval)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(svcs) == 0 {
+		http.Error(writer, fmt.Sprintf("no services found for analysis %s", id), http.StatusNotFound)
+		return
+	}
+
+	cp, err := i.scheduleCheckpoints(id, interval)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(cp)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(buf)
+}
+
+// VICEUnscheduleCheckpoints stops the periodic uploads for an analysis.
+func (i *Internal) VICEUnscheduleCheckpoints(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	removed, err := i.unscheduleCheckpoints(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(writer, fmt.Sprintf("checkpoints aren't scheduled for analysis %s", id), http.StatusNotFound)
+		return
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseCheckpointInterval(t *testing.T) {
+	i := &Internal{Init: Init{CheckpointMinInterval: 10 * time.Minute}}
+
+	d, err := i.parseCheckpointInterval("30m")
+	if err != nil || d != 30*time.Minute {
+		t.Errorf("unexpected interval %s, %v", d, err)
+	}
+
+	if _, err = i.parseCheckpointInterval("5m"); err == nil {
+		t.Error("an interval shorter than the minimum was accepted")
+	}
+
+	if _, err = i.parseCheckpointInterval("often"); err == nil {
+		t.Error("an invalid interval was accepted")
+	}
+
+	i.CheckpointMinInterval = 0
+	if _, err = i.parseCheckpointInterval("10m"); err == nil {
+		t.Error("an interval shorter than the default minimum was accepted")
+	}
+}
+
+func TestTransferIsRunning(t *testing.T) {
+	for status, expected := range map[string]bool{
+		RequestedStatus:   true,
+		UploadingStatus:   true,
+		DownloadingStatus: true,
+		CompletedStatus:   false,
+		FailedStatus:      false,
+	} {
+		transfer := &Transfer{Status: status}
+		if transfer.isRunning() != expected {
+			t.Errorf("isRunning for a %s transfer returned %t", status, !expected)
+		}
+	}
+}
+
+// checkpointStatuses returns the outcomes recorded for checkpoints.
+func checkpointStatuses(db *fakeDB) []string {
+	statuses := []string{}
+	for _, args := range db.called("SET last_run_at") {
+		statuses = append(statuses, args[1].(string))
+	}
+	return statuses
+}
+
+func TestClaimDueCheckpoints(t *testing.T) {
+	db, sqldb := newFakeDB(t)
+	i := &Internal{db: sqldb}
+
+	next := time.Now().Add(30 * time.Minute)
+	db.on("FOR UPDATE SKIP LOCKED", []string{"external_id", "interval_seconds", "next_run_at", "last_run_at", "last_status", "last_message"},
+		[]driver.Value{"a", int64(1800), next, nil, "", ""},
+		[]driver.Value{"b", int64(3600), next, next.Add(-time.Hour), CheckpointSkipped, "skipped"},
+	)
+
+	checkpoints, err := i.claimDueCheckpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 2 {
+		t.Fatalf("%d checkpoints were claimed", len(checkpoints))
+	}
+	if cp := checkpoints[0]; cp.ExternalID != "a" || cp.Interval != "30m0s" || cp.interval != 30*time.Minute || cp.LastRunAt != nil {
+		t.Errorf("unexpected checkpoint %+v", cp)
+	}
+	if cp := checkpoints[1]; cp.ExternalID != "b" || cp.LastRunAt == nil || cp.LastStatus != CheckpointSkipped {
+		t.Errorf("unexpected checkpoint %+v", cp)
+	}
+}
+
+func TestRunCheckpoint(t *testing.T) {
+	i, db, _, transfers := testSaveAndExit(t)
+	transfers.set("GET /upload", `{"transfers": [{"uuid": "old", "status": "completed"}]}`)
+	transfers.set("GET /download", `{"transfers": []}`)
+	transfers.set("POST /upload", `{"uuid": "u", "status": "requested"}`)
+	transfers.set("GET /upload/u", `{"uuid": "u", "status": "completed"}`)
+
+	i.runCheckpoint(&Checkpoint{ExternalID: "a", interval: time.Minute})
+
+	if statuses := checkpointStatuses(db); len(statuses) != 1 || statuses[0] != CheckpointCompleted {
+		t.Errorf("unexpected checkpoint outcomes %v", statuses)
+	}
+}
+
+func TestRunCheckpointSkipsRunningTransfer(t *testing.T) {
+	i, db, _, transfers := testSaveAndExit(t)
+	transfers.set("GET /upload", `{"transfers": []}`)
+	transfers.set("GET /download", `{"transfers": [{"uuid": "d", "status": "downloading"}]}`)
+
+	i.runCheckpoint(&Checkpoint{ExternalID: "a", interval: time.Minute})
+
+	if statuses := checkpointStatuses(db); len(statuses) != 1 || statuses[0] != CheckpointSkipped {
+		t.Errorf("unexpected checkpoint outcomes %v", statuses)
+	}
+	if transfers.received("POST /upload") {
+		t.Error("an upload was started while a download was running")
+	}
+}
+
+func TestRunCheckpointStuckUpload(t *testing.T) {
+	i, db, _, transfers := testSaveAndExit(t)
+	transfers.set("GET /upload", `{"transfers": []}`)
+	transfers.set("GET /download", `{"transfers": []}`)
+	transfers.set("POST /upload", `{"uuid": "u", "status": "requested"}`)
+	transfers.set("GET /upload/u", `{"uuid": "u", "status": "uploading"}`)
+
+	done := make(chan struct{})
+	go func() {
+		i.runCheckpoint(&Checkpoint{ExternalID: "a", interval: 50 * time.Millisecond})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the checkpoint kept waiting on an upload that never finished")
+	}
+
+	if statuses := checkpointStatuses(db); len(statuses) != 1 || statuses[0] != CheckpointFailed {
+		t.Errorf("unexpected checkpoint outcomes %v", statuses)
+	}
+}
+
+func TestRunCheckpointUnschedulesStoppedAnalysis(t *testing.T) {
+	db, sqldb := newFakeDB(t)
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		db:        sqldb,
+		clientset: fake.NewSimpleClientset(),
+	}
+
+	i.runCheckpoint(&Checkpoint{ExternalID: "a", interval: time.Minute})
+
+	if deletes := db.called("DELETE FROM vice_checkpoints"); len(deletes) != 1 || deletes[0][0] != "a" {
+		t.Errorf("the schedule wasn't removed: %v", deletes)
+	}
+	if statuses := checkpointStatuses(db); len(statuses) != 0 {
+		t.Errorf("outcomes were recorded for an analysis that isn't running: %v", statuses)
+	}
+}
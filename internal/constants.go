@@ -24,6 +24,23 @@ const (
 	inputPathListMountPath  = "/input-paths"
 	inputPathListFileName   = "input-path-list"
 	inputPathListVolumeName = "input-path-list"
+	inputTicketListFileName = "input-ticket-list"
+
+	sharingMountPath  = "/etc/vice-sharing"
+	sharingFileName   = "allowed-users"
+	sharingVolumeName = "vice-sharing"
+
+	homeVolumeName         = "vice-home"
+	homeVolumeLabel        = "vice-volume"
+	homeVolumeLabelValue   = "home"
+	homeVolumeLastUsed     = "vice-last-used"
+	defaultHomeVolumeSize  = "10Gi"
+	defaultHomeVolumeMount = "/home/vice"
+
+	secretsVolumeName       = "vice-secrets"
+	secretStoreLabel        = "vice-secret"
+	secretStoreLabelValue   = "user-store"
+	defaultSecretsMountPath = "/etc/vice-secrets"
 
 	irodsConfigFilePath = "/etc/porklock/irods-config.properties"
 
@@ -49,6 +66,8 @@ const (
 	viceAffinityOperator = "In"
 	viceAffinityValue    = "true"
 
+	gpuResourceName = "nvidia.com/gpu"
+
 	gpuAffinityKey      = "gpu"
 	gpuAffinityOperator = "In"
 	gpuAffinityValue    = "true"
@@ -56,3 +75,4 @@ const (
 
 func int32Ptr(i int32) *int32 { return &i }
 func int64Ptr(i int64) *int64 { return &i }
+func boolPtr(b bool) *bool    { return &b }
@@ -3,8 +3,8 @@ package internal
 import (
 	"fmt"
 	"net/url"
+	"path"
 	"strconv"
-	"strings"
 
 	"gopkg.in/cyverse-de/model.v4"
 	appsv1 "k8s.io/api/apps/v1"
@@ -34,7 +34,7 @@ func analysisPorts(step *model.Step) []apiv1.ContainerPort {
 // it returns the objects that can be included in the Deployment object that
 // will get passed to the k8s API later. Also not that these are the Volumes,
 // not the container-specific VolumeMounts.
-func deploymentVolumes(job *model.Job) []apiv1.Volume {
+func deploymentVolumes(job *model.Job, backend StorageBackend) []apiv1.Volume {
 	output := []apiv1.Volume{}
 
 	if len(job.FilterInputsWithoutTickets()) > 0 {
@@ -57,20 +57,27 @@ func deploymentVolumes(job *model.Job) []apiv1.Volume {
 				EmptyDir: &apiv1.EmptyDirVolumeSource{},
 			},
 		},
+	)
+
+	output = append(output, backend.volumes()...)
+
+	output = append(output,
 		apiv1.Volume{
-			Name: porklockConfigVolumeName,
+			Name: excludesVolumeName,
 			VolumeSource: apiv1.VolumeSource{
-				Secret: &apiv1.SecretVolumeSource{
-					SecretName: porklockConfigSecretName,
+				ConfigMap: &apiv1.ConfigMapVolumeSource{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: excludesConfigMapName(job),
+					},
 				},
 			},
 		},
 		apiv1.Volume{
-			Name: excludesVolumeName,
+			Name: sharingVolumeName,
 			VolumeSource: apiv1.VolumeSource{
 				ConfigMap: &apiv1.ConfigMapVolumeSource{
 					LocalObjectReference: apiv1.LocalObjectReference{
-						Name: excludesConfigMapName(job),
+						Name: sharingConfigMapName(job.InvocationID),
 					},
 				},
 			},
@@ -104,6 +111,7 @@ func (i *Internal) viceProxyCommand(job *model.Job) []string {
 		"--external-id", job.InvocationID,
 		"--get-analysis-id-base", fmt.Sprintf("http://%s.%s", i.GetAnalysisIDService, i.VICEBackendNamespace),
 		"--check-resource-access-base", fmt.Sprintf("http://%s.%s", i.CheckResourceAccessService, i.VICEBackendNamespace),
+		"--allowed-users-file", path.Join(sharingMountPath, sharingFileName),
 	}
 
 	return output
@@ -123,6 +131,57 @@ func memResourceLimit(job *model.Job) int64 {
 	return 8589934592 // 8 GB in bytes
 }
 
+// cpuResourceRequest returns the number of cores requested for the analysis
+// container. Uses the minimum set for the job if there is one, otherwise the
+// configured fraction of the limit, otherwise 1 core. Never exceeds the limit.
+func (i *Internal) cpuResourceRequest(job *model.Job) float32 {
+	var request float32
+
+	limit := cpuResourceLimit(job)
+
+	if job.Steps[0].Component.Container.MinCPUCores != 0 {
+		request = job.Steps[0].Component.Container.MinCPUCores
+	} else if i.ResourceRequestRatio > 0 {
+		request = limit * float32(i.ResourceRequestRatio)
+	} else {
+		request = 1
+	}
+
+	if request > limit {
+		return limit
+	}
+	return request
+}
+
+// memResourceRequest returns the number of bytes of memory requested for the
+// analysis container. Uses the minimum set for the job if there is one,
+// otherwise the configured fraction of the limit, otherwise 2GiB. Never
+// exceeds the limit.
+func (i *Internal) memResourceRequest(job *model.Job) int64 {
+	var request int64
+
+	limit := memResourceLimit(job)
+
+	if job.Steps[0].Component.Container.MinMemoryLimit != 0 {
+		request = job.Steps[0].Component.Container.MinMemoryLimit
+	} else if i.ResourceRequestRatio > 0 {
+		request = int64(float64(limit) * i.ResourceRequestRatio)
+	} else {
+		request = 2147483648 // 2 GiB in bytes
+	}
+
+	if request > limit {
+		return limit
+	}
+	return request
+}
+
+// diskResourceRequest returns the number of bytes of ephemeral storage
+// requested for the analysis container, or 0 if the job doesn't set one.
+func diskResourceRequest(job *model.Job) int64 {
+	return job.Steps[0].Component.Container.MinDiskSpace
+}
+
 var (
 	defaultCPUResourceRequest, _ = resourcev1.ParseQuantity("1000m")
 	defaultMemResourceRequest, _ = resourcev1.ParseQuantity("2Gi")
@@ -130,17 +189,97 @@ var (
 	defaultMemResourceLimit, _   = resourcev1.ParseQuantity("32Gi")
 )
 
+// analysisResources returns the resource requests and limits for the analysis
+// container.
+func (i *Internal) analysisResources(job *VICEJob) apiv1.ResourceRequirements {
+	cpuLimit, err := resourcev1.ParseQuantity(fmt.Sprintf("%fm", cpuResourceLimit(&job.Job)*1000))
+	if err != nil {
+		log.Warn(err)
+		cpuLimit = defaultCPUResourceLimit
+	}
+
+	memLimit, err := resourcev1.ParseQuantity(fmt.Sprintf("%d", memResourceLimit(&job.Job)))
+	if err != nil {
+		log.Warn(err)
+		memLimit = defaultMemResourceLimit
+	}
+
+	cpuRequest, err := resourcev1.ParseQuantity(fmt.Sprintf("%fm", i.cpuResourceRequest(&job.Job)*1000))
+	if err != nil {
+		log.Warn(err)
+		cpuRequest = defaultCPUResourceRequest
+	}
+
+	memRequest, err := resourcev1.ParseQuantity(fmt.Sprintf("%d", i.memResourceRequest(&job.Job)))
+	if err != nil {
+		log.Warn(err)
+		memRequest = defaultMemResourceRequest
+	}
+
+	limits := apiv1.ResourceList{
+		apiv1.ResourceCPU:    cpuLimit, //job contains # cores
+		apiv1.ResourceMemory: memLimit, // job contains # bytes mem
+	}
+
+	requests := apiv1.ResourceList{
+		apiv1.ResourceCPU:    cpuRequest,
+		apiv1.ResourceMemory: memRequest,
+	}
+
+	// If GPUs are requested, then add them to the resource limits.
+	gpu, err := i.gpuRequest(job)
+	if err != nil {
+		log.Warn(err)
+	} else if gpu != nil {
+		gpuLimit, err := resourcev1.ParseQuantity(fmt.Sprintf("%d", gpu.Count))
+		if err != nil {
+			log.Warn(err)
+		} else {
+			limits[apiv1.ResourceName(gpu.Model.Resource)] = gpuLimit
+		}
+	}
+
+	// The working directory is an EmptyDir, so whatever the analysis writes
+	// counts against the node's ephemeral storage.
+	if disk := diskResourceRequest(&job.Job); disk > 0 {
+		diskRequest, err := resourcev1.ParseQuantity(fmt.Sprintf("%d", disk))
+		if err != nil {
+			log.Warn(err)
+		} else {
+			requests[apiv1.ResourceEphemeralStorage] = diskRequest
+		}
+	}
+
+	if i.EphemeralStorageLimit != "" {
+		diskLimit, err := resourcev1.ParseQuantity(i.EphemeralStorageLimit)
+		if err != nil {
+			log.Warn(err)
+		} else {
+			if diskRequest, ok := requests[apiv1.ResourceEphemeralStorage]; ok && diskRequest.Cmp(diskLimit) > 0 {
+				diskLimit = diskRequest
+			}
+			limits[apiv1.ResourceEphemeralStorage] = diskLimit
+		}
+	}
+
+	return apiv1.ResourceRequirements{
+		Limits:   limits,
+		Requests: requests,
+	}
+}
+
 // initContainers returns a []apiv1.Container used for the InitContainers in
 // the VICE app Deployment resource.
-func (i *Internal) initContainers(job *model.Job) []apiv1.Container {
+func (i *Internal) initContainers(job *model.Job, backend StorageBackend) []apiv1.Container {
 	return []apiv1.Container{
 		apiv1.Container{
 			Name:            fileTransfersInitContainerName,
 			Image:           fmt.Sprintf("%s:%s", i.PorklockImage, i.PorklockTag),
-			Command:         append(fileTransferCommand(job), "--no-service"),
+			Command:         append(fileTransferCommand(job, backend), "--no-service"),
+			Env:             backend.env(),
 			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
 			WorkingDir:      inputPathListMountPath,
-			VolumeMounts:    i.fileTransfersVolumeMounts(job),
+			VolumeMounts:    i.fileTransfersVolumeMounts(job, backend),
 			Ports: []apiv1.ContainerPort{
 				{
 					Name:          fileTransfersPortName,
@@ -171,17 +310,7 @@ func (i *Internal) initContainers(job *model.Job) []apiv1.Container {
 	}
 }
 
-func gpuEnabled(job *model.Job) bool {
-	gpuEnabled := false
-	for _, device := range job.Steps[0].Component.Container.Devices {
-		if strings.HasPrefix(strings.ToLower(device.HostPath), "/dev/nvidia") {
-			gpuEnabled = true
-		}
-	}
-	return gpuEnabled
-}
-
-func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
+func (i *Internal) defineAnalysisContainer(job *VICEJob, secrets []UserSecret) apiv1.Container {
 	analysisEnvironment := []apiv1.EnvVar{}
 	for envKey, envVal := range job.Steps[0].Environment {
 		analysisEnvironment = append(
@@ -197,7 +326,7 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		analysisEnvironment,
 		apiv1.EnvVar{
 			Name:  "REDIRECT_URL",
-			Value: i.getFrontendURL(job).String(),
+			Value: i.getFrontendURL(&job.Job).String(),
 		},
 		apiv1.EnvVar{
 			Name:  "IPLANT_USER",
@@ -209,31 +338,30 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		},
 	)
 
-	cpuLimit, err := resourcev1.ParseQuantity(fmt.Sprintf("%fm", cpuResourceLimit(job)*1000))
-	if err != nil {
-		log.Warn(err)
-		cpuLimit = defaultCPUResourceLimit
-	}
+	analysisEnvironment = append(analysisEnvironment, secretEnvironment(&job.Job, secrets)...)
 
-	memLimit, err := resourcev1.ParseQuantity(fmt.Sprintf("%d", memResourceLimit(job)))
-	if err != nil {
-		log.Warn(err)
-		memLimit = defaultMemResourceLimit
+	volumeMounts := []apiv1.VolumeMount{
+		{
+			Name:      fileTransfersVolumeName,
+			MountPath: fileTransfersMountPath(&job.Job),
+			ReadOnly:  false,
+		},
 	}
 
-	limits := apiv1.ResourceList{
-		apiv1.ResourceCPU:    cpuLimit, //job contains # cores
-		apiv1.ResourceMemory: memLimit, // job contains # bytes mem
+	if i.HomeVolumesEnabled {
+		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
+			Name:      homeVolumeName,
+			MountPath: i.homeVolumeMountPath(),
+			ReadOnly:  false,
+		})
 	}
 
-	// If a GPU device is configured, then add it to the resource limits.
-	if gpuEnabled(job) {
-		gpuLimit, err := resourcev1.ParseQuantity("1")
-		if err != nil {
-			log.Warn(err)
-		} else {
-			limits[apiv1.ResourceName("nvidia.com/gpu")] = gpuLimit
-		}
+	if secretsVolume(&job.Job, secrets) != nil {
+		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
+			Name:      secretsVolumeName,
+			MountPath: i.secretsMountPath(),
+			ReadOnly:  true,
+		})
 	}
 
 	analysisContainer := apiv1.Container{
@@ -245,21 +373,9 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		),
 		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
 		Env:             analysisEnvironment,
-		Resources: apiv1.ResourceRequirements{
-			Limits: limits,
-			Requests: apiv1.ResourceList{
-				apiv1.ResourceCPU:    defaultCPUResourceRequest,
-				apiv1.ResourceMemory: defaultMemResourceRequest,
-			},
-		},
-		VolumeMounts: []apiv1.VolumeMount{
-			{
-				Name:      fileTransfersVolumeName,
-				MountPath: fileTransfersMountPath(job),
-				ReadOnly:  false,
-			},
-		},
-		Ports: analysisPorts(&job.Steps[0]),
+		Resources:       i.analysisResources(job),
+		VolumeMounts:    volumeMounts,
+		Ports:           analysisPorts(&job.Steps[0]),
 		SecurityContext: &apiv1.SecurityContext{
 			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
 			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
@@ -314,13 +430,20 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 
 // deploymentContainers returns the Containers needed for the VICE analysis
 // Deployment. It does not call the k8s API.
-func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
+func (i *Internal) deploymentContainers(job *VICEJob, secrets []UserSecret, backend StorageBackend) []apiv1.Container {
 	return []apiv1.Container{
 		apiv1.Container{
 			Name:            viceProxyContainerName,
 			Image:           i.ViceProxyImage,
-			Command:         i.viceProxyCommand(job),
+			Command:         i.viceProxyCommand(&job.Job),
 			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+			VolumeMounts: []apiv1.VolumeMount{
+				{
+					Name:      sharingVolumeName,
+					MountPath: sharingMountPath,
+					ReadOnly:  true,
+				},
+			},
 			Ports: []apiv1.ContainerPort{
 				{
 					Name:          viceProxyPortName,
@@ -359,10 +482,11 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 		apiv1.Container{
 			Name:            fileTransfersContainerName,
 			Image:           fmt.Sprintf("%s:%s", i.PorklockImage, i.PorklockTag),
-			Command:         fileTransferCommand(job),
+			Command:         fileTransferCommand(&job.Job, backend),
+			Env:             backend.env(),
 			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
 			WorkingDir:      inputPathListMountPath,
-			VolumeMounts:    i.fileTransfersVolumeMounts(job),
+			VolumeMounts:    i.fileTransfersVolumeMounts(&job.Job, backend),
 			Ports: []apiv1.ContainerPort{
 				{
 					Name:          fileTransfersPortName,
@@ -399,54 +523,81 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 				},
 			},
 		},
-		i.defineAnalysisContainer(job),
+		i.defineAnalysisContainer(job, secrets),
 	}
 }
 
 // getDeployment assembles and returns the Deployment for the VICE analysis. It does
 // not call the k8s API.
-func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
-	labels, err := i.labelsFromJob(job)
+func (i *Internal) getDeployment(job *VICEJob) (*appsv1.Deployment, error) {
+	labels, err := i.labelsFromJob(&job.Job)
 	if err != nil {
 		return nil, err
 	}
 
 	autoMount := false
 
-	tolerations := []apiv1.Toleration{
-		{
-			Key:      viceTolerationKey,
-			Operator: apiv1.TolerationOperator(viceTolerationOperator),
-			Value:    viceTolerationValue,
-			Effect:   apiv1.TaintEffect(viceTolerationEffect),
-		},
+	securityProfileName, securityProfile, err := i.securityProfileFor(&job.Job)
+	if err != nil {
+		return nil, err
 	}
 
-	nodeSelectorRequirements := []apiv1.NodeSelectorRequirement{
-		{
-			Key:      viceAffinityKey,
-			Operator: apiv1.NodeSelectorOperator(viceAffinityOperator),
-			Values: []string{
-				viceAffinityValue,
-			},
-		},
+	gpu, err := i.gpuRequest(job)
+	if err != nil {
+		return nil, err
 	}
 
-	if gpuEnabled(job) {
-		tolerations = append(tolerations, apiv1.Toleration{
-			Key:      gpuTolerationKey,
-			Operator: apiv1.TolerationOperator(gpuTolerationOperator),
-			Value:    gpuTolerationValue,
-			Effect:   apiv1.TaintEffect(gpuTolerationEffect),
-		})
+	backend, err := i.storageBackend(job)
+	if err != nil {
+		return nil, err
+	}
 
-		nodeSelectorRequirements = append(nodeSelectorRequirements, apiv1.NodeSelectorRequirement{
-			Key:      gpuAffinityKey,
-			Operator: apiv1.NodeSelectorOperator(gpuAffinityOperator),
-			Values: []string{
-				gpuAffinityValue,
-			},
-		})
+	scheduling := i.schedulingPolicy().settingsFor(job, gpu)
+
+	tolerations := []apiv1.Toleration{}
+	for _, t := range scheduling.Tolerations {
+		tolerations = append(tolerations, t.toleration())
+	}
+
+	nodeSelectorRequirements := []apiv1.NodeSelectorRequirement{}
+	for _, term := range scheduling.Affinity {
+		nodeSelectorRequirements = append(nodeSelectorRequirements, term.requirement())
+	}
+
+	priorityClass, err := i.priorityClassFor(job, scheduling.PriorityClass)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resumed analyses have their workspace restored by the init container
+	// before the app starts.
+	initContainers := i.initContainers(&job.Job, backend)
+	workspace, err := i.resumeWorkspace(job)
+	if err != nil {
+		return nil, err
+	}
+	if workspace != nil {
+		initContainers[0].Command = append(initContainers[0].Command, "--restore-workspace", workspace.ArchivePath)
+	}
+
+	volumes := deploymentVolumes(&job.Job, backend)
+	if i.HomeVolumesEnabled {
+		volumes = append(volumes, homeVolume(job))
+	}
+
+	// The user secrets requested by the job are copied into a Secret for the
+	// analysis when it's launched.
+	secrets, err := i.secretsForJob(job)
+	if err != nil {
+		return nil, err
+	}
+	if v := secretsVolume(&job.Job, secrets); v != nil {
+		volumes = append(volumes, *v)
+	}
+
+	topologySpreadConstraints := []apiv1.TopologySpreadConstraint{}
+	for _, t := range scheduling.TopologySpread {
+		topologySpreadConstraints = append(topologySpreadConstraints, t.constraint(labels))
 	}
 
 	deployment := &appsv1.Deployment{
@@ -467,30 +618,47 @@ func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
 				},
 				Spec: apiv1.PodSpec{
 					RestartPolicy:                apiv1.RestartPolicy("Always"),
-					Volumes:                      deploymentVolumes(job),
-					InitContainers:               i.initContainers(job),
-					Containers:                   i.deploymentContainers(job),
+					Volumes:                      volumes,
+					InitContainers:               initContainers,
+					Containers:                   i.deploymentContainers(job, secrets, backend),
 					AutomountServiceAccountToken: &autoMount,
-					SecurityContext: &apiv1.PodSecurityContext{
-						RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-						RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-						FSGroup:    int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-					},
-					Tolerations: tolerations,
-					Affinity: &apiv1.Affinity{
-						NodeAffinity: &apiv1.NodeAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
-								NodeSelectorTerms: []apiv1.NodeSelectorTerm{
-									{
-										MatchExpressions: nodeSelectorRequirements,
-									},
-								},
-							},
+					Tolerations:                  tolerations,
+					PriorityClassName:            priorityClass,
+					TopologySpreadConstraints:    topologySpreadConstraints,
+				},
+			},
+		},
+	}
+
+	// The security profile applies to every container in the pod, including
+	// the ones app-exposer adds.
+	podSpec := &deployment.Spec.Template.Spec
+	deployment.Spec.Template.Annotations = applySecurityProfile(podSpec, securityProfile, int64(job.Steps[0].Component.Container.UID))
+	if err = i.validatePodSecurity(securityProfileName, securityProfile, podSpec, deployment.Spec.Template.Annotations); err != nil {
+		return nil, err
+	}
+
+	// Analysis pods get the grace period to shut down cleanly when they're
+	// stopped, whether the analysis is exiting or the pod was preempted. Files
+	// that weren't saved before then are lost.
+	if i.TerminationGracePeriod > 0 {
+		deployment.Spec.Template.Spec.TerminationGracePeriodSeconds = int64Ptr(int64(i.TerminationGracePeriod.Seconds()))
+	}
+
+	// An empty node selector term doesn't match any nodes, so the affinity is
+	// only set if the scheduling policy asks for one.
+	if len(nodeSelectorRequirements) > 0 {
+		deployment.Spec.Template.Spec.Affinity = &apiv1.Affinity{
+			NodeAffinity: &apiv1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+					NodeSelectorTerms: []apiv1.NodeSelectorTerm{
+						{
+							MatchExpressions: nodeSelectorRequirements,
 						},
 					},
 				},
 			},
-		},
+		}
 	}
 
 	return deployment, nil
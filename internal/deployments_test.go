@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func testJob(container model.Container) *model.Job {
+	return &model.Job{
+		Steps: []model.Step{
+			{
+				Component: model.StepComponent{
+					Container: container,
+				},
+			},
+		},
+	}
+}
+
+func TestCPUResourceRequest(t *testing.T) {
+	i := &Internal{}
+
+	if actual := i.cpuResourceRequest(testJob(model.Container{MinCPUCores: 2, MaxCPUCores: 8})); actual != 2 {
+		t.Errorf("cpuResourceRequest returned %f, not 2", actual)
+	}
+
+	if actual := i.cpuResourceRequest(testJob(model.Container{MaxCPUCores: 0.5})); actual != 0.5 {
+		t.Errorf("cpuResourceRequest returned %f, not the 0.5 limit", actual)
+	}
+
+	i.ResourceRequestRatio = 0.25
+	if actual := i.cpuResourceRequest(testJob(model.Container{MaxCPUCores: 8})); actual != 2 {
+		t.Errorf("cpuResourceRequest returned %f, not 2", actual)
+	}
+}
+
+func TestMemResourceRequest(t *testing.T) {
+	i := &Internal{}
+
+	if actual := i.memResourceRequest(testJob(model.Container{})); actual != 2147483648 {
+		t.Errorf("memResourceRequest returned %d, not 2GiB", actual)
+	}
+
+	i.ResourceRequestRatio = 0.5
+	if actual := i.memResourceRequest(testJob(model.Container{MemoryLimit: 4096})); actual != 2048 {
+		t.Errorf("memResourceRequest returned %d, not 2048", actual)
+	}
+
+	if actual := i.memResourceRequest(testJob(model.Container{MinMemoryLimit: 1024, MemoryLimit: 4096})); actual != 1024 {
+		t.Errorf("memResourceRequest returned %d, not 1024", actual)
+	}
+}
+
+func TestAnalysisResourcesEphemeralStorage(t *testing.T) {
+	i := &Internal{Init: Init{EphemeralStorageLimit: "1Gi"}}
+
+	resources := i.analysisResources(&VICEJob{Job: *testJob(model.Container{MinDiskSpace: 2147483648})})
+
+	request := resources.Requests[apiv1.ResourceEphemeralStorage]
+	if request.Value() != 2147483648 {
+		t.Errorf("ephemeral storage request was %s, not 2Gi", request.String())
+	}
+
+	// The limit is raised to match the request.
+	limit := resources.Limits[apiv1.ResourceEphemeralStorage]
+	if limit.Value() != 2147483648 {
+		t.Errorf("ephemeral storage limit was %s, not 2Gi", limit.String())
+	}
+}
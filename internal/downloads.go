@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// TicketedPath is a data store path that's downloaded with a ticket.
+type TicketedPath struct {
+	Path   string `json:"path"`
+	Ticket string `json:"ticket"`
+}
+
+// DownloadRequest lists additional data store paths to download into a
+// running analysis. Paths ending in a slash are downloaded as folders.
+type DownloadRequest struct {
+	Paths   []string       `json:"paths,omitempty"`
+	Tickets []TicketedPath `json:"tickets,omitempty"`
+}
+
+// DownloadOptions is sent to the file transfer service to download paths that
+// aren't in the input path list the analysis was launched with. The lists use
+// the same format as the input path list file, but are sent in the body of the
+// request rather than mounted into the sidecar, since the input ConfigMaps of a
+// running analysis can't be changed without restarting it.
+type DownloadOptions struct {
+	PathList       string `json:"path_list,omitempty"`
+	TicketPathList string `json:"ticket_path_list,omitempty"`
+}
+
+// validDataStorePath returns an error if the path can't be added to a path
+// list.
+func validDataStorePath(p string) error {
+	if !path.IsAbs(p) {
+		return fmt.Errorf("%q must be an absolute path in the data store", p)
+	}
+	if strings.ContainsAny(p, "\r\n") {
+		return fmt.Errorf("%q contains a line break", p)
+	}
+	return nil
+}
+
+// validate returns an error if any of the paths or tickets can't be added to a
+// path list.
+func (d *DownloadRequest) validate() error {
+	if len(d.Paths) == 0 && len(d.Tickets) == 0 {
+		return errors.New("at least one path or ticket is required")
+	}
+
+	for _, p := range d.Paths {
+		if err := validDataStorePath(p); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range d.Tickets {
+		if err := validDataStorePath(t.Path); err != nil {
+			return err
+		}
+		if t.Ticket == "" || strings.ContainsAny(t.Ticket, ",\r\n") {
+			return fmt.Errorf("the ticket for %q is invalid", t.Path)
+		}
+	}
+
+	return nil
+}
+
+// downloadOptions returns the path lists sent to the file transfer service for the
+// request. Each list starts with its header line, like the path lists
+// generated when the analysis is launched.
+func (i *Internal) downloadOptions(d *DownloadRequest) *DownloadOptions {
+	options := &DownloadOptions{}
+
+	if len(d.Paths) > 0 {
+		var buf bytes.Buffer
+		fmt.Fprintln(&buf, i.InputPathListIdentifier)
+		for _, p := range d.Paths {
+			fmt.Fprintln(&buf, p)
+		}
+		options.PathList = buf.String()
+	}
+
+	if len(d.Tickets) > 0 {
+		var buf bytes.Buffer
+		fmt.Fprintln(&buf, i.TicketInputPathListIdentifier)
+		for _, t := range d.Tickets {
+			fmt.Fprintf(&buf, "%s,%s\n", t.Ticket, t.Path)
+		}
+		options.TicketPathList = buf.String()
+	}
+
+	return options
+}
+
+// VICETriggerDownloads handles requests to trigger file downloads. Without a
+// body, the input files the analysis was launched with are downloaded again.
+// With a DownloadRequest in the body, the paths in it are downloaded into the
+// running analysis instead.
+func (i *Internal) VICETriggerDownloads(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	buf, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var options interface{}
+	if len(bytes.TrimSpace(buf)) > 0 {
+		downloadRequest := &DownloadRequest{}
+		if err = json.Unmarshal(buf, downloadRequest); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = downloadRequest.validate(); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		options = i.downloadOptions(downloadRequest)
+	}
+
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(svcs) == 0 {
+		http.Error(writer, fmt.Sprintf("no services found for analysis %s", id), http.StatusNotFound)
+		return
+	}
+
+	if err = i.doFileTransfer(id, downloadBasePath, downloadKind, options, true); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
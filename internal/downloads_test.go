@@ -0,0 +1,52 @@
+package internal
+
+import "testing"
+
+func TestDownloadRequestValidate(t *testing.T) {
+	valid := &DownloadRequest{
+		Paths:   []string{"/iplant/home/user/data/", "/iplant/home/user/reads.fastq"},
+		Tickets: []TicketedPath{{Path: "/iplant/home/other/shared.csv", Ticket: "abc123"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("a valid request failed validation: %s", err)
+	}
+
+	invalid := []*DownloadRequest{
+		{},
+		{Paths: []string{"data/reads.fastq"}},
+		{Paths: []string{"/iplant/home/user/a\n/iplant/home/other/b"}},
+		{Tickets: []TicketedPath{{Path: "/iplant/home/other/shared.csv"}}},
+		{Tickets: []TicketedPath{{Path: "/iplant/home/other/shared.csv", Ticket: "a,b"}}},
+	}
+	for _, d := range invalid {
+		if err := d.validate(); err == nil {
+			t.Errorf("%+v passed validation", d)
+		}
+	}
+}
+
+func TestDownloadOptions(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			InputPathListIdentifier:       "# application/vnd.de.path-list+csv; version=1",
+			TicketInputPathListIdentifier: "# application/vnd.de.tickets-path-list+csv; version=1",
+		},
+	}
+
+	options := i.downloadOptions(&DownloadRequest{
+		Paths:   []string{"/iplant/home/user/data/"},
+		Tickets: []TicketedPath{{Path: "/iplant/home/other/shared.csv", Ticket: "abc123"}},
+	})
+
+	if options.PathList != "# application/vnd.de.path-list+csv; version=1\n/iplant/home/user/data/\n" {
+		t.Errorf("unexpected path list %q", options.PathList)
+	}
+	if options.TicketPathList != "# application/vnd.de.tickets-path-list+csv; version=1\nabc123,/iplant/home/other/shared.csv\n" {
+		t.Errorf("unexpected ticket path list %q", options.TicketPathList)
+	}
+
+	options = i.downloadOptions(&DownloadRequest{Paths: []string{"/iplant/home/user/data/"}})
+	if options.TicketPathList != "" {
+		t.Errorf("a ticket path list was generated without tickets: %q", options.TicketPathList)
+	}
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver for tests. The responses to statements are
+// picked by a substring of their SQL, and every statement is recorded.
+type fakeDB struct {
+	lock      sync.Mutex
+	responses []fakeResponse
+	calls     []fakeCall
+}
+
+type fakeResponse struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+	err     error
+}
+
+type fakeCall struct {
+	query string
+	args  []driver.Value
+}
+
+var (
+	fakeDBsLock sync.Mutex
+	fakeDBs     = map[string]*fakeDB{}
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// newFakeDB returns a fakeDB and a *sql.DB that uses it.
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	f := &fakeDB{}
+
+	fakeDBsLock.Lock()
+	dsn := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[dsn] = f
+	fakeDBsLock.Unlock()
+
+	db, err := sql.Open("fakedb", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, db
+}
+
+// on sets the rows returned by the statements containing match.
+func (f *fakeDB) on(match string, columns []string, rows ...[]driver.Value) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses = append(f.responses, fakeResponse{match: match, columns: columns, rows: rows})
+}
+
+// fail makes the statements containing match return the error.
+func (f *fakeDB) fail(match string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses = append(f.responses, fakeResponse{match: match, err: err})
+}
+
+// called returns the arguments of each of the statements containing match.
+func (f *fakeDB) called(match string) [][]driver.Value {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	retval := [][]driver.Value{}
+	for _, c := range f.calls {
+		if strings.Contains(c.query, match) {
+			retval = append(retval, c.args)
+		}
+	}
+	return retval
+}
+
+func (f *fakeDB) run(query string, args []driver.Value) fakeResponse {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls = append(f.calls, fakeCall{query: query, args: args})
+	for _, r := range f.responses {
+		if strings.Contains(query, r.match) {
+			return r
+		}
+	}
+	return fakeResponse{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDBsLock.Lock()
+	defer fakeDBsLock.Unlock()
+
+	f, ok := fakeDBs[dsn]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake database %s", dsn)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions aren't supported by the fake database")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	r := s.db.run(s.query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return driver.RowsAffected(len(r.rows)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r := s.db.run(s.query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{columns: r.columns, rows: r.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// recordingPublisher records the status updates sent for analyses.
+type recordingPublisher struct {
+	lock    sync.Mutex
+	updates []string
+}
+
+func (p *recordingPublisher) record(status, jobID, msg string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.updates = append(p.updates, fmt.Sprintf("%s %s: %s", status, jobID, msg))
+	return nil
+}
+
+func (p *recordingPublisher) Fail(jobID, msg string) error {
+	return p.record("failed", jobID, msg)
+}
+
+func (p *recordingPublisher) Success(jobID, msg string) error {
+	return p.record("completed", jobID, msg)
+}
+
+func (p *recordingPublisher) Running(jobID, msg string) error {
+	return p.record("running", jobID, msg)
+}
+
+func (p *recordingPublisher) Queued(jobID, msg string) error {
+	return p.record("queued", jobID, msg)
+}
+
+// sent returns the updates with the status.
+func (p *recordingPublisher) sent(status string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	retval := []string{}
+	for _, u := range p.updates {
+		if strings.HasPrefix(u, status+" ") {
+			retval = append(retval, u)
+		}
+	}
+	return retval
+}
+
+// fakeTransferService stands in for the file transfer services running
+// alongside analyses. The responses are keyed by the method and path of the
+// request, like "GET /upload/a". Unknown requests get a 404.
+type fakeTransferService struct {
+	lock      sync.Mutex
+	responses map[string]string
+	statuses  map[string]int
+	requests  []string
+}
+
+func (f *fakeTransferService) set(request, response string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.responses == nil {
+		f.responses = map[string]string{}
+	}
+	f.responses[request] = response
+}
+
+// fail makes the request get an error status.
+func (f *fakeTransferService) fail(request string, status int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.statuses == nil {
+		f.statuses = map[string]int{}
+	}
+	f.statuses[request] = status
+}
+
+func (f *fakeTransferService) received(request string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeTransferService) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := fmt.Sprintf("%s %s", req.Method, req.URL.Path)
+	f.requests = append(f.requests, key)
+
+	status := http.StatusOK
+	body, ok := f.responses[key]
+	if !ok {
+		status = http.StatusNotFound
+	}
+	if s, ok := f.statuses[key]; ok {
+		status = s
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{},
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeTransferService) client() *http.Client {
+	return &http.Client{Transport: f}
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// defaultGPUModelName is the name of the GPU model used when a job asks for
+// GPUs without picking a model and no default model is configured.
+const defaultGPUModelName = "default"
+
+// NodeAffinityTerm is a node affinity requirement read from the config file
+// or the scheduling policy.
+// It's converted to an apiv1.NodeSelectorRequirement when the Deployment is
+// assembled.
+type NodeAffinityTerm struct {
+	Key      string   `mapstructure:"key" json:"key"`
+	Operator string   `mapstructure:"operator" json:"operator,omitempty"`
+	Values   []string `mapstructure:"values" json:"values,omitempty"`
+}
+
+// requirement returns the apiv1.NodeSelectorRequirement for the term.
+func (n NodeAffinityTerm) requirement() apiv1.NodeSelectorRequirement {
+	operator := n.Operator
+	if operator == "" {
+		operator = string(apiv1.NodeSelectorOpIn)
+	}
+	return apiv1.NodeSelectorRequirement{
+		Key:      n.Key,
+		Operator: apiv1.NodeSelectorOperator(operator),
+		Values:   n.Values,
+	}
+}
+
+// GPUModel maps a GPU model that users can select to the extended resource
+// name that the device plugin advertises for it, such as nvidia.com/gpu or a
+// MIG profile like nvidia.com/mig-1g.5gb, and the node affinity needed to
+// land on nodes that have it. MaxCount is the most GPUs of the model that an
+// analysis can ask for, which is usually the number on a single node. It
+// defaults to one.
+type GPUModel struct {
+	Resource string             `mapstructure:"resource"`
+	Affinity []NodeAffinityTerm `mapstructure:"affinity"`
+	MaxCount int64              `mapstructure:"max-count"`
+}
+
+// maxCount returns the most GPUs of the model that an analysis can ask for.
+func (m GPUModel) maxCount() int64 {
+	if m.MaxCount > 0 {
+		return m.MaxCount
+	}
+	return 1
+}
+
+// GPURequest is the number of GPUs of a single model that an analysis needs.
+type GPURequest struct {
+	Name  string
+	Model GPUModel
+	Count int64
+}
+
+// gpuModels returns the configured GPU models. If none are configured, a
+// single default model using the nvidia.com/gpu resource is returned.
+func (i *Internal) gpuModels() map[string]GPUModel {
+	if len(i.GPUModels) > 0 {
+		return i.GPUModels
+	}
+	return map[string]GPUModel{
+		defaultGPUModelName: {Resource: gpuResourceName},
+	}
+}
+
+// gpuResourceNames returns the resource names of all of the configured GPU
+// models.
+func (i *Internal) gpuResourceNames() []apiv1.ResourceName {
+	seen := map[string]bool{}
+	names := []apiv1.ResourceName{}
+	for _, m := range i.gpuModels() {
+		if !seen[m.Resource] {
+			seen[m.Resource] = true
+			names = append(names, apiv1.ResourceName(m.Resource))
+		}
+	}
+	return names
+}
+
+// gpuCount returns the number of GPUs requested for the job. Jobs that don't
+// set a count but have an NVIDIA device get a single GPU.
+func gpuCount(job *VICEJob) int64 {
+	if job.GPUCount > 0 {
+		return int64(job.GPUCount)
+	}
+	if gpuEnabled(&job.Job) {
+		return 1
+	}
+	return 0
+}
+
+// gpuRequest returns the GPUs that the job needs, or nil if it doesn't need
+// any. Returns an error if the job asks for a GPU model that isn't configured,
+// picks a model without asking for any GPUs, or asks for more GPUs than an
+// analysis can get. A request that can never be met would otherwise wait in
+// the launch queue forever.
+func (i *Internal) gpuRequest(job *VICEJob) (*GPURequest, error) {
+	if job.GPUCount < 0 {
+		return nil, fmt.Errorf("the GPU count %d is invalid", job.GPUCount)
+	}
+
+	count := gpuCount(job)
+	if count == 0 {
+		if job.GPUModel != "" {
+			return nil, fmt.Errorf("GPU model %s was picked without a GPU count", job.GPUModel)
+		}
+		return nil, nil
+	}
+
+	name := strings.ToLower(job.GPUModel)
+	if name == "" {
+		name = strings.ToLower(i.GPUDefaultModel)
+	}
+	if name == "" {
+		name = defaultGPUModelName
+	}
+
+	gpuModel, ok := i.gpuModels()[name]
+	if !ok {
+		return nil, fmt.Errorf("GPU model %s is not available", name)
+	}
+
+	if max := gpuModel.maxCount(); count > max {
+		return nil, fmt.Errorf("%d GPUs of model %s were requested, but an analysis can have at most %d", count, name, max)
+	}
+
+	return &GPURequest{
+		Name:  name,
+		Model: gpuModel,
+		Count: count,
+	}, nil
+}
+
+// gpuEnabled returns true if the job has an NVIDIA device configured.
+func gpuEnabled(job *model.Job) bool {
+	gpuEnabled := false
+	for _, device := range job.Steps[0].Component.Container.Devices {
+		if strings.HasPrefix(strings.ToLower(device.HostPath), "/dev/nvidia") {
+			gpuEnabled = true
+		}
+	}
+	return gpuEnabled
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestGPURequest(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			GPUDefaultModel: "a100",
+			GPUModels: map[string]GPUModel{
+				"a100": {Resource: "nvidia.com/gpu"},
+				"a100-1g.5gb": {
+					Resource: "nvidia.com/mig-1g.5gb",
+					MaxCount: 7,
+					Affinity: []NodeAffinityTerm{
+						{Key: "nvidia.com/mig.strategy", Values: []string{"mixed"}},
+					},
+				},
+			},
+		},
+	}
+
+	gpu, err := i.gpuRequest(&VICEJob{Job: *testJob(model.Container{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpu != nil {
+		t.Errorf("gpuRequest returned %+v for a job without GPUs", gpu)
+	}
+
+	job := &VICEJob{
+		Job: *testJob(model.Container{
+			Devices: []model.Device{{HostPath: "/dev/nvidia0"}},
+		}),
+	}
+	gpu, err = i.gpuRequest(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpu.Name != "a100" || gpu.Count != 1 {
+		t.Errorf("gpuRequest returned %+v, not a single a100", gpu)
+	}
+
+	job = &VICEJob{Job: *testJob(model.Container{}), GPUCount: 2, GPUModel: "A100-1g.5gb"}
+	gpu, err = i.gpuRequest(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpu.Model.Resource != "nvidia.com/mig-1g.5gb" || gpu.Count != 2 {
+		t.Errorf("gpuRequest returned %+v, not two MIG slices", gpu)
+	}
+	if req := gpu.Model.Affinity[0].requirement(); req.Operator != apiv1.NodeSelectorOpIn {
+		t.Errorf("affinity operator defaulted to %s, not In", req.Operator)
+	}
+
+	job = &VICEJob{Job: *testJob(model.Container{}), GPUCount: 1, GPUModel: "h100"}
+	if _, err = i.gpuRequest(job); err == nil {
+		t.Error("expected an error for an unknown GPU model")
+	}
+
+	job = &VICEJob{Job: *testJob(model.Container{}), GPUCount: 2, GPUModel: "a100"}
+	if _, err = i.gpuRequest(job); err == nil {
+		t.Error("expected an error for more GPUs than the model's maximum")
+	}
+
+	job = &VICEJob{Job: *testJob(model.Container{}), GPUModel: "a100"}
+	if _, err = i.gpuRequest(job); err == nil {
+		t.Error("expected an error for a GPU model without a count")
+	}
+
+	job = &VICEJob{Job: *testJob(model.Container{}), GPUCount: -1}
+	if _, err = i.gpuRequest(job); err == nil {
+		t.Error("expected an error for a negative GPU count")
+	}
+}
+
+func TestNodeMatchesAffinity(t *testing.T) {
+	node := &apiv1.Node{}
+	node.Labels = map[string]string{"nvidia.com/gpu.product": "A100"}
+
+	if !nodeMatchesAffinity(node, []NodeAffinityTerm{{Key: "nvidia.com/gpu.product", Operator: "In", Values: []string{"A100"}}}) {
+		t.Error("node should match the In term")
+	}
+
+	if nodeMatchesAffinity(node, []NodeAffinityTerm{{Key: "nvidia.com/gpu.product", Operator: "DoesNotExist"}}) {
+		t.Error("node should not match the DoesNotExist term")
+	}
+}
@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+// HomeVolumeInfo describes a user's persistent home volume.
+type HomeVolumeInfo struct {
+	Name         string `json:"name"`
+	Username     string `json:"username"`
+	UserID       string `json:"user_id"`
+	Size         string `json:"size"`
+	StorageClass string `json:"storage_class"`
+	Phase        string `json:"phase"`
+	LastUsed     string `json:"last_used"`
+	InUse        bool   `json:"in_use"`
+}
+
+// homeVolumeClaimName returns the name of the PersistentVolumeClaim for the
+// user's home volume.
+func homeVolumeClaimName(userID string) string {
+	return fmt.Sprintf("vice-home-%s", userID)
+}
+
+// homeVolumeMountPath returns the path the home volume is mounted at in the
+// analysis container.
+func (i *Internal) homeVolumeMountPath() string {
+	if i.HomeVolumeMountPath != "" {
+		return i.HomeVolumeMountPath
+	}
+	return defaultHomeVolumeMount
+}
+
+// homeVolumeSize returns the size of the user's home volume. It comes from the
+// user's resource quota if one sets it, otherwise the configured default.
+func (i *Internal) homeVolumeSize(job *VICEJob) (resourcev1.Quantity, error) {
+	quota, err := i.getResourceQuota(slugString(job.Submitter), job.UserGroups)
+	if err != nil {
+		return resourcev1.Quantity{}, errors.Wrapf(err, "unable to determine the home volume size for %s", job.Submitter)
+	}
+
+	if quota.HomeVolumeBytes != nil {
+		return *resourcev1.NewQuantity(*quota.HomeVolumeBytes, resourcev1.BinarySI), nil
+	}
+
+	size := i.HomeVolumeDefaultSize
+	if size == "" {
+		size = defaultHomeVolumeSize
+	}
+	return resourcev1.ParseQuantity(size)
+}
+
+// homeVolumeAccessMode returns the access mode for home volumes. It defaults
+// to ReadWriteMany, since all of a user's analyses share the volume and they
+// may run on different nodes.
+func (i *Internal) homeVolumeAccessMode() apiv1.PersistentVolumeAccessMode {
+	if i.HomeVolumeAccessMode != "" {
+		return apiv1.PersistentVolumeAccessMode(i.HomeVolumeAccessMode)
+	}
+	return apiv1.ReadWriteMany
+}
+
+// validateHomeVolume returns a capacity error if the user already has an
+// analysis running and the home volume can only be mounted on one node at a
+// time. The second analysis would be stuck with a Multi-Attach error if it
+// landed on another node.
+func (i *Internal) validateHomeVolume(job *VICEJob) error {
+	if !i.HomeVolumesEnabled || i.homeVolumeAccessMode() == apiv1.ReadWriteMany {
+		return nil
+	}
+
+	inUse, err := i.homeVolumeInUse(job.UserID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine whether the home volume for %s is in use", job.Submitter)
+	}
+	if inUse {
+		return newCapacityError("the home volume for %s is already in use by another analysis", job.Submitter)
+	}
+
+	return nil
+}
+
+// homeVolumeClaim assembles the PersistentVolumeClaim for the user's home
+// volume. It does not call the k8s API.
+func (i *Internal) homeVolumeClaim(job *VICEJob, size resourcev1.Quantity) *apiv1.PersistentVolumeClaim {
+	accessMode := i.homeVolumeAccessMode()
+
+	pvc := &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: homeVolumeClaimName(job.UserID),
+			Labels: map[string]string{
+				homeVolumeLabel: homeVolumeLabelValue,
+				"user-id":       job.UserID,
+				"username":      slugString(job.Submitter),
+			},
+			Annotations: map[string]string{
+				homeVolumeLastUsed: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{accessMode},
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+
+	if i.HomeVolumeStorageClass != "" {
+		pvc.Spec.StorageClassName = &i.HomeVolumeStorageClass
+	}
+
+	return pvc
+}
+
+// UpsertHomeVolume creates the user's home volume if it doesn't exist yet. If
+// it does, the last used time is updated and the volume is expanded if the
+// user's quota has grown since it was created. Volumes are never shrunk.
+func (i *Internal) UpsertHomeVolume(job *VICEJob) error {
+	size, err := i.homeVolumeSize(job)
+	if err != nil {
+		return err
+	}
+
+	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+	name := homeVolumeClaimName(job.UserID)
+
+	_, err = pvcclient.Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = pvcclient.Create(i.homeVolumeClaim(job, size))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvc, err := pvcclient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if pvc.Annotations == nil {
+			pvc.Annotations = map[string]string{}
+		}
+		pvc.Annotations[homeVolumeLastUsed] = time.Now().UTC().Format(time.RFC3339)
+
+		if current, ok := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]; ok && size.Cmp(current) > 0 {
+			log.Infof("expanding home volume %s from %s to %s", name, current.String(), size.String())
+			pvc.Spec.Resources.Requests[apiv1.ResourceStorage] = size
+		}
+
+		_, err = pvcclient.Update(pvc)
+		return err
+	})
+}
+
+// homeVolume returns the Volume for the user's home volume that's included in
+// the analysis Deployment.
+func homeVolume(job *VICEJob) apiv1.Volume {
+	return apiv1.Volume{
+		Name: homeVolumeName,
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: homeVolumeClaimName(job.UserID),
+			},
+		},
+	}
+}
+
+// homeVolumeInUse returns true if the user has a VICE analysis running.
+func (i *Internal) homeVolumeInUse(userID string) (bool, error) {
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+		"user-id":  userID,
+	})
+
+	deplist, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(deplist.Items) > 0, nil
+}
+
+// homeVolumeExpired returns true if the volume was last used longer ago than
+// the retention period. Volumes without a valid last used time never expire.
+func homeVolumeExpired(pvc *apiv1.PersistentVolumeClaim, retention time.Duration, now time.Time) bool {
+	lastUsed, err := time.Parse(time.RFC3339, pvc.Annotations[homeVolumeLastUsed])
+	if err != nil {
+		return false
+	}
+	return now.Sub(lastUsed) > retention
+}
+
+func homeVolumeSelector() string {
+	return labels.Set(map[string]string{
+		homeVolumeLabel: homeVolumeLabelValue,
+	}).AsSelector().String()
+}
+
+// cleanupHomeVolumes deletes the home volumes that haven't been used for
+// longer than the retention period. Volumes that belong to users with running
+// analyses have their last used time updated instead.
+func (i *Internal) cleanupHomeVolumes() error {
+	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+
+	pvclist, err := pvcclient.List(metav1.ListOptions{
+		LabelSelector: homeVolumeSelector(),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for _, pvc := range pvclist.Items {
+		inUse, err := i.homeVolumeInUse(pvc.Labels["user-id"])
+		if err != nil {
+			log.Error(errors.Wrapf(err, "unable to tell whether home volume %s is in use", pvc.Name))
+			continue
+		}
+
+		if inUse {
+			if pvc.Annotations == nil {
+				pvc.Annotations = map[string]string{}
+			}
+			pvc.Annotations[homeVolumeLastUsed] = now.Format(time.RFC3339)
+			if _, err = pvcclient.Update(&pvc); err != nil {
+				log.Error(errors.Wrapf(err, "error updating the last used time of home volume %s", pvc.Name))
+			}
+			continue
+		}
+
+		if homeVolumeExpired(&pvc, i.HomeVolumeRetention, now) {
+			log.Infof("deleting home volume %s, which hasn't been used since %s", pvc.Name, pvc.Annotations[homeVolumeLastUsed])
+			if err = pvcclient.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(errors.Wrapf(err, "error deleting home volume %s", pvc.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// CleanupHomeVolumes fires up a goroutine that periodically deletes the home
+// volumes that have outlived the retention period.
+func (i *Internal) CleanupHomeVolumes() {
+	go func() {
+		ticker := time.NewTicker(i.HomeVolumeCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.cleanupHomeVolumes(); err != nil {
+				log.Error(errors.Wrap(err, "error cleaning up home volumes"))
+			}
+		}
+	}()
+}
+
+// userHomeVolume returns the home volume for the user along with whether it's
+// in use. Returns nil if the user doesn't have a home volume.
+func (i *Internal) userHomeVolume(username string) (*HomeVolumeInfo, error) {
+	set := labels.Set(map[string]string{
+		homeVolumeLabel: homeVolumeLabelValue,
+		"username":      username,
+	})
+
+	pvclist, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pvclist.Items) < 1 {
+		return nil, nil
+	}
+
+	pvc := pvclist.Items[0]
+
+	inUse, err := i.homeVolumeInUse(pvc.Labels["user-id"])
+	if err != nil {
+		return nil, err
+	}
+
+	info := &HomeVolumeInfo{
+		Name:     pvc.Name,
+		Username: pvc.Labels["username"],
+		UserID:   pvc.Labels["user-id"],
+		Phase:    string(pvc.Status.Phase),
+		LastUsed: pvc.Annotations[homeVolumeLastUsed],
+		InUse:    inUse,
+	}
+
+	if size, ok := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]; ok {
+		info.Size = size.String()
+	}
+
+	if pvc.Spec.StorageClassName != nil {
+		info.StorageClass = *pvc.Spec.StorageClassName
+	}
+
+	return info, nil
+}
+
+// VICEGetHomeVolume returns information about a user's home volume.
+//
+// Query Parameters:
+//   user - Required. The user that owns the home volume.
+func (i *Internal) VICEGetHomeVolume(writer http.ResponseWriter, request *http.Request) {
+	user := request.URL.Query().Get("user")
+	if user == "" {
+		http.Error(writer, "user is not set", http.StatusForbidden)
+		return
+	}
+
+	info, err := i.userHomeVolume(slugString(user))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		http.Error(writer, fmt.Sprintf("%s does not have a home volume", user), http.StatusNotFound)
+		return
+	}
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
+
+// VICEDeleteHomeVolume deletes a user's home volume. Volumes that are in use
+// by a running analysis can't be deleted.
+//
+// Query Parameters:
+//   user - Required. The user that owns the home volume.
+func (i *Internal) VICEDeleteHomeVolume(writer http.ResponseWriter, request *http.Request) {
+	user := request.URL.Query().Get("user")
+	if user == "" {
+		http.Error(writer, "user is not set", http.StatusForbidden)
+		return
+	}
+
+	info, err := i.userHomeVolume(slugString(user))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		http.Error(writer, fmt.Sprintf("%s does not have a home volume", user), http.StatusNotFound)
+		return
+	}
+	if info.InUse {
+		http.Error(writer, fmt.Sprintf("the home volume for %s is in use by a running analysis", user), http.StatusConflict)
+		return
+	}
+
+	if err = i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Delete(info.Name, &metav1.DeleteOptions{}); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/cyverse-de/model.v4"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testHomeVolumeClaim(userID string, lastUsed time.Time) *apiv1.PersistentVolumeClaim {
+	return &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      homeVolumeClaimName(userID),
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				homeVolumeLabel: homeVolumeLabelValue,
+				"user-id":       userID,
+			},
+			Annotations: map[string]string{
+				homeVolumeLastUsed: lastUsed.Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+func TestHomeVolumeExpired(t *testing.T) {
+	now := time.Now().UTC()
+
+	if homeVolumeExpired(testHomeVolumeClaim("a", now.Add(-time.Hour)), 2*time.Hour, now) {
+		t.Error("a volume used an hour ago expired with a two hour retention")
+	}
+
+	if !homeVolumeExpired(testHomeVolumeClaim("a", now.Add(-3*time.Hour)), 2*time.Hour, now) {
+		t.Error("a volume used three hours ago didn't expire with a two hour retention")
+	}
+
+	pvc := testHomeVolumeClaim("a", now)
+	pvc.Annotations[homeVolumeLastUsed] = "yesterday"
+	if homeVolumeExpired(pvc, time.Hour, now) {
+		t.Error("a volume without a valid last used time expired")
+	}
+}
+
+func TestCleanupHomeVolumes(t *testing.T) {
+	old := time.Now().UTC().Add(-48 * time.Hour)
+
+	i := &Internal{
+		Init: Init{
+			ViceNamespace:       "vice-apps",
+			HomeVolumeRetention: 24 * time.Hour,
+		},
+		clientset: fake.NewSimpleClientset(
+			testHomeVolumeClaim("idle", old),
+			testHomeVolumeClaim("busy", old),
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "job",
+					Namespace: "vice-apps",
+					Labels: map[string]string{
+						"app-type": "interactive",
+						"user-id":  "busy",
+					},
+				},
+			},
+		),
+	}
+
+	if err := i.cleanupHomeVolumes(); err != nil {
+		t.Fatal(err)
+	}
+
+	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims("vice-apps")
+
+	if _, err := pvcclient.Get(homeVolumeClaimName("idle"), metav1.GetOptions{}); err == nil {
+		t.Error("the idle home volume wasn't deleted")
+	}
+
+	busy, err := pvcclient.Get(homeVolumeClaimName("busy"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if homeVolumeExpired(busy, i.HomeVolumeRetention, time.Now().UTC()) {
+		t.Error("the last used time of the busy home volume wasn't updated")
+	}
+}
+
+func TestValidateHomeVolume(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			ViceNamespace:        "vice-apps",
+			HomeVolumesEnabled:   true,
+			HomeVolumeAccessMode: string(apiv1.ReadWriteOnce),
+		},
+		clientset: fake.NewSimpleClientset(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "a",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"app-type": "interactive", "user-id": "u1"},
+			},
+		}),
+	}
+
+	err := i.validateHomeVolume(&VICEJob{Job: model.Job{UserID: "u1", Submitter: "ipcdev"}})
+	if !isCapacityError(err) {
+		t.Errorf("a second analysis sharing a ReadWriteOnce home volume was allowed: %v", err)
+	}
+
+	if err = i.validateHomeVolume(&VICEJob{Job: model.Job{UserID: "u2", Submitter: "other"}}); err != nil {
+		t.Errorf("the first analysis using a home volume was refused: %v", err)
+	}
+
+	i.HomeVolumeAccessMode = ""
+	if err = i.validateHomeVolume(&VICEJob{Job: model.Job{UserID: "u1", Submitter: "ipcdev"}}); err != nil {
+		t.Errorf("a second analysis sharing a ReadWriteMany home volume was refused: %v", err)
+	}
+}
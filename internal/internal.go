@@ -1,12 +1,15 @@
 package internal
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cyverse-de/app-exposer/apps"
@@ -17,8 +20,11 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"gopkg.in/cyverse-de/model.v4"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -36,21 +42,63 @@ func slugString(str string) string {
 
 // Init contains configuration for configuring an *Internal.
 type Init struct {
-	PorklockImage                 string
-	PorklockTag                   string
-	InputPathListIdentifier       string
-	TicketInputPathListIdentifier string
-	ViceProxyImage                string
-	CASBaseURL                    string
-	FrontendBaseURL               string
-	ViceDefaultBackendService     string
-	ViceDefaultBackendServicePort int
-	GetAnalysisIDService          string
-	CheckResourceAccessService    string
-	VICEBackendNamespace          string
-	AppsServiceBaseURL            string
-	ViceNamespace                 string
-	JobStatusURL                  string
+	PorklockImage                  string
+	PorklockTag                    string
+	InputPathListIdentifier        string
+	TicketInputPathListIdentifier  string
+	ViceProxyImage                 string
+	CASBaseURL                     string
+	FrontendBaseURL                string
+	ViceDefaultBackendService      string
+	ViceDefaultBackendServicePort  int
+	GetAnalysisIDService           string
+	CheckResourceAccessService     string
+	VICEBackendNamespace           string
+	AppsServiceBaseURL             string
+	ViceNamespace                  string
+	JobStatusURL                   string
+	LaunchQueueEnabled             bool
+	LaunchQueueInterval            time.Duration
+	LaunchQueueGroupPriorities     map[string]int
+	ResourceRequestRatio           float64
+	EphemeralStorageLimit          string
+	GPUModels                      map[string]GPUModel
+	GPUDefaultModel                string
+	SchedulingPolicyFile           string
+	SchedulingPolicyReloadInterval time.Duration
+	PriorityClassDefault           string
+	PriorityClassUserTiers         map[string]string
+	PriorityClassAppCategories     map[string]string
+	TerminationGracePeriod         time.Duration
+	HomeVolumesEnabled             bool
+	HomeVolumeMountPath            string
+	HomeVolumeStorageClass         string
+	HomeVolumeAccessMode           string
+	HomeVolumeDefaultSize          string
+	HomeVolumeRetention            time.Duration
+	HomeVolumeCleanupInterval      time.Duration
+	SecurityProfiles               map[string]SecurityProfile
+	SecurityDefaultProfile         string
+	SecurityAppProfiles            map[string]string
+	SecurityMinimumLevel           string
+	NetworkPolicies                NetworkPolicyConfig
+	SecretsMountPath               string
+	AdminUsers                     []string
+	Redaction                      RedactionRules
+	OrphanGCEnabled                bool
+	OrphanGCInterval               time.Duration
+	OrphanGracePeriod              time.Duration
+	ReconcileEnabled               bool
+	ReconcileInterval              time.Duration
+	OperatorEnabled                bool
+	OperatorResyncInterval         time.Duration
+	TransferTimeout                time.Duration
+	TransferRequestTimeout         time.Duration
+	TransferPollInterval           time.Duration
+	CheckpointMinInterval          time.Duration
+	CheckpointCheckInterval        time.Duration
+	StorageBackends                map[string]StorageBackend
+	StorageDefaultBackend          string
 }
 
 // Internal contains information and operations for launching VICE apps inside the
@@ -58,20 +106,74 @@ type Init struct {
 type Internal struct {
 	Init
 	clientset       kubernetes.Interface
+	dynamicClient   dynamic.Interface
 	db              *sql.DB
 	statusPublisher AnalysisStatusPublisher
+	scheduling      *SchedulingPolicy
+	schedulingLock  sync.RWMutex
+	orphans         map[string]time.Time
+	orphansLock     sync.Mutex
+	transfers       map[string]trackedTransfer
+	transfersLock   sync.Mutex
+	transferClient  *http.Client
+	redaction       *redactor
+	redactionErr    error
+	redactionOnce   sync.Once
 }
 
-// New creates a new *Internal.
-func New(init *Init, db *sql.DB, clientset kubernetes.Interface) *Internal {
-	return &Internal{
-		Init:      *init,
-		db:        db,
-		clientset: clientset,
+// VICEJob is the job submission for a VICE analysis. It's a model.Job along
+// with the VICE-specific launch settings that the job model doesn't have
+// fields for. The settings are read from the top level of the job JSON.
+type VICEJob struct {
+	model.Job
+
+	// The number of GPUs to make available to the analysis. Defaults to one
+	// if the tool has an NVIDIA device configured and no count is set.
+	GPUCount int `json:"gpu_count,omitempty"`
+
+	// The name of the configured GPU model to use. Uses the default GPU model
+	// if it's not set.
+	GPUModel string `json:"gpu_model,omitempty"`
+
+	// The external ID of a suspended analysis. The workspace saved when it
+	// was suspended is restored into the working directory before the app
+	// starts.
+	ResumeFrom string `json:"resume_from,omitempty"`
+
+	// The names of the secrets registered by the user that should be made
+	// available in the analysis container.
+	Secrets []string `json:"secrets,omitempty"`
+
+	// How often the output files are uploaded while the analysis runs, e.g.
+	// 30m or 2h. The output files are only uploaded at the end if it's not
+	// set.
+	CheckpointInterval string `json:"checkpoint_interval,omitempty"`
+
+	// The name of the configured storage backend that the input files are
+	// downloaded from and the output files are uploaded to. Uses the default
+	// storage backend if it's not set.
+	StorageBackend string `json:"storage_backend,omitempty"`
+}
+
+// New creates a new *Internal. The dynamic client is only used in operator mode
+// and may be nil otherwise.
+func New(init *Init, db *sql.DB, clientset kubernetes.Interface, dynamicClient dynamic.Interface) *Internal {
+	i := &Internal{
+		Init:          *init,
+		db:            db,
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
 		statusPublisher: &JSLPublisher{
 			statusURL: init.JobStatusURL,
 		},
 	}
+
+	// Compile the redaction rules now rather than on the first listing.
+	if _, err := i.redactor(); err != nil {
+		log.Error(err)
+	}
+
+	return i
 }
 
 // labelsFromJob returns a map[string]string that can be used as labels for K8s resources.
@@ -163,7 +265,7 @@ func (i *Internal) UpsertInputPathListConfigMap(job *model.Job) error {
 // UpsertDeployment uses the Job passed in to assemble a Deployment for the
 // VICE analysis. If then uses the k8s API to create the Deployment if it does
 // not already exist or to update it if it does.
-func (i *Internal) UpsertDeployment(job *model.Job) error {
+func (i *Internal) UpsertDeployment(job *VICEJob) error {
 	deployment, err := i.getDeployment(job)
 	if err != nil {
 		return err
@@ -184,7 +286,7 @@ func (i *Internal) UpsertDeployment(job *model.Job) error {
 	}
 
 	// Create the service for the job.
-	svc, err := i.getService(job, deployment)
+	svc, err := i.getService(&job.Job, deployment)
 	if err != nil {
 		return err
 	}
@@ -198,7 +300,7 @@ func (i *Internal) UpsertDeployment(job *model.Job) error {
 	}
 
 	// Create the ingress for the job
-	ingress, err := i.getIngress(job, svc)
+	ingress, err := i.getIngress(&job.Job, svc)
 	if err != nil {
 		return err
 	}
@@ -212,14 +314,104 @@ func (i *Internal) UpsertDeployment(job *model.Job) error {
 		}
 	}
 
+	// Create the network policy for the job
+	if i.NetworkPolicies.Enabled {
+		if err = i.UpsertNetworkPolicy(&job.Job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// launch creates the k8s resources for the VICE analysis described by the
+// Job. The job should be validated before it's passed in.
+func (i *Internal) launch(job *VICEJob) error {
+	var err error
+
+	// In operator mode the controller creates the resources for the analysis.
+	if i.OperatorEnabled {
+		err = i.createVICEAnalysis(job)
+	} else {
+		err = i.launchResources(job)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The analysis is up at this point, so a checkpoint schedule that can't be
+	// stored is reported without failing the launch. The interval was checked
+	// when the job was validated.
+	if job.CheckpointInterval != "" {
+		interval, err := i.parseCheckpointInterval(job.CheckpointInterval)
+		if err == nil {
+			_, err = i.scheduleCheckpoints(job.InvocationID, interval)
+		}
+		if err != nil {
+			log.Error(err)
+			i.publishRunning(job.InvocationID, fmt.Sprintf("checkpoints couldn't be scheduled for job %s: %s", job.InvocationID, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// launchResources creates the k8s resources for the analysis.
+func (i *Internal) launchResources(job *VICEJob) error {
+	// Record the job so the analysis can be reconciled against it later.
+	if err := i.UpsertJobRecord(job); err != nil {
+		return err
+	}
+
+	// Create the excludes file ConfigMap for the job.
+	if err := i.UpsertExcludesConfigMap(&job.Job); err != nil {
+		return err
+	}
+
+	// Create the input path list config map
+	if err := i.UpsertInputPathListConfigMap(&job.Job); err != nil {
+		return err
+	}
+
+	// Create the config map listing the users the analysis is shared with.
+	if err := i.CreateSharingConfigMap(&job.Job); err != nil {
+		return err
+	}
+
+	// Create the user's home volume if they don't have one yet.
+	if i.HomeVolumesEnabled {
+		if err := i.UpsertHomeVolume(job); err != nil {
+			return err
+		}
+	}
+
+	// Copy the user secrets requested by the job into a secret for the job.
+	if err := i.UpsertAnalysisSecret(job); err != nil {
+		return err
+	}
+
+	// Create the deployment for the job.
+	if err := i.UpsertDeployment(job); err != nil {
+		return err
+	}
+
+	// Make the deployment the owner of the rest of the objects for the job so
+	// that they're deleted along with it. The analysis is already running at
+	// this point, so a failure is only logged. Objects without the owner
+	// reference are still deleted by their labels when the analysis exits.
+	if err := i.adoptByDeployment(job.InvocationID); err != nil {
+		log.Error(err)
+	}
+
 	return nil
 }
 
 // VICELaunchApp is the HTTP handler that orchestrates the launching of a VICE analysis inside
 // the k8s cluster. This get passed to the router to be associated with a route. The Job
-// is passed in as the body of the request.
+// is passed in as the body of the request. If the launch queue is enabled and the
+// user or the cluster is at capacity, the job is queued and a 202 is returned.
 func (i *Internal) VICELaunchApp(writer http.ResponseWriter, request *http.Request) {
-	job := &model.Job{}
+	job := &VICEJob{}
 
 	buf, err := ioutil.ReadAll(request.Body)
 	if err != nil {
@@ -233,70 +425,130 @@ func (i *Internal) VICELaunchApp(writer http.ResponseWriter, request *http.Reque
 	}
 
 	if err = i.validateJob(job); err != nil {
+		if i.LaunchQueueEnabled && isCapacityError(err) {
+			i.queueLaunch(writer, job, err)
+			return
+		}
+
 		http.Error(writer, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Create the excludes file ConfigMap for the job.
-	if err = i.UpsertExcludesConfigMap(job); err != nil {
-		if err != nil {
-			http.Error(
-				writer,
-				err.Error(),
-				http.StatusInternalServerError,
-			)
-			return
-		}
+	if err = i.launch(job); err != nil {
+		http.Error(
+			writer,
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+		return
 	}
+}
 
-	// Create the input path list config map
-	if err = i.UpsertInputPathListConfigMap(job); err != nil {
-		if err != nil {
-			http.Error(
-				writer,
-				err.Error(),
-				http.StatusInternalServerError,
-			)
+// VICETriggerUploads handles requests to trigger file uploads. The body of the
+// request is optional. If it's there, it's an UploadOptions that narrows down
+// the files that are uploaded and where they go.
+func (i *Internal) VICETriggerUploads(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	buf, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var options interface{}
+	if len(bytes.TrimSpace(buf)) > 0 {
+		uploadOptions := &UploadOptions{}
+		if err = json.Unmarshal(buf, uploadOptions); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
 			return
 		}
-	}
 
-	// Create the deployment for the job.
-	if err = i.UpsertDeployment(job); err != nil {
-		if err != nil {
-			http.Error(
-				writer,
-				err.Error(),
-				http.StatusInternalServerError,
-			)
+		// The destination is checked against the home folder of the user
+		// that launched the analysis, which comes from its job record.
+		var home string
+		if uploadOptions.Destination != "" {
+			job, err := i.jobRecord(id)
+			if k8serrors.IsNotFound(errors.Cause(err)) {
+				http.Error(writer, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			home = path.Join(job.IRODSBase, job.Submitter)
+		}
+
+		if err = uploadOptions.validate(home); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if !uploadOptions.empty() {
+			options = uploadOptions
+		}
 	}
-}
 
-// VICETriggerDownloads handles requests to trigger file downloads.
-func (i *Internal) VICETriggerDownloads(writer http.ResponseWriter, request *http.Request) {
-	var err error
-	if err = i.doFileTransfer(request, downloadBasePath, downloadKind, true); err != nil {
+	if err = i.doFileTransfer(id, uploadBasePath, uploadKind, options, true); err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-// VICETriggerUploads handles requests to trigger file uploads.
-func (i *Internal) VICETriggerUploads(writer http.ResponseWriter, request *http.Request) {
-	var err error
-	if err = i.doFileTransfer(request, uploadBasePath, uploadKind, true); err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+// ExitedObject is a k8s object that was deleted when an analysis exited or that
+// couldn't be deleted. Cascaded objects are owned by another deleted object and
+// are deleted by the garbage collector before their owner is.
+type ExitedObject struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Cascaded bool   `json:"cascaded,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ExitResult lists what was done when an analysis exited.
+type ExitResult struct {
+	ExternalID string         `json:"external_id"`
+	Dequeued   bool           `json:"dequeued"`
+	Removed    []ExitedObject `json:"removed"`
+	Failed     []ExitedObject `json:"failed"`
+}
+
+// matched returns true if anything belonging to the analysis was found.
+func (r *ExitResult) matched() bool {
+	return r.Dequeued || len(r.Removed) > 0 || len(r.Failed) > 0
+}
+
+// record adds the outcome of deleting an object to the result.
+func (r *ExitResult) record(kind, name string, cascaded bool, err error) {
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error deleting %s %s for %s", kind, name, r.ExternalID))
+		r.Failed = append(r.Failed, ExitedObject{Kind: kind, Name: name, Error: err.Error()})
+		return
 	}
+	r.Removed = append(r.Removed, ExitedObject{Kind: kind, Name: name, Cascaded: cascaded})
 }
 
-// VICEExit terminates the VICE analysis deployment and cleans up
-// resources asscociated with it. Does not save outputs first. Uses
-// the external-id label to find all of the objects in the configured
-// namespace associated with the job. Deletes the following objects:
-// ingresses, services, deployments, and configmaps.
-func (i *Internal) VICEExit(writer http.ResponseWriter, request *http.Request) {
-	id := mux.Vars(request)["id"]
+// ownedBy returns true if one of the owner references points at one of the
+// owners.
+func ownedBy(refs []metav1.OwnerReference, owners map[types.UID]bool) bool {
+	for _, ref := range refs {
+		if owners[ref.UID] {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteAnalysisObjects deletes the objects for the analysis in order. The
+// VICEAnalysis is deleted first in operator mode, then the Deployment. Both
+// are deleted in the foreground, so the objects they own are deleted by the
+// garbage collector before they are. The objects that aren't owned by either
+// of them are deleted individually.
+func (i *Internal) deleteAnalysisObjects(id string) (*ExitResult, error) {
+	result := &ExitResult{
+		ExternalID: id,
+		Removed:    []ExitedObject{},
+		Failed:     []ExitedObject{},
+	}
 
 	set := labels.Set(map[string]string{
 		"external-id": id,
@@ -306,61 +558,170 @@ func (i *Internal) VICEExit(writer http.ResponseWriter, request *http.Request) {
 		LabelSelector: set.AsSelector().String(),
 	}
 
+	propagation := metav1.DeletePropagationForeground
+	deleteoptions := &metav1.DeleteOptions{PropagationPolicy: &propagation}
+
+	// The UIDs of the deleted objects that own other objects.
+	owners := map[types.UID]bool{}
+
+	// Delete the VICEAnalysis first so the controller doesn't recreate the
+	// objects deleted below.
+	if i.OperatorEnabled {
+		if err := i.deleteVICEAnalyses(listoptions, deleteoptions, result, owners); err != nil {
+			return nil, err
+		}
+	}
+
+	// Delete the deployment
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	deplist, err := depclient.List(listoptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range deplist.Items {
+		if ownedBy(dep.OwnerReferences, owners) {
+			owners[dep.UID] = true
+			result.record("Deployment", dep.Name, true, nil)
+			continue
+		}
+		err = depclient.Delete(dep.Name, deleteoptions)
+		if err == nil {
+			owners[dep.UID] = true
+		}
+		result.record("Deployment", dep.Name, false, err)
+	}
+
 	// Delete the ingress
 	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
 	ingresslist, err := ingressclient.List(listoptions)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	for _, ingress := range ingresslist.Items {
-		if err = ingressclient.Delete(ingress.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+		if ownedBy(ingress.OwnerReferences, owners) {
+			result.record("Ingress", ingress.Name, true, nil)
+			continue
 		}
+		result.record("Ingress", ingress.Name, false, ingressclient.Delete(ingress.Name, deleteoptions))
 	}
 
 	// Delete the service
 	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
 	svclist, err := svcclient.List(listoptions)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	for _, svc := range svclist.Items {
-		if err = svcclient.Delete(svc.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+		if ownedBy(svc.OwnerReferences, owners) {
+			result.record("Service", svc.Name, true, nil)
+			continue
 		}
+		result.record("Service", svc.Name, false, svcclient.Delete(svc.Name, deleteoptions))
 	}
 
-	// Delete the deployment
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	deplist, err := depclient.List(listoptions)
+	// Delete the network policy
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+	nplist, err := npclient.List(listoptions)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	for _, dep := range deplist.Items {
-		if err = depclient.Delete(dep.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+	for _, np := range nplist.Items {
+		if ownedBy(np.OwnerReferences, owners) {
+			result.record("NetworkPolicy", np.Name, true, nil)
+			continue
+		}
+		result.record("NetworkPolicy", np.Name, false, npclient.Delete(np.Name, deleteoptions))
+	}
+
+	// Delete the secret containing the user secrets
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	secretlist, err := secretclient.List(listoptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secretlist.Items {
+		if ownedBy(secret.OwnerReferences, owners) {
+			result.record("Secret", secret.Name, true, nil)
+			continue
 		}
+		result.record("Secret", secret.Name, false, secretclient.Delete(secret.Name, deleteoptions))
 	}
 
 	// Delete the input files list and the excludes list config maps
 	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
 	cmlist, err := cmclient.List(listoptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, cm := range cmlist.Items {
+		if ownedBy(cm.OwnerReferences, owners) {
+			result.record("ConfigMap", cm.Name, true, nil)
+			continue
+		}
+		result.record("ConfigMap", cm.Name, false, cmclient.Delete(cm.Name, deleteoptions))
+	}
+
+	log.Infof("exited analysis %s: %d objects removed, %d failed", id, len(result.Removed), len(result.Failed))
+
+	return result, nil
+}
+
+// exitAnalysis terminates the VICE analysis deployment and cleans up
+// resources asscociated with it. Does not save outputs first. Removes the
+// analysis from the launch queue if it hasn't been launched yet and uses the
+// external-id label to find all of the objects in the configured namespace
+// associated with the job.
+func (i *Internal) exitAnalysis(id string) (*ExitResult, error) {
+	// The analysis may not have made it out of the launch queue yet.
+	dequeued, err := i.dequeueLaunch(id)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// There's nothing left to checkpoint.
+	if _, err = i.unscheduleCheckpoints(id); err != nil {
+		log.Error(err)
+	}
+
+	result, err := i.deleteAnalysisObjects(id)
+	if err != nil {
+		return nil, err
+	}
+	result.Dequeued = dequeued
+
+	return result, nil
+}
+
+// VICEExit terminates the VICE analysis deployment and cleans up
+// resources asscociated with it. Does not save outputs first. The response
+// lists the objects that were removed and the ones that couldn't be. A 404 is
+// returned if nothing belongs to the analysis and a 500 is returned if any of
+// the objects couldn't be removed.
+func (i *Internal) VICEExit(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	result, err := i.exitAnalysis(id)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("number of configmaps to be deleted for %s: %d", id, len(cmlist.Items))
+	if !result.matched() {
+		http.Error(writer, fmt.Sprintf("no resources found for analysis %s", id), http.StatusNotFound)
+		return
+	}
 
-	for _, cm := range cmlist.Items {
-		log.Infof("deleting configmap %s for %s", cm.Name, id)
-		if err = cmclient.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
-		}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	if len(result.Failed) > 0 {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+	writer.Write(buf)
 }
 
 func (i *Internal) getIDFromHost(host string) (string, error) {
@@ -449,34 +810,6 @@ func (i *Internal) VICEStatus(writer http.ResponseWriter, request *http.Request)
 	fmt.Fprintf(writer, string(body))
 }
 
-// VICESaveAndExit handles requests to save the output files in iRODS and then exit.
-// The exit portion will only occur if the save operation succeeds. The operation is
-// performed inside of a goroutine so that the caller isn't waiting for hours/days for
-// output file transfers to complete.
-func (i *Internal) VICESaveAndExit(writer http.ResponseWriter, request *http.Request) {
-	log.Info("save and exit called")
-
-	// Since file transfers can take a while, we should do this asynchronously by default.
-	go func(writer http.ResponseWriter, request *http.Request) {
-		var err error
-
-		log.Info("calling doFileTransfer")
-
-		// Trigger a blocking output file transfer request.
-		if err = i.doFileTransfer(request, uploadBasePath, uploadKind, false); err != nil {
-			log.Error(errors.Wrap(err, "error doing file transfer")) // Log but don't exit. Possible to cancel a job that hasn't started yet
-		}
-
-		log.Info("calling VICEExit")
-
-		i.VICEExit(writer, request)
-
-		log.Info("after VICEExit")
-	}(writer, request)
-
-	log.Info("leaving save and exit")
-}
-
 const updateTimeLimitSQL = `
 	UPDATE ONLY jobs
 	   SET planned_end_date = old_value.planned_end_date + interval '72 hours'
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeleteAnalysisObjects(t *testing.T) {
+	labels := map[string]string{"external-id": "a"}
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps", UID: "uid-a", Labels: labels}}
+	owner := deploymentOwnerReference(deployment)
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			deployment,
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{
+				Name: "vice-a", Namespace: "vice-apps", Labels: labels,
+				OwnerReferences: []metav1.OwnerReference{owner},
+			}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-a", Namespace: "vice-apps", Labels: labels}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-b", Namespace: "vice-apps"}},
+		),
+	}
+
+	result, err := i.deleteAnalysisObjects("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.matched() || len(result.Removed) != 3 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	removed := map[string]ExitedObject{}
+	for _, obj := range result.Removed {
+		removed[obj.Kind] = obj
+	}
+	if removed["Deployment"].Cascaded || !removed["Service"].Cascaded || removed["ConfigMap"].Cascaded {
+		t.Errorf("unexpected cascading in %+v", result.Removed)
+	}
+
+	// The owned service is left to the garbage collector.
+	if _, err = i.clientset.CoreV1().Services("vice-apps").Get("vice-a", metav1.GetOptions{}); err != nil {
+		t.Errorf("the owned service was deleted directly: %v", err)
+	}
+	if _, err = i.clientset.CoreV1().ConfigMaps("vice-apps").Get("excludes-file-a", metav1.GetOptions{}); err == nil {
+		t.Error("the unowned config map wasn't deleted")
+	}
+	if _, err = i.clientset.CoreV1().ConfigMaps("vice-apps").Get("excludes-file-b", metav1.GetOptions{}); err != nil {
+		t.Error("a config map for another analysis was deleted")
+	}
+
+	result, err = i.deleteAnalysisObjects("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.matched() {
+		t.Errorf("an unknown analysis matched %+v", result)
+	}
+}
@@ -1,17 +1,80 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
-	"gopkg.in/cyverse-de/model.v4"
 	v1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 )
 
+// capacityError is returned when a job can't be launched right now, but could
+// be launched once the user or the cluster has capacity for it.
+type capacityError struct {
+	msg string
+}
+
+func (c *capacityError) Error() string {
+	return c.msg
+}
+
+func newCapacityError(format string, args ...interface{}) error {
+	return &capacityError{msg: fmt.Sprintf(format, args...)}
+}
+
+// isCapacityError returns true if the cause of the error is a lack of capacity.
+func isCapacityError(err error) bool {
+	_, ok := errors.Cause(err).(*capacityError)
+	return ok
+}
+
+// isTransientError returns true if the error is likely to go away on its own,
+// such as when the k8s API server or the database is briefly unavailable.
+// Other errors, like a job that fails validation, happen again if the
+// operation is retried.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+
+	if _, ok := cause.(k8serrors.APIStatus); ok {
+		return k8serrors.IsServerTimeout(cause) ||
+			k8serrors.IsTimeout(cause) ||
+			k8serrors.IsTooManyRequests(cause) ||
+			k8serrors.IsServiceUnavailable(cause) ||
+			k8serrors.IsInternalError(cause) ||
+			k8serrors.IsUnexpectedServerError(cause) ||
+			k8serrors.IsConflict(cause)
+	}
+
+	if pqerr, ok := cause.(*pq.Error); ok {
+		switch pqerr.Code.Class() {
+		case "08", "40", "53", "57", "58":
+			return true
+		}
+		return false
+	}
+
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+
+	return cause == context.DeadlineExceeded || cause == driver.ErrBadConn || cause == sql.ErrConnDone
+}
+
 func shouldCountStatus(status string) bool {
 	countIt := true
 
@@ -30,7 +93,10 @@ func shouldCountStatus(status string) bool {
 	return countIt
 }
 
-func (i *Internal) countJobsForUser(username string) (int, error) {
+// runningDeploymentsForUser returns the VICE deployments for the user that
+// should count against their limits. Deployments for analyses that the
+// database says have finished are skipped.
+func (i *Internal) runningDeploymentsForUser(username string) ([]v1.Deployment, error) {
 	set := labels.Set(map[string]string{
 		"username": username,
 	})
@@ -42,7 +108,7 @@ func (i *Internal) countJobsForUser(username string) (int, error) {
 	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
 	deplist, err := depclient.List(listoptions)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	countedDeployments := []v1.Deployment{}
@@ -88,7 +154,15 @@ func (i *Internal) countJobsForUser(username string) (int, error) {
 		}
 	}
 
-	return len(countedDeployments), nil
+	return countedDeployments, nil
+}
+
+func (i *Internal) countJobsForUser(username string) (int, error) {
+	deployments, err := i.runningDeploymentsForUser(username)
+	if err != nil {
+		return 0, err
+	}
+	return len(deployments), nil
 }
 
 const getJobLimitForUserSQL = `
@@ -105,13 +179,40 @@ func (i *Internal) getJobLimitForUser(username string) (int, error) {
 	return jobLimit, nil
 }
 
-func (i *Internal) validateJob(job *model.Job) error {
+func (i *Internal) validateJob(job *VICEJob) error {
 
 	// Verify that the job type is supported by this service
 	if strings.ToLower(job.ExecutionTarget) != "interapps" {
 		return fmt.Errorf("job type %s is not supported by this service", job.Type)
 	}
 
+	// Verify that the workspace being resumed from exists and belongs to the user.
+	if _, err := i.resumeWorkspace(job); err != nil {
+		return err
+	}
+
+	// Verify that the user has registered the secrets the job asks for.
+	if _, err := i.secretsForJob(job); err != nil {
+		return err
+	}
+
+	// Verify that the checkpoint interval is one the users can choose.
+	if job.CheckpointInterval != "" {
+		if _, err := i.parseCheckpointInterval(job.CheckpointInterval); err != nil {
+			return err
+		}
+	}
+
+	// Verify that the requested storage backend is available.
+	if _, err := i.storageBackend(job); err != nil {
+		return err
+	}
+
+	// Verify that the requested GPU model is available.
+	if _, err := i.gpuRequest(job); err != nil {
+		return err
+	}
+
 	// Get the username
 	user := slugString(job.Submitter)
 
@@ -124,8 +225,126 @@ func (i *Internal) validateJob(job *model.Job) error {
 	if err != nil {
 		return errors.Wrapf(err, "unable to determine the concurrent job limit for %s", user)
 	}
+	if jobLimit <= 0 {
+		return fmt.Errorf("%s is not allowed to run concurrent jobs", user)
+	}
 	if jobCount >= jobLimit {
-		return fmt.Errorf("%s is already running %d or more concurrent jobs", user, jobLimit)
+		return newCapacityError("%s is already running %d or more concurrent jobs", user, jobLimit)
+	}
+
+	// Verify that the user's home volume can be mounted by another analysis.
+	if err = i.validateHomeVolume(job); err != nil {
+		return err
+	}
+
+	// Verify that the job won't push the user over their resource quota.
+	if err = i.validateQuota(job); err != nil {
+		return err
+	}
+
+	// Verify that the cluster has enough GPUs free to run the job.
+	if err = i.validateGPUCapacity(job); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// nodeMatchesAffinity returns true if the node's labels satisfy all of the
+// affinity terms.
+func nodeMatchesAffinity(node *apiv1.Node, affinity []NodeAffinityTerm) bool {
+	for _, term := range affinity {
+		requirement := term.requirement()
+
+		// The node selector operators are the capitalized versions of the
+		// label selector operators, except for DoesNotExist.
+		op := selection.Operator(strings.ToLower(string(requirement.Operator)))
+		if requirement.Operator == apiv1.NodeSelectorOpDoesNotExist {
+			op = selection.DoesNotExist
+		}
+
+		selector, err := labels.NewRequirement(requirement.Key, op, requirement.Values)
+		if err != nil {
+			log.Warn(err)
+			return false
+		}
+		if !selector.Matches(labels.Set(node.Labels)) {
+			return false
+		}
+	}
+	return true
+}
+
+// availableGPUs returns the number of GPUs of the requested model on the GPU
+// nodes in the cluster that haven't been claimed by a pod yet. VICE pods that
+// are still waiting to be scheduled are counted as claiming their GPUs.
+func (i *Internal) availableGPUs(gpu *GPURequest) (int64, error) {
+	nodelist, err := i.clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only count the nodes that the scheduling policy puts GPU analyses on.
+	affinity := append(append([]NodeAffinityTerm{}, i.schedulingPolicy().GPU.Affinity...), gpu.Model.Affinity...)
+
+	var total int64
+	resourceName := apiv1.ResourceName(gpu.Model.Resource)
+	gpuNodes := map[string]bool{}
+
+	for _, node := range nodelist.Items {
+		if node.Spec.Unschedulable || !nodeMatchesAffinity(&node, affinity) {
+			continue
+		}
+		if gpus, ok := node.Status.Allocatable[resourceName]; ok {
+			total += gpus.Value()
+			gpuNodes[node.Name] = true
+		}
+	}
+
+	podlist, err := i.clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	var claimed int64
+	for _, pod := range podlist.Items {
+		if pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+
+		unscheduledVICEPod := pod.Spec.NodeName == "" && pod.Namespace == i.ViceNamespace
+		if !gpuNodes[pod.Spec.NodeName] && !unscheduledVICEPod {
+			continue
+		}
+
+		for _, container := range pod.Spec.Containers {
+			if gpus, ok := container.Resources.Limits[resourceName]; ok {
+				claimed += gpus.Value()
+			}
+		}
+	}
+
+	return total - claimed, nil
+}
+
+// validateGPUCapacity returns an error if the job needs more GPUs than are
+// currently free in the cluster.
+func (i *Internal) validateGPUCapacity(job *VICEJob) error {
+	gpu, err := i.gpuRequest(job)
+	if err != nil {
+		return err
+	}
+	if gpu == nil {
+		return nil
+	}
+
+	available, err := i.availableGPUs(gpu)
+	if err != nil {
+		return errors.Wrap(err, "unable to determine the number of GPUs available in the cluster")
+	}
+
+	if available < gpu.Count {
+		return newCapacityError("the cluster has %d %s GPUs available, but %d are needed", available, gpu.Name, gpu.Count)
 	}
 
 	return nil
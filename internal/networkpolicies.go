@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultEgressPolicyName is the egress policy used when neither the app nor
+// the config picks one.
+const defaultEgressPolicyName = "internet"
+
+// PeerSelector selects the pods that are allowed to connect to analyses. An
+// empty set of namespace labels matches pods in every namespace, so it's
+// rejected by NetworkPolicyConfig.Validate.
+type PeerSelector struct {
+	NamespaceLabels map[string]string `mapstructure:"namespace-labels"`
+	PodLabels       map[string]string `mapstructure:"pod-labels"`
+}
+
+// peer returns the NetworkPolicyPeer for the selector.
+func (p PeerSelector) peer() netv1.NetworkPolicyPeer {
+	return netv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: p.NamespaceLabels,
+		},
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: p.PodLabels,
+		},
+	}
+}
+
+// EgressPolicy controls the outgoing connections that an analysis can make.
+// Connections to DNS, to pods in the cluster, and to the required CIDRs, like
+// the data store and CAS, are always allowed.
+type EgressPolicy struct {
+	AllowInternet bool     `mapstructure:"allow-internet"`
+	AllowCIDRs    []string `mapstructure:"allow-cidrs"`
+}
+
+// NetworkPolicyConfig contains the settings for the NetworkPolicy that's
+// created for each analysis.
+type NetworkPolicyConfig struct {
+	Enabled             bool                    `mapstructure:"enabled"`
+	IngressController   PeerSelector            `mapstructure:"ingress-controller"`
+	AppExposer          PeerSelector            `mapstructure:"app-exposer"`
+	RequiredEgressCIDRs []string                `mapstructure:"required-egress-cidrs"`
+	DefaultEgressPolicy string                  `mapstructure:"default-egress-policy"`
+	EgressPolicies      map[string]EgressPolicy `mapstructure:"egress-policies"`
+	AppEgressPolicies   map[string]string       `mapstructure:"app-egress-policies"`
+}
+
+// Validate returns an error if network policies are enabled and the pods that
+// can connect to analyses aren't limited to a namespace. Without namespace
+// labels, any pod with the right labels in any namespace could reach the
+// file transfer port of an analysis and trigger uploads.
+func (c NetworkPolicyConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.IngressController.NamespaceLabels) == 0 {
+		return fmt.Errorf("ingress-controller.namespace-labels must be set when network policies are enabled")
+	}
+	if len(c.AppExposer.NamespaceLabels) == 0 {
+		return fmt.Errorf("app-exposer.namespace-labels must be set when network policies are enabled")
+	}
+	return nil
+}
+
+// egressPolicies returns the configured egress policies, or the built-in ones
+// if none are configured.
+func (c NetworkPolicyConfig) egressPolicies() map[string]EgressPolicy {
+	if len(c.EgressPolicies) > 0 {
+		return c.EgressPolicies
+	}
+	return map[string]EgressPolicy{
+		"internet":    {AllowInternet: true},
+		"no-internet": {AllowInternet: false},
+	}
+}
+
+// egressPolicyFor returns the egress policy for the job's app. Apps without a
+// policy of their own get the default policy.
+func (c NetworkPolicyConfig) egressPolicyFor(job *model.Job) (EgressPolicy, error) {
+	name, ok := c.AppEgressPolicies[strings.ToLower(job.AppID)]
+	if !ok {
+		name = c.DefaultEgressPolicy
+	}
+	if name == "" {
+		name = defaultEgressPolicyName
+	}
+
+	policy, ok := c.egressPolicies()[strings.ToLower(name)]
+	if !ok {
+		return EgressPolicy{}, fmt.Errorf("egress policy %s is not configured", name)
+	}
+
+	return policy, nil
+}
+
+func networkPolicyName(invocationID string) string {
+	return fmt.Sprintf("vice-%s", invocationID)
+}
+
+// egressRules returns the egress rules for the policy.
+func (c NetworkPolicyConfig) egressRules(policy EgressPolicy) []netv1.NetworkPolicyEgressRule {
+	// An egress rule without any peers or ports allows everything.
+	if policy.AllowInternet {
+		return []netv1.NetworkPolicyEgressRule{{}}
+	}
+
+	udp := apiv1.ProtocolUDP
+	tcp := apiv1.ProtocolTCP
+	dns := intstr.FromInt(53)
+
+	peers := []netv1.NetworkPolicyPeer{
+		// Pods in any namespace in the cluster.
+		{NamespaceSelector: &metav1.LabelSelector{}},
+	}
+
+	cidrs := append(append([]string{}, c.RequiredEgressCIDRs...), policy.AllowCIDRs...)
+	for _, cidr := range cidrs {
+		peers = append(peers, netv1.NetworkPolicyPeer{
+			IPBlock: &netv1.IPBlock{CIDR: cidr},
+		})
+	}
+
+	return []netv1.NetworkPolicyEgressRule{
+		{
+			Ports: []netv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dns},
+				{Protocol: &tcp, Port: &dns},
+			},
+		},
+		{
+			To: peers,
+		},
+	}
+}
+
+// getNetworkPolicy assembles and returns the NetworkPolicy for the VICE
+// analysis. Incoming connections are only allowed from the ingress controller
+// to the vice-proxy port and from app-exposer to the file transfer port.
+// Outgoing connections are controlled by the egress policy for the app. It
+// does not call the k8s API.
+func (i *Internal) getNetworkPolicy(job *model.Job) (*netv1.NetworkPolicy, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	egress, err := i.NetworkPolicies.egressPolicyFor(job)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := apiv1.ProtocolTCP
+	proxyPort := intstr.FromInt(int(viceProxyPort))
+	transfersPort := intstr.FromInt(int(fileTransfersPort))
+
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   networkPolicyName(job.InvocationID),
+			Labels: labels,
+		},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"external-id": job.InvocationID,
+				},
+			},
+			PolicyTypes: []netv1.PolicyType{
+				netv1.PolicyTypeIngress,
+				netv1.PolicyTypeEgress,
+			},
+			Ingress: []netv1.NetworkPolicyIngressRule{
+				{
+					From:  []netv1.NetworkPolicyPeer{i.NetworkPolicies.IngressController.peer()},
+					Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: &proxyPort}},
+				},
+				{
+					From:  []netv1.NetworkPolicyPeer{i.NetworkPolicies.AppExposer.peer()},
+					Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: &transfersPort}},
+				},
+			},
+			Egress: i.NetworkPolicies.egressRules(egress),
+		},
+	}, nil
+}
+
+// UpsertNetworkPolicy creates the NetworkPolicy for the analysis if it doesn't
+// exist, or updates it if it does.
+func (i *Internal) UpsertNetworkPolicy(job *model.Job) error {
+	policy, err := i.getNetworkPolicy(job)
+	if err != nil {
+		return err
+	}
+
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+
+	existing, err := npclient.Get(policy.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = npclient.Create(policy)
+		return err
+	}
+
+	policy.ResourceVersion = existing.ResourceVersion
+	_, err = npclient.Update(policy)
+	return err
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+func TestEgressPolicyFor(t *testing.T) {
+	c := NetworkPolicyConfig{
+		AppEgressPolicies: map[string]string{"app": "no-internet"},
+	}
+
+	job := testJob(model.Container{})
+	job.AppID = "app"
+	if policy, err := c.egressPolicyFor(job); err != nil || policy.AllowInternet {
+		t.Errorf("egressPolicyFor returned %v, %v for an app without internet access", policy, err)
+	}
+
+	job.AppID = "other"
+	if policy, err := c.egressPolicyFor(job); err != nil || !policy.AllowInternet {
+		t.Errorf("egressPolicyFor returned %v, %v for an app with the default policy", policy, err)
+	}
+
+	c.DefaultEgressPolicy = "missing"
+	if _, err := c.egressPolicyFor(job); err == nil {
+		t.Error("egressPolicyFor didn't fail for a missing policy")
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	c := NetworkPolicyConfig{
+		RequiredEgressCIDRs: []string{"10.0.0.0/8"},
+	}
+
+	rules := c.egressRules(EgressPolicy{AllowInternet: true})
+	if len(rules) != 1 || len(rules[0].To) != 0 || len(rules[0].Ports) != 0 {
+		t.Errorf("unexpected rules for internet access: %v", rules)
+	}
+
+	rules = c.egressRules(EgressPolicy{AllowCIDRs: []string{"192.168.1.0/24"}})
+	if len(rules) != 2 {
+		t.Fatalf("expected DNS and peer rules, got %v", rules)
+	}
+
+	var cidrs []string
+	for _, peer := range rules[1].To {
+		if peer.IPBlock != nil {
+			cidrs = append(cidrs, peer.IPBlock.CIDR)
+			if peer.IPBlock.CIDR == "0.0.0.0/0" {
+				t.Error("the internet is allowed by a policy without internet access")
+			}
+		}
+	}
+	if len(cidrs) != 2 || cidrs[0] != "10.0.0.0/8" || cidrs[1] != "192.168.1.0/24" {
+		t.Errorf("unexpected CIDRs %v", cidrs)
+	}
+}
+
+func TestNetworkPolicyConfigValidate(t *testing.T) {
+	c := NetworkPolicyConfig{
+		Enabled:           true,
+		IngressController: PeerSelector{NamespaceLabels: map[string]string{"name": "ingress-nginx"}},
+		AppExposer:        PeerSelector{NamespaceLabels: map[string]string{"name": "prod"}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("a valid config was rejected: %s", err)
+	}
+
+	c.AppExposer.NamespaceLabels = nil
+	if err := c.Validate(); err == nil {
+		t.Error("a config that lets pods in every namespace connect was accepted")
+	}
+
+	c.Enabled = false
+	if err := c.Validate(); err != nil {
+		t.Errorf("a disabled config was rejected: %s", err)
+	}
+}
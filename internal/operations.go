@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The kinds of long-running operations on an analysis.
+const (
+	saveAndExitOperation = "save-and-exit"
+	suspendOperation     = "suspend"
+)
+
+// The statuses an operation goes through. Save-and-exit and suspend operations
+// go from pending to uploading to exiting and end up completed or failed.
+const (
+	OperationPending   = "pending"
+	OperationUploading = "uploading"
+	OperationExiting   = "exiting"
+	OperationCompleted = "completed"
+	OperationFailed    = "failed"
+)
+
+// operationHeartbeat is how often a running operation records that it's still
+// being worked on. Operations that haven't been touched for operationStaleAfter
+// are assumed to belong to an app-exposer instance that went away and are
+// resumed by another one.
+const (
+	operationHeartbeat  = time.Minute
+	operationStaleAfter = 5 * time.Minute
+)
+
+// errOperationRunning is returned when an operation is already running for the
+// analysis.
+var errOperationRunning = errors.New("the operation is already running")
+
+// Operation is a long-running operation on an analysis. Operations are stored
+// in the database so that they survive app-exposer restarts.
+type Operation struct {
+	ID         string    `json:"id"`
+	ExternalID string    `json:"external_id"`
+	Kind       string    `json:"kind"`
+	Status     string    `json:"status"`
+	Message    string    `json:"message,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Nothing is returned if an operation is already running for the analysis.
+const createOperationSQL = `
+	INSERT INTO vice_operations (external_id, kind, status)
+	VALUES ($1, $2, $3)
+	    ON CONFLICT (external_id) WHERE status NOT IN ('completed', 'failed') DO NOTHING
+	RETURNING id, created_at, updated_at
+`
+
+const updateOperationSQL = `
+	UPDATE vice_operations
+	   SET status = $2, message = $3, updated_at = now()
+	 WHERE id = $1
+`
+
+const touchOperationSQL = `
+	UPDATE vice_operations SET updated_at = now() WHERE id = $1
+`
+
+const getOperationSQL = `
+	SELECT id, external_id, kind, status, COALESCE(message, ''), created_at, updated_at
+	  FROM vice_operations
+	 WHERE id::text = $1
+	   AND external_id = $2
+`
+
+// Claiming an operation touches it, so an operation is only claimed by one
+// app-exposer instance.
+const claimStaleOperationsSQL = `
+	UPDATE vice_operations
+	   SET updated_at = now()
+	 WHERE id IN (
+		SELECT id
+		  FROM vice_operations
+		 WHERE status NOT IN ('completed', 'failed')
+		   AND updated_at < $1
+		   FOR UPDATE SKIP LOCKED
+	 )
+	RETURNING id, external_id, kind, status, COALESCE(message, ''), created_at, updated_at
+`
+
+// createOperation stores a new pending operation for the analysis. Returns
+// errOperationRunning if another operation is already running for it.
+func (i *Internal) createOperation(externalID, kind string) (*Operation, error) {
+	op := &Operation{
+		ExternalID: externalID,
+		Kind:       kind,
+		Status:     OperationPending,
+	}
+
+	err := i.db.QueryRow(createOperationSQL, externalID, kind, op.Status).Scan(&op.ID, &op.CreatedAt, &op.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errOperationRunning
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating the %s operation for %s", kind, externalID)
+	}
+	return op, nil
+}
+
+// setOperationStatus records the new status of the operation.
+func (i *Internal) setOperationStatus(op *Operation, status, msg string) {
+	op.Status = status
+	op.Message = msg
+	if _, err := i.db.Exec(updateOperationSQL, op.ID, status, msg); err != nil {
+		log.Error(errors.Wrapf(err, "error updating operation %s to %s", op.ID, status))
+	}
+}
+
+// getOperation returns the operation for the analysis.
+func (i *Internal) getOperation(externalID, id string) (*Operation, error) {
+	op := &Operation{}
+	err := i.db.QueryRow(getOperationSQL, id, externalID).Scan(
+		&op.ID, &op.ExternalID, &op.Kind, &op.Status, &op.Message, &op.CreatedAt, &op.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// heartbeat touches the operation until the returned function is called.
+func (i *Internal) heartbeat(op *Operation) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(operationHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := i.db.Exec(touchOperationSQL, op.ID); err != nil {
+					log.Error(errors.Wrapf(err, "error touching operation %s", op.ID))
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// exitSummary describes the outcome of exiting the analysis.
+func exitSummary(result *ExitResult) string {
+	if len(result.Failed) == 0 {
+		return fmt.Sprintf("removed %d objects", len(result.Removed))
+	}
+
+	msg := fmt.Sprintf("removed %d objects, failed to remove %d:", len(result.Removed), len(result.Failed))
+	for _, obj := range result.Failed {
+		msg = fmt.Sprintf("%s %s %s (%s);", msg, obj.Kind, obj.Name, obj.Error)
+	}
+	return msg
+}
+
+// failOperation marks the operation and the analysis as failed.
+func (i *Internal) failOperation(op *Operation, msg string) {
+	i.setOperationStatus(op, OperationFailed, msg)
+	if err := i.statusPublisher.Fail(op.ExternalID, msg); err != nil {
+		log.Error(err)
+	}
+}
+
+// runSaveAndExit uploads the output files of the analysis and then shuts it
+// down. If the upload fails, only the operation is marked as failed. The
+// analysis is left running with its status unchanged, so that the orphan
+// collector doesn't remove it and the outputs can still be retrieved. A resumed operation picks
+// up at the step it was on. If it was uploading, it waits for the upload that's
+// already running rather than starting another one.
+func (i *Internal) runSaveAndExit(op *Operation) {
+	stop := i.heartbeat(op)
+	defer stop()
+
+	id := op.ExternalID
+
+	if op.Status == OperationPending || op.Status == OperationUploading {
+		var err error
+		if op.Status == OperationUploading {
+			err = i.resumeFileTransfer(id, uploadBasePath, uploadKind)
+		} else {
+			i.setOperationStatus(op, OperationUploading, "")
+			err = i.doFileTransfer(id, uploadBasePath, uploadKind, nil, false)
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("the output files couldn't be saved: %s", err.Error())
+			log.Error(errors.Wrapf(err, "error saving the output files for %s", id))
+			i.setOperationStatus(op, OperationFailed, msg)
+			i.publishRunning(id, fmt.Sprintf("the analysis was not shut down because %s", msg))
+			return
+		}
+	}
+
+	i.setOperationStatus(op, OperationExiting, "")
+
+	result, err := i.exitAnalysis(id)
+	if err != nil {
+		i.failOperation(op, fmt.Sprintf("the analysis couldn't be shut down: %s", err.Error()))
+		return
+	}
+
+	if len(result.Failed) > 0 {
+		i.failOperation(op, fmt.Sprintf("the analysis couldn't be shut down: %s", exitSummary(result)))
+		return
+	}
+
+	i.setOperationStatus(op, OperationCompleted, exitSummary(result))
+}
+
+// runOperation runs the operation based on its kind.
+func (i *Internal) runOperation(op *Operation) {
+	switch op.Kind {
+	case saveAndExitOperation:
+		i.runSaveAndExit(op)
+	case suspendOperation:
+		i.runSuspend(op)
+	default:
+		i.setOperationStatus(op, OperationFailed, fmt.Sprintf("unknown operation kind %s", op.Kind))
+	}
+}
+
+// resumeOperations runs the unfinished operations that haven't been worked on
+// recently.
+func (i *Internal) resumeOperations() error {
+	rows, err := i.db.Query(claimStaleOperationsSQL, time.Now().Add(-operationStaleAfter))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ops := []*Operation{}
+	for rows.Next() {
+		op := &Operation{}
+		if err = rows.Scan(&op.ID, &op.ExternalID, &op.Kind, &op.Status, &op.Message, &op.CreatedAt, &op.UpdatedAt); err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		log.Infof("resuming %s operation %s for %s at %s", op.Kind, op.ID, op.ExternalID, op.Status)
+		go i.runOperation(op)
+	}
+
+	return nil
+}
+
+// ResumeOperations fires up a goroutine that periodically resumes the
+// operations that were abandoned, usually because the app-exposer instance
+// running them was restarted.
+func (i *Internal) ResumeOperations() {
+	go func() {
+		ticker := time.NewTicker(operationHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			if err := i.resumeOperations(); err != nil {
+				log.Error(errors.Wrap(err, "error resuming operations"))
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// VICESaveAndExit handles requests to save the output files in iRODS and then
+// exit. The exit portion will only occur if the save operation succeeds. If it
+// doesn't, the operation is marked as failed and the analysis keeps running. The operation runs in the
+// background, so a 202 is returned with the operation, which can be checked
+// with VICEGetOperation. A 404 is returned if the analysis isn't running, and a
+// 409 is returned if it's already being saved and shut down or suspended.
+func (i *Internal) VICESaveAndExit(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	_, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Get(id, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		http.Error(writer, fmt.Sprintf("analysis %s is not running", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	op, err := i.createOperation(id, saveAndExitOperation)
+	if err == errOperationRunning {
+		http.Error(writer, fmt.Sprintf("analysis %s is already being saved and shut down or suspended", id), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(op)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go i.runSaveAndExit(op)
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Header().Add("Location", fmt.Sprintf("/vice/%s/operations/%s", id, op.ID))
+	writer.WriteHeader(http.StatusAccepted)
+	writer.Write(buf)
+}
+
+// VICEGetOperation returns an operation on an analysis.
+func (i *Internal) VICEGetOperation(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+
+	op, err := i.getOperation(vars["id"], vars["op"])
+	if err == sql.ErrNoRows {
+		http.Error(writer, fmt.Sprintf("operation %s not found for %s", vars["op"], vars["id"]), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(op)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(buf)
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestExitSummary(t *testing.T) {
+	result := &ExitResult{
+		Removed: []ExitedObject{{Kind: "Deployment", Name: "a"}, {Kind: "Service", Name: "vice-a", Cascaded: true}},
+	}
+	if msg := exitSummary(result); msg != "removed 2 objects" {
+		t.Errorf("unexpected summary %q", msg)
+	}
+
+	result.Failed = []ExitedObject{{Kind: "ConfigMap", Name: "excludes-file-a", Error: "forbidden"}}
+	msg := exitSummary(result)
+	if !strings.Contains(msg, "failed to remove 1") || !strings.Contains(msg, "ConfigMap excludes-file-a (forbidden)") {
+		t.Errorf("unexpected summary %q", msg)
+	}
+}
+
+// testSaveAndExit returns an Internal with a running analysis called a and the
+// fakes it uses.
+func testSaveAndExit(t *testing.T) (*Internal, *fakeDB, *recordingPublisher, *fakeTransferService) {
+	labels := map[string]string{"external-id": "a"}
+	db, sqldb := newFakeDB(t)
+	publisher := &recordingPublisher{}
+	transfers := &fakeTransferService{}
+
+	i := &Internal{
+		Init: Init{
+			ViceNamespace:        "vice-apps",
+			TransferPollInterval: time.Millisecond,
+		},
+		db: sqldb,
+		clientset: fake.NewSimpleClientset(
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps", Labels: labels}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "vice-a", Namespace: "vice-apps", Labels: labels}},
+		),
+		statusPublisher: publisher,
+		transferClient:  transfers.client(),
+	}
+
+	return i, db, publisher, transfers
+}
+
+// operationStatuses returns the statuses the operations were moved to.
+func operationStatuses(db *fakeDB) []string {
+	statuses := []string{}
+	for _, args := range db.called("SET status = $2") {
+		statuses = append(statuses, args[1].(string))
+	}
+	return statuses
+}
+
+func TestRunSaveAndExit(t *testing.T) {
+	i, db, publisher, transfers := testSaveAndExit(t)
+	transfers.set("POST /upload", `{"uuid": "u", "status": "requested"}`)
+	transfers.set("GET /upload/u", `{"uuid": "u", "status": "completed"}`)
+
+	i.runSaveAndExit(&Operation{ID: "op", ExternalID: "a", Kind: saveAndExitOperation, Status: OperationPending})
+
+	expected := []string{OperationUploading, OperationExiting, OperationCompleted}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+	if fails := publisher.sent("failed"); len(fails) != 0 {
+		t.Errorf("failures were published: %v", fails)
+	}
+	if _, err := i.clientset.AppsV1().Deployments("vice-apps").Get("a", metav1.GetOptions{}); err == nil {
+		t.Error("the analysis is still running")
+	}
+}
+
+func TestRunSaveAndExitUploadFailed(t *testing.T) {
+	i, db, publisher, transfers := testSaveAndExit(t)
+	transfers.set("POST /upload", `{"uuid": "u", "status": "requested"}`)
+	transfers.set("GET /upload/u", `{"uuid": "u", "status": "failed"}`)
+
+	i.runSaveAndExit(&Operation{ID: "op", ExternalID: "a", Kind: saveAndExitOperation, Status: OperationPending})
+
+	expected := []string{OperationUploading, OperationFailed}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+
+	// A failed analysis would be removed by the orphan collector along with
+	// the outputs that couldn't be saved.
+	if fails := publisher.sent("failed"); len(fails) != 0 {
+		t.Errorf("the analysis was marked as failed: %v", fails)
+	}
+	if running := publisher.sent("running"); len(running) == 0 {
+		t.Error("the failed upload wasn't reported")
+	}
+	if _, err := i.clientset.AppsV1().Deployments("vice-apps").Get("a", metav1.GetOptions{}); err != nil {
+		t.Error("the analysis was shut down after its outputs couldn't be saved")
+	}
+}
+
+func TestRunSaveAndExitExitFailed(t *testing.T) {
+	i, db, publisher, _ := testSaveAndExit(t)
+	i.clientset.(*fake.Clientset).PrependReactor("delete", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+
+	// The upload already finished before the operation was resumed.
+	i.runSaveAndExit(&Operation{ID: "op", ExternalID: "a", Kind: saveAndExitOperation, Status: OperationExiting})
+
+	expected := []string{OperationExiting, OperationFailed}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+	if fails := publisher.sent("failed"); len(fails) != 1 {
+		t.Errorf("unexpected failures published: %v", fails)
+	}
+}
+
+func TestResumeOperations(t *testing.T) {
+	i, db, publisher, transfers := testSaveAndExit(t)
+	now := time.Now()
+	db.on("status NOT IN", []string{"id", "external_id", "kind", "status", "message", "created_at", "updated_at"},
+		[]driver.Value{"op", "a", saveAndExitOperation, OperationUploading, "", now, now},
+	)
+	transfers.set("GET /upload", `{"transfers": [{"uuid": "old", "status": "completed"}, {"uuid": "u", "status": "uploading"}]}`)
+	transfers.set("GET /upload/u", `{"uuid": "u", "status": "completed"}`)
+
+	if err := i.resumeOperations(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation is resumed in the background.
+	expected := []string{OperationExiting, OperationCompleted}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(operationStatuses(db), expected) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+
+	if transfers.received("POST /upload") {
+		t.Error("a new upload was started instead of waiting for the running one")
+	}
+	if fails := publisher.sent("failed"); len(fails) != 0 {
+		t.Errorf("failures were published: %v", fails)
+	}
+}
+
+func TestVICESaveAndExitHandler(t *testing.T) {
+	i, _, _, _ := testSaveAndExit(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/vice/{id}/save-and-exit", i.VICESaveAndExit).Methods("POST")
+
+	saveAndExit := func(id string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/vice/"+id+"/save-and-exit", nil))
+		return rec.Code
+	}
+
+	if code := saveAndExit("missing"); code != http.StatusNotFound {
+		t.Errorf("an analysis that isn't running got a %d", code)
+	}
+
+	// The insert doesn't return anything when there's already an operation
+	// running for the analysis.
+	if code := saveAndExit("a"); code != http.StatusConflict {
+		t.Errorf("an analysis that's already being saved got a %d", code)
+	}
+}
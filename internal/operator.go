@@ -0,0 +1,698 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	viceAnalysisGroup    = "vice.cyverse.org"
+	viceAnalysisVersion  = "v1alpha1"
+	viceAnalysisKind     = "VICEAnalysis"
+	viceAnalysisPlural   = "viceanalyses"
+	viceAnalysisSingular = "viceanalysis"
+)
+
+// Only one app-exposer instance runs the VICEAnalysis controller at a time. The
+// instances elect a leader through a Lease in the VICE namespace.
+const (
+	operatorLeaseName     = "app-exposer-operator"
+	operatorLeaseDuration = 15 * time.Second
+	operatorRenewDeadline = 10 * time.Second
+	operatorRetryPeriod   = 2 * time.Second
+)
+
+// The phases a VICEAnalysis goes through.
+const (
+	viceAnalysisLaunching = "Launching"
+	viceAnalysisRunning   = "Running"
+	viceAnalysisFailed    = "Failed"
+)
+
+// The conditions reported in the status of a VICEAnalysis.
+const (
+	conditionResourcesCreated = "ResourcesCreated"
+	conditionReady            = "Ready"
+)
+
+var viceAnalysisResource = schema.GroupVersionResource{
+	Group:    viceAnalysisGroup,
+	Version:  viceAnalysisVersion,
+	Resource: viceAnalysisPlural,
+}
+
+var crdResource = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1",
+	Resource: "customresourcedefinitions",
+}
+
+// VICEAnalysisSpec is the desired state of a VICEAnalysis, which is the job the
+// analysis was launched from.
+type VICEAnalysisSpec struct {
+	Job VICEJob `json:"job"`
+}
+
+// VICEAnalysisCondition is a condition reported in the status of a
+// VICEAnalysis.
+type VICEAnalysisCondition struct {
+	Type               string                `json:"type"`
+	Status             apiv1.ConditionStatus `json:"status"`
+	Reason             string                `json:"reason,omitempty"`
+	Message            string                `json:"message,omitempty"`
+	LastTransitionTime metav1.Time           `json:"lastTransitionTime,omitempty"`
+}
+
+// VICEAnalysisStatus is the observed state of a VICEAnalysis.
+type VICEAnalysisStatus struct {
+	Phase              string                  `json:"phase,omitempty"`
+	ObservedGeneration int64                   `json:"observedGeneration,omitempty"`
+	Conditions         []VICEAnalysisCondition `json:"conditions,omitempty"`
+}
+
+// VICEAnalysisCR is the VICEAnalysis custom resource created for each analysis
+// in operator mode. It owns the k8s resources created for the analysis.
+type VICEAnalysisCR struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VICEAnalysisSpec   `json:"spec"`
+	Status VICEAnalysisStatus `json:"status,omitempty"`
+}
+
+// setCondition adds or updates the condition in the status. The transition
+// time is only changed if the status of the condition changes.
+func (s *VICEAnalysisStatus) setCondition(condType string, status apiv1.ConditionStatus, reason, message string) {
+	for idx := range s.Conditions {
+		c := &s.Conditions[idx]
+		if c.Type != condType {
+			continue
+		}
+		if c.Status != status {
+			c.LastTransitionTime = metav1.NewTime(time.Now())
+		}
+		c.Status = status
+		c.Reason = reason
+		c.Message = message
+		return
+	}
+
+	s.Conditions = append(s.Conditions, VICEAnalysisCondition{
+		Type:               condType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+	})
+}
+
+// viceAnalysisFromUnstructured converts an object returned by the dynamic
+// client into a VICEAnalysis.
+func viceAnalysisFromUnstructured(u *unstructured.Unstructured) (*VICEAnalysisCR, error) {
+	buf, err := u.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := &VICEAnalysisCR{}
+	if err = json.Unmarshal(buf, analysis); err != nil {
+		return nil, errors.Wrapf(err, "error parsing VICEAnalysis %s", u.GetName())
+	}
+	return analysis, nil
+}
+
+// toUnstructured converts a VICEAnalysis into an object that can be passed to
+// the dynamic client.
+func (a *VICEAnalysisCR) toUnstructured() (*unstructured.Unstructured, error) {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &unstructured.Unstructured{}
+	if err = json.Unmarshal(buf, &u.Object); err != nil {
+		return nil, err
+	}
+	u.SetAPIVersion(fmt.Sprintf("%s/%s", viceAnalysisGroup, viceAnalysisVersion))
+	u.SetKind(viceAnalysisKind)
+	return u, nil
+}
+
+// ownerReference returns the owner reference that's added to the resources
+// created for the analysis.
+func (a *VICEAnalysisCR) ownerReference() metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion:         fmt.Sprintf("%s/%s", viceAnalysisGroup, viceAnalysisVersion),
+		Kind:               viceAnalysisKind,
+		Name:               a.Name,
+		UID:                a.UID,
+		Controller:         &controller,
+		BlockOwnerDeletion: &controller,
+	}
+}
+
+// viceAnalysisCRD returns the CustomResourceDefinition for VICEAnalysis. The
+// spec and status aren't validated beyond being objects, since the spec is a
+// job that's validated when it's submitted.
+func viceAnalysisCRD() *unstructured.Unstructured {
+	preserved := map[string]interface{}{
+		"type":                                 "object",
+		"x-kubernetes-preserve-unknown-fields": true,
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "apiextensions.k8s.io/v1",
+			"kind":       "CustomResourceDefinition",
+			"metadata": map[string]interface{}{
+				"name": fmt.Sprintf("%s.%s", viceAnalysisPlural, viceAnalysisGroup),
+			},
+			"spec": map[string]interface{}{
+				"group": viceAnalysisGroup,
+				"scope": "Namespaced",
+				"names": map[string]interface{}{
+					"plural":     viceAnalysisPlural,
+					"singular":   viceAnalysisSingular,
+					"kind":       viceAnalysisKind,
+					"shortNames": []interface{}{"vice"},
+				},
+				"versions": []interface{}{
+					map[string]interface{}{
+						"name":    viceAnalysisVersion,
+						"served":  true,
+						"storage": true,
+						"subresources": map[string]interface{}{
+							"status": map[string]interface{}{},
+						},
+						"additionalPrinterColumns": []interface{}{
+							map[string]interface{}{"name": "User", "type": "string", "jsonPath": ".metadata.labels.username"},
+							map[string]interface{}{"name": "App", "type": "string", "jsonPath": ".metadata.labels.app-name"},
+							map[string]interface{}{"name": "Phase", "type": "string", "jsonPath": ".status.phase"},
+							map[string]interface{}{"name": "Age", "type": "date", "jsonPath": ".metadata.creationTimestamp"},
+						},
+						"schema": map[string]interface{}{
+							"openAPIV3Schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"spec":   preserved,
+									"status": preserved,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// registerVICEAnalysisD creates the CustomResourceDefinition for
+// VICEAnalysis if it doesn't already exist.
+func (i *Internal) registerVICEAnalysisCRD() error {
+	_, err := i.dynamicClient.Resource(crdResource).Create(viceAnalysisCRD(), metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "error registering the VICEAnalysis custom resource definition")
+	}
+	return nil
+}
+
+// createVICEAnalysis creates the VICEAnalysis for the job. The controller
+// creates the rest of the resources for the analysis.
+func (i *Internal) createVICEAnalysis(job *VICEJob) error {
+	labels, err := i.labelsFromJob(&job.Job)
+	if err != nil {
+		return err
+	}
+
+	analysis := &VICEAnalysisCR{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.InvocationID,
+			Namespace: i.ViceNamespace,
+			Labels:    labels,
+		},
+		Spec: VICEAnalysisSpec{Job: *job},
+	}
+
+	u, err := analysis.toUnstructured()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.dynamicClient.Resource(viceAnalysisResource).Namespace(i.ViceNamespace).Create(u, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteVICEAnalyses deletes the VICEAnalysis objects matching the list
+// options, recording the outcome in the result. The UIDs of the deleted
+// objects are added to owners.
+func (i *Internal) deleteVICEAnalyses(listoptions metav1.ListOptions, deleteoptions *metav1.DeleteOptions, result *ExitResult, owners map[types.UID]bool) error {
+	client := i.dynamicClient.Resource(viceAnalysisResource).Namespace(i.ViceNamespace)
+
+	list, err := client.List(listoptions)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range list.Items {
+		err = client.Delete(item.GetName(), deleteoptions)
+		if err == nil {
+			owners[item.GetUID()] = true
+		}
+		result.record(viceAnalysisKind, item.GetName(), false, err)
+	}
+
+	return nil
+}
+
+// addOwnerReference adds the owner reference to the object if it isn't
+// already there. It returns true if the object was changed.
+func addOwnerReference(obj metav1.Object, owner metav1.OwnerReference) bool {
+	if obj.GetUID() == owner.UID || hasOwnerReference(obj, owner) {
+		return false
+	}
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), owner))
+	return true
+}
+
+// hasOwnerReference returns true if the object already has the owner
+// reference.
+func hasOwnerReference(obj metav1.Object, owner metav1.OwnerReference) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == owner.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptResources adds the owner reference to the resources created for the
+// analysis so that they're deleted along with their owner. The Deployment is
+// adopted last, so an owner reference on the Deployment means that the rest of
+// the resources have been adopted too.
+func (i *Internal) adoptResources(externalID string, owner metav1.OwnerReference) error {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+
+	listoptions := metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	}
+
+	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+	svclist, err := svcclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range svclist.Items {
+		if addOwnerReference(&svclist.Items[idx], owner) {
+			if _, err = svcclient.Update(&svclist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+	ingresslist, err := ingressclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range ingresslist.Items {
+		if addOwnerReference(&ingresslist.Items[idx], owner) {
+			if _, err = ingressclient.Update(&ingresslist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+	nplist, err := npclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range nplist.Items {
+		if addOwnerReference(&nplist.Items[idx], owner) {
+			if _, err = npclient.Update(&nplist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	secretlist, err := secretclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range secretlist.Items {
+		if addOwnerReference(&secretlist.Items[idx], owner) {
+			if _, err = secretclient.Update(&secretlist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	cmlist, err := cmclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range cmlist.Items {
+		if addOwnerReference(&cmlist.Items[idx], owner) {
+			if _, err = cmclient.Update(&cmlist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	deplist, err := depclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for idx := range deplist.Items {
+		if addOwnerReference(&deplist.Items[idx], owner) {
+			if _, err = depclient.Update(&deplist.Items[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deploymentOwnerReference returns the owner reference that's added to the
+// rest of the objects for the analysis. It's not a controller reference, since
+// the VICEAnalysis controls them in operator mode.
+func deploymentOwnerReference(deployment *appsv1.Deployment) metav1.OwnerReference {
+	block := true
+	return metav1.OwnerReference{
+		APIVersion:         "apps/v1",
+		Kind:               "Deployment",
+		Name:               deployment.Name,
+		UID:                deployment.UID,
+		BlockOwnerDeletion: &block,
+	}
+}
+
+// adoptByDeployment makes the Deployment for the analysis the owner of the
+// rest of its objects.
+func (i *Internal) adoptByDeployment(externalID string) error {
+	deployment, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Get(externalID, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if err = i.adoptResources(externalID, deploymentOwnerReference(deployment)); err != nil {
+		return errors.Wrapf(err, "error adding owner references to the resources for %s", externalID)
+	}
+	return nil
+}
+
+// updateVICEAnalysisStatus writes the status of the analysis back to k8s if it
+// has changed.
+func (i *Internal) updateVICEAnalysisStatus(analysis *VICEAnalysisCR, original VICEAnalysisStatus) error {
+	if apiequality.Semantic.DeepEqual(analysis.Status, original) {
+		return nil
+	}
+
+	u, err := analysis.toUnstructured()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.dynamicClient.Resource(viceAnalysisResource).Namespace(i.ViceNamespace).UpdateStatus(u, metav1.UpdateOptions{})
+	return err
+}
+
+// syncVICEAnalysis makes the resources for the analysis match its VICEAnalysis.
+// The resources are created if the Deployment doesn't exist yet and are
+// repaired if it does. The status of the VICEAnalysis is updated to match.
+//
+// If the resources can't be created because of a transient error, the error
+// is returned so the analysis is synced again later. Any other error fails the
+// analysis, which is reported to the job status listener and isn't retried.
+func (i *Internal) syncVICEAnalysis(analysis *VICEAnalysisCR) error {
+	if analysis.DeletionTimestamp != nil || analysis.Status.Phase == viceAnalysisFailed {
+		return nil
+	}
+
+	job := &analysis.Spec.Job
+	original := analysis.Status
+	original.Conditions = append([]VICEAnalysisCondition{}, analysis.Status.Conditions...)
+	analysis.Status.ObservedGeneration = analysis.Generation
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+	deployment, err := depclient.Get(job.InvocationID, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	if k8serrors.IsNotFound(err) {
+		// Resources that already exist were created by an earlier sync that
+		// went away part of the way through, so the analysis is treated as
+		// launched and anything that's missing is repaired on the next sync.
+		if err = i.launchResources(job); k8serrors.IsAlreadyExists(err) {
+			log.Infof("resources for VICEAnalysis %s already exist: %s", analysis.Name, err)
+			err = nil
+		}
+		if err != nil {
+			transient := isTransientError(err)
+			if !transient {
+				analysis.Status.Phase = viceAnalysisFailed
+			}
+			analysis.Status.setCondition(conditionResourcesCreated, apiv1.ConditionFalse, "LaunchFailed", err.Error())
+			if transient {
+				if serr := i.updateVICEAnalysisStatus(analysis, original); serr != nil {
+					log.Error(serr)
+				}
+				return err
+			}
+
+			// The failure is only reported once the Failed phase is stored,
+			// since the phase is what keeps it from being reported again.
+			if serr := i.updateVICEAnalysisStatus(analysis, original); serr != nil {
+				return errors.Wrapf(serr, "error storing the failure of VICEAnalysis %s", analysis.Name)
+			}
+			log.Error(errors.Wrapf(err, "error launching VICEAnalysis %s", analysis.Name))
+			if ferr := i.statusPublisher.Fail(job.InvocationID, fmt.Sprintf("analysis could not be launched: %s", err.Error())); ferr != nil {
+				log.Error(ferr)
+			}
+			return nil
+		}
+
+		if deployment, err = depclient.Get(job.InvocationID, metav1.GetOptions{}); err != nil {
+			return err
+		}
+	} else {
+		i.repairVICEAnalysis(job, deployment)
+	}
+
+	analysis.Status.setCondition(conditionResourcesCreated, apiv1.ConditionTrue, "ResourcesCreated", "")
+
+	if owner := analysis.ownerReference(); !hasOwnerReference(deployment, owner) {
+		if err = i.adoptResources(job.InvocationID, owner); err != nil {
+			return errors.Wrapf(err, "error adding owner references to the resources for %s", job.InvocationID)
+		}
+	}
+
+	if deploymentReady(deployment) {
+		analysis.Status.Phase = viceAnalysisRunning
+		analysis.Status.setCondition(conditionReady, apiv1.ConditionTrue, "DeploymentReady", "")
+	} else {
+		analysis.Status.Phase = viceAnalysisLaunching
+		analysis.Status.setCondition(conditionReady, apiv1.ConditionFalse, "DeploymentNotReady", "the analysis isn't ready yet")
+	}
+
+	return i.updateVICEAnalysisStatus(analysis, original)
+}
+
+// repairVICEAnalysis repairs the resources for an analysis that has already
+// been launched, recording the repairs as Events on the Deployment.
+func (i *Internal) repairVICEAnalysis(job *VICEJob, deployment *appsv1.Deployment) {
+	repairs, err := i.reconcileAnalysis(job, deployment)
+	for _, repair := range repairs {
+		log.Infof("repaired drift for analysis %s: %s %s was %s", job.InvocationID, repair.Kind, repair.Name, repair.Action)
+		if rerr := i.recordDrift(deployment, repair); rerr != nil {
+			log.Error(rerr)
+		}
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error reconciling analysis %s", job.InvocationID))
+	}
+}
+
+// deploymentReady returns true if at least one of the Deployment's pods is
+// ready.
+func deploymentReady(deployment *appsv1.Deployment) bool {
+	return deployment.Status.ReadyReplicas > 0
+}
+
+// processNextVICEAnalysis syncs the next VICEAnalysis in the queue. It returns
+// false when the queue has been shut down.
+func (i *Internal) processNextVICEAnalysis(queue workqueue.RateLimitingInterface, indexer cache.Indexer) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	obj, exists, err := indexer.GetByKey(key.(string))
+	if err != nil {
+		log.Error(err)
+		queue.AddRateLimited(key)
+		return true
+	}
+	if !exists {
+		queue.Forget(key)
+		return true
+	}
+
+	analysis, err := viceAnalysisFromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		log.Error(err)
+		queue.Forget(key)
+		return true
+	}
+
+	if err = i.syncVICEAnalysis(analysis); err != nil {
+		log.Error(errors.Wrapf(err, "error syncing VICEAnalysis %s", key))
+		if isTransientError(err) {
+			queue.AddRateLimited(key)
+		} else {
+			queue.Forget(key)
+		}
+		return true
+	}
+
+	queue.Forget(key)
+	return true
+}
+
+// runVICEAnalysisController syncs each VICEAnalysis with its resources until
+// the context is done.
+func (i *Internal) runVICEAnalysisController(ctx context.Context) error {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(i.dynamicClient, i.OperatorResyncInterval, i.ViceNamespace, nil)
+	informer := factory.ForResource(viceAnalysisResource).Informer()
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), viceAnalysisPlural)
+	defer queue.ShutDown()
+
+	enqueue := func(obj interface{}) {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		queue.Add(key)
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(_, obj interface{}) {
+			enqueue(obj)
+		},
+	})
+
+	go informer.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return errors.New("timed out waiting for the VICEAnalysis cache to sync")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i.processNextVICEAnalysis(queue, informer.GetIndexer()) {
+		}
+	}()
+
+	// Wait for the worker to finish the VICEAnalysis it's syncing, if any.
+	<-ctx.Done()
+	queue.ShutDown()
+	<-done
+
+	return nil
+}
+
+// RunOperator registers the VICEAnalysis custom resource definition and fires
+// up the controller that creates the resources for each VICEAnalysis and
+// keeps its status up to date. The controller only runs in the app-exposer
+// instance that holds the operator Lease, so that the instances don't race
+// each other to launch the same analysis. The other instances wait to take
+// over if the leader goes away.
+func (i *Internal) RunOperator() error {
+	if err := i.registerVICEAnalysisCRD(); err != nil {
+		return err
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "unable to get the hostname for the operator lease")
+	}
+
+	config := leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      operatorLeaseName,
+				Namespace: i.ViceNamespace,
+			},
+			Client:     i.clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   operatorLeaseDuration,
+		RenewDeadline:   operatorRenewDeadline,
+		RetryPeriod:     operatorRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            operatorLeaseName,
+	}
+
+	// The controller from a lost term has to stop before the one for the next
+	// term starts, so it never runs twice in the same instance.
+	var running sync.Mutex
+
+	config.Callbacks = leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			running.Lock()
+			defer running.Unlock()
+
+			log.Infof("%s is running the VICEAnalysis controller", identity)
+			if err := i.runVICEAnalysisController(ctx); err != nil {
+				log.Error(err)
+			}
+		},
+		OnStoppedLeading: func() {
+			log.Infof("%s is no longer running the VICEAnalysis controller", identity)
+		},
+	}
+
+	go func() {
+		for {
+			leaderelection.RunOrDie(context.Background(), config)
+		}
+	}()
+
+	return nil
+}
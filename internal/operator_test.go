@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSetCondition(t *testing.T) {
+	status := &VICEAnalysisStatus{}
+	status.setCondition(conditionReady, corev1.ConditionFalse, "DeploymentNotReady", "")
+	if len(status.Conditions) != 1 {
+		t.Fatalf("unexpected conditions %+v", status.Conditions)
+	}
+	transition := status.Conditions[0].LastTransitionTime
+
+	status.setCondition(conditionReady, corev1.ConditionFalse, "DeploymentNotReady", "still waiting")
+	if len(status.Conditions) != 1 || !status.Conditions[0].LastTransitionTime.Equal(&transition) {
+		t.Errorf("the transition time changed without a change in status: %+v", status.Conditions)
+	}
+
+	status.setCondition(conditionResourcesCreated, corev1.ConditionTrue, "ResourcesCreated", "")
+	if len(status.Conditions) != 2 {
+		t.Errorf("a new condition wasn't added: %+v", status.Conditions)
+	}
+}
+
+func TestVICEAnalysisUnstructured(t *testing.T) {
+	analysis := &VICEAnalysisCR{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps"},
+		Spec: VICEAnalysisSpec{
+			Job: VICEJob{Job: model.Job{InvocationID: "a"}, GPUCount: 1},
+		},
+	}
+	analysis.Status.Phase = viceAnalysisRunning
+
+	u, err := analysis.toUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.GetName() != "a" {
+		t.Errorf("unexpected name %s", u.GetName())
+	}
+
+	parsed, err := viceAnalysisFromUnstructured(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Spec.Job.InvocationID != "a" || parsed.Spec.Job.GPUCount != 1 || parsed.Status.Phase != viceAnalysisRunning {
+		t.Errorf("unexpected VICEAnalysis %+v", parsed)
+	}
+}
+
+func TestAdoptResources(t *testing.T) {
+	labels := map[string]string{"external-id": "a"}
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps", Labels: labels}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-a", Namespace: "vice-apps", Labels: labels}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-b", Namespace: "vice-apps"}},
+		),
+	}
+
+	analysis := &VICEAnalysisCR{ObjectMeta: metav1.ObjectMeta{Name: "a", UID: types.UID("uid-a")}}
+	owner := analysis.ownerReference()
+
+	// Adopting twice shouldn't add a second reference.
+	for n := 0; n < 2; n++ {
+		if err := i.adoptResources("a", owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deployment, err := i.clientset.AppsV1().Deployments("vice-apps").Get("a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := deployment.OwnerReferences; len(refs) != 1 || refs[0].UID != owner.UID || refs[0].Kind != viceAnalysisKind {
+		t.Errorf("unexpected owner references on the deployment: %+v", refs)
+	}
+
+	cm, err := i.clientset.CoreV1().ConfigMaps("vice-apps").Get("excludes-file-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.OwnerReferences) != 1 {
+		t.Errorf("unexpected owner references on the config map: %+v", cm.OwnerReferences)
+	}
+
+	other, err := i.clientset.CoreV1().ConfigMaps("vice-apps").Get("excludes-file-b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other.OwnerReferences) != 0 {
+		t.Error("a config map for another analysis was adopted")
+	}
+}
+
+func TestSyncFailedVICEAnalysis(t *testing.T) {
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(),
+	}
+
+	analysis := &VICEAnalysisCR{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps"},
+		Spec:       VICEAnalysisSpec{Job: VICEJob{Job: model.Job{InvocationID: "a"}}},
+		Status:     VICEAnalysisStatus{Phase: viceAnalysisFailed},
+	}
+
+	// A failed analysis isn't launched again when it's resynced.
+	if err := i.syncVICEAnalysis(analysis); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments, err := i.clientset.AppsV1().Deployments("vice-apps").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 0 {
+		t.Errorf("a failed analysis was launched again: %+v", deployments.Items)
+	}
+}
+
+func TestSyncVICEAnalysisAlreadyExists(t *testing.T) {
+	analysis := &VICEAnalysisCR{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "vice-apps", UID: "uid-a"},
+		Spec:       VICEAnalysisSpec{Job: VICEJob{Job: model.Job{InvocationID: "a", Name: "analysis"}}},
+	}
+	u, err := analysis.toUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, sqldb := newFakeDB(t)
+	db.on("FROM logins", []string{"ip_address"}, []driver.Value{"127.0.0.1"})
+
+	publisher := &recordingPublisher{}
+	clientset := fake.NewSimpleClientset()
+	i := &Internal{
+		Init:            Init{ViceNamespace: "vice-apps"},
+		db:              sqldb,
+		clientset:       clientset,
+		dynamicClient:   dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		statusPublisher: publisher,
+	}
+	if _, err = i.dynamicClient.Resource(viceAnalysisResource).Namespace("vice-apps").Create(u, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another sync of the analysis created the resources after this one saw
+	// that the Deployment didn't exist.
+	deploymentGets := 0
+	clientset.PrependReactor("get", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		deploymentGets++
+		if deploymentGets == 1 {
+			return true, nil, k8serrors.NewNotFound(appsv1.Resource("deployments"), "a")
+		}
+		return true, &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "a",
+				Namespace:       "vice-apps",
+				OwnerReferences: []metav1.OwnerReference{analysis.ownerReference()},
+			},
+		}, nil
+	})
+	clientset.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8serrors.NewAlreadyExists(corev1.Resource(action.GetResource().Resource), "a")
+	})
+
+	if err = i.syncVICEAnalysis(analysis); err != nil {
+		t.Fatal(err)
+	}
+	if analysis.Status.Phase != viceAnalysisLaunching {
+		t.Errorf("the analysis is %s, not %s", analysis.Status.Phase, viceAnalysisLaunching)
+	}
+	if fails := publisher.sent("failed"); len(fails) != 0 {
+		t.Errorf("failures were published: %v", fails)
+	}
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/pkg/errors"
+)
+
+// The reasons the resources for an analysis are considered orphaned.
+const (
+	orphanFinished     = "finished"
+	orphanUnknown      = "unknown"
+	orphanNoDeployment = "no-deployment"
+)
+
+// OrphanedResource is a k8s resource belonging to an orphaned analysis.
+type OrphanedResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Orphan describes the resources left in the cluster for an analysis that
+// shouldn't have any. The analysis is either finished according to the
+// database, isn't in the database at all, or has lost its Deployment.
+type Orphan struct {
+	ExternalID   string             `json:"external_id"`
+	AnalysisID   string             `json:"analysis_id,omitempty"`
+	Status       string             `json:"status,omitempty"`
+	Reason       string             `json:"reason"`
+	Resources    []OrphanedResource `json:"resources"`
+	FirstSeen    time.Time          `json:"first_seen"`
+	CollectAfter *time.Time         `json:"collect_after,omitempty"`
+}
+
+// MissingDeployment describes an analysis that the database says is running
+// but that doesn't have a Deployment in the cluster.
+type MissingDeployment struct {
+	ExternalID string `json:"external_id"`
+	AnalysisID string `json:"analysis_id"`
+	Username   string `json:"username"`
+	Status     string `json:"status"`
+}
+
+// ReconciliationReport lists the differences between the analyses in the
+// database and the resources in the cluster.
+type ReconciliationReport struct {
+	GeneratedAt        time.Time           `json:"generated_at"`
+	Orphans            []Orphan            `json:"orphans"`
+	MissingDeployments []MissingDeployment `json:"missing_deployments"`
+}
+
+// orphanedResources lists the resources in the summary.
+func orphanedResources(s *AnalysisSummary) []OrphanedResource {
+	resources := []OrphanedResource{}
+	for _, d := range s.Deployments {
+		resources = append(resources, OrphanedResource{Kind: "Deployment", Name: d.Name})
+	}
+	for _, p := range s.Pods {
+		resources = append(resources, OrphanedResource{Kind: "Pod", Name: p.Name})
+	}
+	for _, c := range s.ConfigMaps {
+		resources = append(resources, OrphanedResource{Kind: "ConfigMap", Name: c.Name})
+	}
+	for _, svc := range s.Services {
+		resources = append(resources, OrphanedResource{Kind: "Service", Name: svc.Name})
+	}
+	for _, ing := range s.Ingresses {
+		resources = append(resources, OrphanedResource{Kind: "Ingress", Name: ing.Name})
+	}
+	return resources
+}
+
+// classifyOrphan returns the Orphan for the analysis if its resources are
+// orphaned, or nil if they aren't.
+func classifyOrphan(a *apps.Apps, s *AnalysisSummary) (*Orphan, error) {
+	orphan := &Orphan{
+		ExternalID: s.ExternalID,
+		Resources:  orphanedResources(s),
+	}
+
+	analysisID, err := a.GetAnalysisIDByExternalID(s.ExternalID)
+	if err == sql.ErrNoRows {
+		orphan.Reason = orphanUnknown
+		return orphan, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the analysis ID for %s", s.ExternalID)
+	}
+	orphan.AnalysisID = analysisID
+
+	status, err := a.GetAnalysisStatus(analysisID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the status of analysis %s", analysisID)
+	}
+	orphan.Status = status
+
+	if containsString(terminalStatuses, status) {
+		orphan.Reason = orphanFinished
+		return orphan, nil
+	}
+
+	if len(s.Deployments) == 0 {
+		orphan.Reason = orphanNoDeployment
+		return orphan, nil
+	}
+
+	return nil, nil
+}
+
+// trackOrphans records when each of the orphans was first seen and forgets
+// the ones that aren't orphaned anymore. The first seen times are only kept
+// in memory, so the grace period starts over when app-exposer restarts.
+func (i *Internal) trackOrphans(orphans []Orphan, now time.Time) {
+	i.orphansLock.Lock()
+	defer i.orphansLock.Unlock()
+
+	if i.orphans == nil {
+		i.orphans = map[string]time.Time{}
+	}
+
+	current := map[string]time.Time{}
+	for idx := range orphans {
+		firstSeen, ok := i.orphans[orphans[idx].ExternalID]
+		if !ok {
+			firstSeen = now
+		}
+		current[orphans[idx].ExternalID] = firstSeen
+		orphans[idx].FirstSeen = firstSeen
+
+		if i.OrphanGCEnabled {
+			collectAfter := firstSeen.Add(i.OrphanGracePeriod)
+			orphans[idx].CollectAfter = &collectAfter
+		}
+	}
+
+	i.orphans = current
+}
+
+// reconciliationReport compares the VICE resources in the cluster with the
+// analyses in the database.
+func (i *Internal) reconciliationReport() (*ReconciliationReport, error) {
+	now := time.Now().UTC()
+	a := apps.NewApps(i.db)
+
+	summaries, err := i.groupAnalyses(map[string]string{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconciliationReport{
+		GeneratedAt:        now,
+		Orphans:            []Orphan{},
+		MissingDeployments: []MissingDeployment{},
+	}
+
+	for _, s := range summaries {
+		orphan, err := classifyOrphan(a, s)
+		if err != nil {
+			return nil, err
+		}
+		if orphan != nil {
+			report.Orphans = append(report.Orphans, *orphan)
+		}
+	}
+
+	sort.Slice(report.Orphans, func(x, y int) bool {
+		return report.Orphans[x].ExternalID < report.Orphans[y].ExternalID
+	})
+
+	i.trackOrphans(report.Orphans, now)
+
+	running, err := a.ListRunningInteractiveAnalyses()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing the running interactive analyses")
+	}
+
+	for _, analysis := range running {
+		if s, ok := summaries[analysis.ExternalID]; ok && len(s.Deployments) > 0 {
+			continue
+		}
+		report.MissingDeployments = append(report.MissingDeployments, MissingDeployment{
+			ExternalID: analysis.ExternalID,
+			AnalysisID: analysis.ID,
+			Username:   analysis.Username,
+			Status:     analysis.Status,
+		})
+	}
+
+	return report, nil
+}
+
+// collectOrphans deletes the resources of the analyses that have been
+// orphaned for longer than the grace period.
+func (i *Internal) collectOrphans() error {
+	report, err := i.reconciliationReport()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, orphan := range report.Orphans {
+		if orphan.CollectAfter == nil || now.Before(*orphan.CollectAfter) {
+			continue
+		}
+
+		log.Infof("deleting the resources for orphaned analysis %s (%s)", orphan.ExternalID, orphan.Reason)
+		if _, err = i.exitAnalysis(orphan.ExternalID); err != nil {
+			log.Error(errors.Wrapf(err, "error deleting the resources for orphaned analysis %s", orphan.ExternalID))
+		}
+	}
+
+	return nil
+}
+
+// CollectOrphans fires up a goroutine that periodically deletes the resources
+// of analyses that have been orphaned for longer than the grace period.
+func (i *Internal) CollectOrphans() {
+	go func() {
+		ticker := time.NewTicker(i.OrphanGCInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.collectOrphans(); err != nil {
+				log.Error(errors.Wrap(err, "error collecting orphaned VICE resources"))
+			}
+		}
+	}()
+}
+
+// AdminReconciliation is the handler for the reconciliation report. It lists
+// the resources of analyses that are finished or unknown according to the
+// database or that have lost their Deployment, along with the analyses that
+// the database says are running but that don't have a Deployment.
+//
+// Query Parameters:
+//   user - Required. The user making the request, who must be an admin.
+func (i *Internal) AdminReconciliation(writer http.ResponseWriter, request *http.Request) {
+	if !i.requireAdmin(writer, request) {
+		return
+	}
+
+	report, err := i.reconciliationReport()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(report)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
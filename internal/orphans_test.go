@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackOrphans(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			OrphanGCEnabled:   true,
+			OrphanGracePeriod: time.Hour,
+		},
+	}
+
+	start := time.Now().UTC()
+	orphans := []Orphan{{ExternalID: "a"}, {ExternalID: "b"}}
+	i.trackOrphans(orphans, start)
+
+	if !orphans[0].FirstSeen.Equal(start) || !orphans[0].CollectAfter.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected tracking for a new orphan: %+v", orphans[0])
+	}
+
+	// a is still orphaned, b was cleaned up, and c is new.
+	later := start.Add(30 * time.Minute)
+	orphans = []Orphan{{ExternalID: "a"}, {ExternalID: "c"}}
+	i.trackOrphans(orphans, later)
+
+	if !orphans[0].FirstSeen.Equal(start) {
+		t.Errorf("the first seen time of an existing orphan changed to %s", orphans[0].FirstSeen)
+	}
+	if !orphans[1].FirstSeen.Equal(later) {
+		t.Errorf("the first seen time of a new orphan is %s", orphans[1].FirstSeen)
+	}
+	if _, ok := i.orphans["b"]; ok {
+		t.Error("an analysis that isn't orphaned anymore is still tracked")
+	}
+
+	i.OrphanGCEnabled = false
+	orphans = []Orphan{{ExternalID: "a"}}
+	i.trackOrphans(orphans, later)
+	if orphans[0].CollectAfter != nil {
+		t.Error("an orphan has a collection time with the garbage collector disabled")
+	}
+}
+
+func TestOrphanedResources(t *testing.T) {
+	s := testSummary("a")
+	s.Deployments[0].Name = "a"
+	s.ConfigMaps = []ConfigMapInfo{{MetaInfo: MetaInfo{Name: "excludes-file-a"}}}
+
+	resources := orphanedResources(s)
+	if len(resources) != 4 || resources[0].Kind != "Deployment" || resources[1].Name != "excludes-file-a" {
+		t.Errorf("unexpected resources %+v", resources)
+	}
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// preemptedEventReason is the reason the scheduler puts on the events it
+	// emits for the pods it preempts.
+	preemptedEventReason = "Preempted"
+
+	// preemptedAnnotation is set on the Deployment of a preempted analysis to
+	// the UID of the event that was handled, so that each preemption is only
+	// handled once across all of the app-exposer replicas.
+	preemptedAnnotation = "vice-preempted-event"
+)
+
+// priorityClassCandidates returns the names of the priority classes that
+// apply to the job, based on the groups the user is in and the categories the
+// app is in. The names are sorted and don't repeat.
+func (i *Internal) priorityClassCandidates(job *VICEJob, categories []string) []string {
+	seen := map[string]bool{}
+	candidates := []string{}
+
+	add := func(classes map[string]string, keys []string) {
+		for _, key := range keys {
+			if class, ok := classes[strings.ToLower(key)]; ok && !seen[class] {
+				seen[class] = true
+				candidates = append(candidates, class)
+			}
+		}
+	}
+
+	add(i.PriorityClassUserTiers, job.UserGroups)
+	add(i.PriorityClassAppCategories, categories)
+
+	sort.Strings(candidates)
+
+	return candidates
+}
+
+// appCategories returns the categories that the job's app is in. The database
+// is only consulted if priority classes are configured for app categories.
+func (i *Internal) appCategories(job *VICEJob) ([]string, error) {
+	if len(i.PriorityClassAppCategories) == 0 {
+		return []string{}, nil
+	}
+	return apps.NewApps(i.db).GetAppCategories(job.AppID)
+}
+
+// priorityClassFor returns the name of the PriorityClass to use for the
+// analysis pod. If more than one class applies to the job, including the one
+// set by the scheduling policy, the one with the highest value wins. Classes
+// that don't exist in the cluster are skipped. Returns the default class if
+// none of them apply.
+func (i *Internal) priorityClassFor(job *VICEJob, policyClass string) (string, error) {
+	categories, err := i.appCategories(job)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to look up the categories for app %s", job.AppID)
+	}
+
+	candidates := i.priorityClassCandidates(job, categories)
+	if policyClass != "" {
+		candidates = append(candidates, policyClass)
+	}
+
+	var (
+		best      string
+		bestValue int32
+	)
+
+	pcclient := i.clientset.SchedulingV1().PriorityClasses()
+	for _, name := range candidates {
+		pc, err := pcclient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "skipping priority class %s for job %s", name, job.InvocationID))
+			continue
+		}
+		if best == "" || pc.Value > bestValue {
+			best = pc.Name
+			bestValue = pc.Value
+		}
+	}
+
+	if best == "" {
+		return i.PriorityClassDefault, nil
+	}
+
+	return best, nil
+}
+
+// deploymentForPod returns the Deployment for the VICE analysis that the
+// named pod belongs to. Preempted pods may already be gone, so the
+// Deployments are searched by name if the pod can't be found.
+func (i *Internal) deploymentForPod(podName string) (*appsv1.Deployment, error) {
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+	pod, err := i.clientset.CoreV1().Pods(i.ViceNamespace).Get(podName, metav1.GetOptions{})
+	if err == nil {
+		externalID, ok := pod.Labels["external-id"]
+		if !ok {
+			return nil, fmt.Errorf("pod %s is missing the external-id label", podName)
+		}
+		return depclient.Get(externalID, metav1.GetOptions{})
+	}
+
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+
+	deplist, err := depclient.List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dep := range deplist.Items {
+		if strings.HasPrefix(podName, dep.Name+"-") {
+			return &dep, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no VICE deployment found for pod %s", podName)
+}
+
+// claimPreemption marks the Deployment as having handled the preemption
+// event. Returns false if the event was already handled, possibly by another
+// replica of app-exposer.
+func (i *Internal) claimPreemption(name, eventUID string) (bool, error) {
+	claimed := false
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := depclient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if deployment.Annotations[preemptedAnnotation] == eventUID {
+			claimed = false
+			return nil
+		}
+
+		if deployment.Annotations == nil {
+			deployment.Annotations = map[string]string{}
+		}
+		deployment.Annotations[preemptedAnnotation] = eventUID
+
+		_, err = depclient.Update(deployment)
+		claimed = err == nil
+		return err
+	})
+
+	return claimed, err
+}
+
+// eventPreempted handles the events that the scheduler emits when it preempts
+// a VICE analysis pod to make room for a higher priority one. A status update
+// explaining what happened is published and the analysis is left for k8s to
+// reschedule. The outputs can't be saved at this point, since the preempted
+// pod and its working directory are already being torn down, so analyses that
+// can be preempted should have checkpoints scheduled.
+func (i *Internal) eventPreempted(event *apiv1.Event) error {
+	if event.Reason != preemptedEventReason || event.InvolvedObject.Kind != "Pod" {
+		return nil
+	}
+
+	deployment, err := i.deploymentForPod(event.InvolvedObject.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to find the analysis for preempted pod %s", event.InvolvedObject.Name)
+	}
+
+	claimed, err := i.claimPreemption(deployment.Name, string(event.UID))
+	if err != nil {
+		return errors.Wrapf(err, "unable to record the preemption of pod %s", event.InvolvedObject.Name)
+	}
+	if !claimed {
+		return nil
+	}
+
+	jobID := deployment.Labels["external-id"]
+	msg := fmt.Sprintf(
+		"analysis %s was preempted to make room for a higher priority analysis: %s",
+		deployment.Labels["analysis-name"],
+		event.Message,
+	)
+	log.Info(msg)
+
+	// The ReplicaSet creates a new pod, which waits in the scheduling queue
+	// until there's room for it.
+	return i.statusPublisher.Queued(
+		jobID,
+		fmt.Sprintf("%s. It will restart automatically once there's capacity for it. Files that weren't saved have been lost.", msg),
+	)
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+	appsv1 "k8s.io/api/apps/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPriorityClassCandidates(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			PriorityClassUserTiers: map[string]string{
+				"paid":     "vice-paid",
+				"workshop": "vice-workshop",
+			},
+			PriorityClassAppCategories: map[string]string{
+				"featured": "vice-featured",
+			},
+		},
+	}
+
+	job := &VICEJob{Job: *testJob(model.Container{})}
+	job.UserGroups = []string{"Workshop", "paid", "other"}
+
+	actual := i.priorityClassCandidates(job, []string{"Featured", "vice-paid"})
+	expected := []string{"vice-featured", "vice-paid", "vice-workshop"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("priorityClassCandidates returned %v, not %v", actual, expected)
+	}
+}
+
+func TestPriorityClassFor(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			PriorityClassDefault: "vice-default",
+			PriorityClassUserTiers: map[string]string{
+				"paid":     "vice-paid",
+				"workshop": "vice-workshop",
+				"missing":  "vice-missing",
+			},
+		},
+		clientset: fake.NewSimpleClientset(
+			&schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "vice-paid"}, Value: 2000},
+			&schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "vice-workshop"}, Value: 1000},
+		),
+	}
+
+	job := &VICEJob{Job: *testJob(model.Container{})}
+	job.UserGroups = []string{"workshop", "paid", "missing"}
+
+	actual, err := i.priorityClassFor(job, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "vice-paid" {
+		t.Errorf("priorityClassFor returned %q, not vice-paid", actual)
+	}
+
+	job.UserGroups = []string{"missing"}
+	if actual, err = i.priorityClassFor(job, ""); err != nil {
+		t.Fatal(err)
+	}
+	if actual != "vice-default" {
+		t.Errorf("priorityClassFor returned %q, not vice-default", actual)
+	}
+}
+
+func TestClaimPreemption(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+		},
+		clientset: fake.NewSimpleClientset(
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "vice-apps"}},
+		),
+	}
+
+	claimed, err := i.claimPreemption("job", "event-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Error("the first claim of event-1 failed")
+	}
+
+	if claimed, err = i.claimPreemption("job", "event-1"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Error("event-1 was claimed twice")
+	}
+}
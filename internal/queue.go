@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// QueuedLaunch contains information about a VICE analysis that is waiting in
+// the launch queue for capacity to free up.
+type QueuedLaunch struct {
+	ExternalID string    `json:"external_id"`
+	Username   string    `json:"username"`
+	Priority   int       `json:"priority"`
+	QueuedAt   time.Time `json:"queued_at"`
+	Position   int       `json:"position"`
+}
+
+const enqueueLaunchSQL = `
+	INSERT INTO vice_launch_queue (external_id, username, priority, job)
+	VALUES ($1, $2, $3, $4)
+	    ON CONFLICT (external_id) DO UPDATE SET job = EXCLUDED.job
+`
+
+const dequeueLaunchSQL = `
+	DELETE FROM vice_launch_queue WHERE external_id = $1
+`
+
+const listQueuedJobsSQL = `
+	SELECT external_id, username, priority, queued_at, job
+	  FROM vice_launch_queue
+  ORDER BY priority DESC, queued_at ASC
+`
+
+// Requeued jobs keep their place in the queue.
+const requeueLaunchSQL = `
+	INSERT INTO vice_launch_queue (external_id, username, priority, job, queued_at)
+	VALUES ($1, $2, $3, $4, $5)
+	    ON CONFLICT (external_id) DO NOTHING
+`
+
+const listQueuedLaunchesSQL = `
+	SELECT external_id, username, priority, queued_at, position
+	  FROM (
+		SELECT external_id, username, priority, queued_at,
+		       rank() OVER (ORDER BY priority DESC, queued_at ASC) AS position
+		  FROM vice_launch_queue
+	  ) AS q
+	 WHERE ($1 = '' OR username = $1)
+	   AND ($2 = '' OR external_id = $2)
+  ORDER BY position ASC
+`
+
+// queuePriority returns the priority of the job in the launch queue. Jobs
+// submitted by members of a group with a configured priority get the highest
+// priority among their groups. Everyone else gets 0.
+func (i *Internal) queuePriority(job *VICEJob) int {
+	var priority int
+	for _, group := range job.UserGroups {
+		if p, ok := i.LaunchQueueGroupPriorities[group]; ok && p > priority {
+			priority = p
+		}
+	}
+	return priority
+}
+
+// enqueueLaunch adds the job to the launch queue and returns its position.
+func (i *Internal) enqueueLaunch(job *VICEJob) (*QueuedLaunch, error) {
+	js, err := json.Marshal(job)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marshalling job %s for the launch queue", job.InvocationID)
+	}
+
+	if _, err = i.db.Exec(enqueueLaunchSQL, job.InvocationID, slugString(job.Submitter), i.queuePriority(job), string(js)); err != nil {
+		return nil, errors.Wrapf(err, "error adding job %s to the launch queue", job.InvocationID)
+	}
+
+	return i.queuedLaunch(job.InvocationID)
+}
+
+// dequeueLaunch removes the job from the launch queue and returns true if it
+// was there. It's not an error if the job isn't in the queue.
+func (i *Internal) dequeueLaunch(externalID string) (bool, error) {
+	result, err := i.db.Exec(dequeueLaunchSQL, externalID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error removing job %s from the launch queue", externalID)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "error removing job %s from the launch queue", externalID)
+	}
+	return rows > 0, nil
+}
+
+func (i *Internal) listQueuedLaunches(username, externalID string) ([]QueuedLaunch, error) {
+	rows, err := i.db.Query(listQueuedLaunchesSQL, username, externalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	launches := []QueuedLaunch{}
+	for rows.Next() {
+		var l QueuedLaunch
+		if err = rows.Scan(&l.ExternalID, &l.Username, &l.Priority, &l.QueuedAt, &l.Position); err != nil {
+			return nil, err
+		}
+		launches = append(launches, l)
+	}
+
+	return launches, rows.Err()
+}
+
+// queuedLaunch returns the queue entry for the job, or sql.ErrNoRows if it
+// isn't queued.
+func (i *Internal) queuedLaunch(externalID string) (*QueuedLaunch, error) {
+	launches, err := i.listQueuedLaunches("", externalID)
+	if err != nil {
+		return nil, err
+	}
+	if len(launches) < 1 {
+		return nil, sql.ErrNoRows
+	}
+	return &launches[0], nil
+}
+
+// queueLaunch adds the job to the launch queue, publishes a status update
+// explaining why, and writes the queue entry to the response with a 202.
+func (i *Internal) queueLaunch(writer http.ResponseWriter, job *VICEJob, reason error) {
+	queued, err := i.enqueueLaunch(job)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msg := fmt.Sprintf("analysis is waiting at position %d in the launch queue: %s", queued.Position, reason.Error())
+	log.Info(msg)
+	if err = i.statusPublisher.Queued(job.InvocationID, msg); err != nil {
+		log.Error(err)
+	}
+
+	buf, err := json.Marshal(queued)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(writer, string(buf))
+}
+
+// queuedJob is a job waiting in the launch queue.
+type queuedJob struct {
+	externalID string
+	username   string
+	priority   int
+	queuedAt   time.Time
+	job        string
+}
+
+// queuedJobs returns the jobs in the launch queue in the order they should be
+// launched.
+func (i *Internal) queuedJobs() ([]queuedJob, error) {
+	rows, err := i.db.Query(listQueuedJobsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := []queuedJob{}
+	for rows.Next() {
+		var q queuedJob
+		if err = rows.Scan(&q.externalID, &q.username, &q.priority, &q.queuedAt, &q.job); err != nil {
+			return nil, err
+		}
+		queued = append(queued, q)
+	}
+
+	return queued, rows.Err()
+}
+
+// requeueLaunch puts a job that was taken out of the launch queue back in its
+// old place.
+func (i *Internal) requeueLaunch(q queuedJob) error {
+	if _, err := i.db.Exec(requeueLaunchSQL, q.externalID, q.username, q.priority, q.job, q.queuedAt); err != nil {
+		return errors.Wrapf(err, "error putting job %s back in the launch queue", q.externalID)
+	}
+	return nil
+}
+
+// launchQueued makes a single pass through the launch queue in priority
+// order, launching each job that there's capacity for. Jobs that can never
+// be launched are failed and removed from the queue. Jobs that run into
+// transient errors stay in the queue and are tried again on the next pass.
+//
+// A job is removed from the queue before it's launched, so that no database
+// locks are held while the k8s API is called. Only the app-exposer instance
+// that removes it launches it.
+func (i *Internal) launchQueued() error {
+	queued, err := i.queuedJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range queued {
+		job := &VICEJob{}
+
+		if err = json.Unmarshal([]byte(q.job), job); err == nil {
+			err = i.validateJob(job)
+		}
+
+		if isCapacityError(err) {
+			continue
+		}
+		if isTransientError(err) {
+			log.Error(errors.Wrapf(err, "error validating queued job %s, it will be tried again", q.externalID))
+			continue
+		}
+
+		claimed, dqerr := i.dequeueLaunch(q.externalID)
+		if dqerr != nil {
+			return dqerr
+		}
+		if !claimed {
+			continue
+		}
+
+		if err == nil {
+			err = i.launch(job)
+		}
+
+		if isTransientError(err) {
+			log.Error(errors.Wrapf(err, "error launching queued job %s, it will be tried again", q.externalID))
+			if err = i.requeueLaunch(q); err == nil {
+				continue
+			}
+		}
+
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error launching queued job %s", q.externalID))
+			if failerr := i.statusPublisher.Fail(q.externalID, fmt.Sprintf("queued analysis could not be launched: %s", err.Error())); failerr != nil {
+				log.Error(failerr)
+			}
+			continue
+		}
+
+		log.Infof("launched queued job %s", q.externalID)
+		if runerr := i.statusPublisher.Running(q.externalID, "capacity is available, launching the queued analysis"); runerr != nil {
+			log.Error(runerr)
+		}
+	}
+
+	return nil
+}
+
+// ProcessLaunchQueue fires up a goroutine that periodically launches the
+// queued VICE analyses that there is now capacity for.
+func (i *Internal) ProcessLaunchQueue() {
+	go func() {
+		ticker := time.NewTicker(i.LaunchQueueInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.launchQueued(); err != nil {
+				log.Error(errors.Wrap(err, "error processing the launch queue"))
+			}
+		}
+	}()
+}
+
+// VICELaunchQueue lists the VICE analyses waiting in the launch queue along
+// with their positions.
+//
+// Query Parameters:
+//   user - Optional. Only list the analyses queued by this user.
+func (i *Internal) VICELaunchQueue(writer http.ResponseWriter, request *http.Request) {
+	var user string
+	if u := request.URL.Query().Get("user"); u != "" {
+		user = slugString(u)
+	}
+
+	launches, err := i.listQueuedLaunches(user, "")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(map[string][]QueuedLaunch{
+		"queue": launches,
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
+
+// VICEQueuePosition returns the launch queue entry for a single VICE analysis.
+func (i *Internal) VICEQueuePosition(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	queued, err := i.queuedLaunch(id)
+	if err == sql.ErrNoRows {
+		http.Error(writer, fmt.Sprintf("job %s is not in the launch queue", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(queued)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
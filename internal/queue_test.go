@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v4"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestQueuePriority(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			LaunchQueueGroupPriorities: map[string]int{
+				"workshop": 10,
+				"paid":     20,
+			},
+		},
+	}
+
+	job := &VICEJob{Job: model.Job{UserGroups: []string{"everyone", "workshop", "paid"}}}
+	if actual := i.queuePriority(job); actual != 20 {
+		t.Errorf("queuePriority returned %d, not 20", actual)
+	}
+
+	job = &VICEJob{Job: model.Job{UserGroups: []string{"everyone"}}}
+	if actual := i.queuePriority(job); actual != 0 {
+		t.Errorf("queuePriority returned %d, not 0", actual)
+	}
+}
+
+func TestIsCapacityError(t *testing.T) {
+	err := errors.Wrap(newCapacityError("%s is at capacity", "test"), "wrapped")
+	if !isCapacityError(err) {
+		t.Error("wrapped capacity error was not detected")
+	}
+
+	if isCapacityError(errors.New("not a capacity error")) {
+		t.Error("plain error was detected as a capacity error")
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	transient := []error{
+		k8serrors.NewServiceUnavailable("the API server is restarting"),
+		errors.Wrap(k8serrors.NewTimeoutError("timed out", 1), "wrapped"),
+		&pq.Error{Code: "08006"},
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		context.DeadlineExceeded,
+	}
+	for _, err := range transient {
+		if !isTransientError(err) {
+			t.Errorf("%v was not detected as transient", err)
+		}
+	}
+
+	permanent := []error{
+		nil,
+		errors.New("job type foo is not supported by this service"),
+		k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "vice-user-secrets"),
+		&pq.Error{Code: "23505"},
+	}
+	for _, err := range permanent {
+		if isTransientError(err) {
+			t.Errorf("%v was detected as transient", err)
+		}
+	}
+}
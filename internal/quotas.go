@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// ResourceAmounts contains the amount of each resource that one or more VICE
+// analyses are allowed to use.
+type ResourceAmounts struct {
+	CPUCores    float64 `json:"cpu_cores"`
+	MemoryBytes int64   `json:"memory_bytes"`
+	GPUs        int64   `json:"gpus"`
+}
+
+// Add returns the sum of the ResourceAmounts.
+func (r ResourceAmounts) Add(o ResourceAmounts) ResourceAmounts {
+	return ResourceAmounts{
+		CPUCores:    r.CPUCores + o.CPUCores,
+		MemoryBytes: r.MemoryBytes + o.MemoryBytes,
+		GPUs:        r.GPUs + o.GPUs,
+	}
+}
+
+// ResourceQuota contains the total resources a user's running VICE analyses
+// may use. A nil field means that the resource isn't limited. HomeVolumeBytes
+// is the size of the user's persistent home volume, and nil means that the
+// configured default size is used.
+type ResourceQuota struct {
+	CPUCores        *float64 `json:"cpu_cores"`
+	MemoryBytes     *int64   `json:"memory_bytes"`
+	GPUs            *int64   `json:"gpus"`
+	HomeVolumeBytes *int64   `json:"home_volume_bytes"`
+}
+
+// QuotaInfo is returned by the VICEQuota handler.
+type QuotaInfo struct {
+	User  string          `json:"user"`
+	Quota ResourceQuota   `json:"quota"`
+	Usage ResourceAmounts `json:"usage"`
+}
+
+// jobResources returns the resource limits that will be set on the analysis
+// container for the job.
+func jobResources(job *VICEJob) ResourceAmounts {
+	return ResourceAmounts{
+		CPUCores:    float64(cpuResourceLimit(&job.Job)),
+		MemoryBytes: memResourceLimit(&job.Job),
+		GPUs:        gpuCount(job),
+	}
+}
+
+// deploymentResources returns the resource limits set on the analysis
+// container in a VICE deployment. All of the resource names in gpuResources
+// count as GPUs.
+func deploymentResources(deployment *v1.Deployment, gpuResources []apiv1.ResourceName) ResourceAmounts {
+	amounts := ResourceAmounts{}
+
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+
+		limits := container.Resources.Limits
+
+		if cpu, ok := limits[apiv1.ResourceCPU]; ok {
+			amounts.CPUCores += float64(cpu.MilliValue()) / 1000
+		}
+
+		if mem, ok := limits[apiv1.ResourceMemory]; ok {
+			amounts.MemoryBytes += mem.Value()
+		}
+
+		for _, name := range gpuResources {
+			if gpu, ok := limits[name]; ok {
+				amounts.GPUs += gpu.Value()
+			}
+		}
+	}
+
+	return amounts
+}
+
+// resourceUsageForUser returns the total resources that the user's running
+// VICE analyses are allowed to use.
+func (i *Internal) resourceUsageForUser(username string) (ResourceAmounts, error) {
+	usage := ResourceAmounts{}
+
+	deployments, err := i.runningDeploymentsForUser(username)
+	if err != nil {
+		return usage, err
+	}
+
+	gpuResources := i.gpuResourceNames()
+	for _, deployment := range deployments {
+		usage = usage.Add(deploymentResources(&deployment, gpuResources))
+	}
+
+	return usage, nil
+}
+
+// A quota set for the user takes precedence over the quotas for their groups,
+// which take precedence over the default quota. If the user is in more than
+// one group with a quota, the most generous CPU quota wins.
+const getResourceQuotaSQL = `
+	SELECT max_cpu_cores, max_memory, max_gpus, home_volume_size
+	  FROM resource_quotas
+	 WHERE launcher = $1
+	    OR group_name = ANY($2)
+	    OR (launcher IS NULL AND group_name IS NULL)
+  ORDER BY launcher IS NULL, group_name IS NULL, max_cpu_cores DESC NULLS FIRST
+	 LIMIT 1
+`
+
+func (i *Internal) getResourceQuota(username string, groups []string) (*ResourceQuota, error) {
+	var (
+		cpu  sql.NullFloat64
+		mem  sql.NullInt64
+		gpu  sql.NullInt64
+		home sql.NullInt64
+	)
+
+	quota := &ResourceQuota{}
+
+	err := i.db.QueryRow(getResourceQuotaSQL, username, pq.Array(groups)).Scan(&cpu, &mem, &gpu, &home)
+	if err == sql.ErrNoRows {
+		return quota, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cpu.Valid {
+		quota.CPUCores = &cpu.Float64
+	}
+	if mem.Valid {
+		quota.MemoryBytes = &mem.Int64
+	}
+	if gpu.Valid {
+		quota.GPUs = &gpu.Int64
+	}
+	if home.Valid {
+		quota.HomeVolumeBytes = &home.Int64
+	}
+
+	return quota, nil
+}
+
+// checkQuota returns an error if the usage exceeds the quota.
+func checkQuota(user string, quota *ResourceQuota, usage ResourceAmounts) error {
+	if quota.CPUCores != nil && usage.CPUCores > *quota.CPUCores {
+		return fmt.Errorf("%s would be using %.2f CPU cores, which exceeds their quota of %.2f", user, usage.CPUCores, *quota.CPUCores)
+	}
+	if quota.MemoryBytes != nil && usage.MemoryBytes > *quota.MemoryBytes {
+		return fmt.Errorf("%s would be using %d bytes of memory, which exceeds their quota of %d", user, usage.MemoryBytes, *quota.MemoryBytes)
+	}
+	if quota.GPUs != nil && usage.GPUs > *quota.GPUs {
+		return fmt.Errorf("%s would be using %d GPUs, which exceeds their quota of %d", user, usage.GPUs, *quota.GPUs)
+	}
+	return nil
+}
+
+// validateQuota returns an error if launching the job would push the user's
+// running VICE analyses over their resource quota.
+func (i *Internal) validateQuota(job *VICEJob) error {
+	user := slugString(job.Submitter)
+
+	quota, err := i.getResourceQuota(user, job.UserGroups)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the resource quota for %s", user)
+	}
+
+	usage, err := i.resourceUsageForUser(user)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the resources %s is currently using", user)
+	}
+
+	// A job that's larger than the quota on its own will never fit.
+	if err = checkQuota(user, quota, jobResources(job)); err != nil {
+		return err
+	}
+
+	if err = checkQuota(user, quota, usage.Add(jobResources(job))); err != nil {
+		return &capacityError{msg: err.Error()}
+	}
+
+	return nil
+}
+
+// VICEQuota returns the resource quota for a user along with the resources
+// their running VICE analyses are currently using.
+//
+// Query Parameters:
+//   user - Required. The username to look up the quota for.
+//   group - Optional, may be repeated. The groups the user belongs to.
+func (i *Internal) VICEQuota(writer http.ResponseWriter, request *http.Request) {
+	users, found := request.URL.Query()["user"]
+	if !found || len(users) < 1 {
+		http.Error(writer, "user is not set", http.StatusForbidden)
+		return
+	}
+
+	user := slugString(users[0])
+	groups := request.URL.Query()["group"]
+
+	quota, err := i.getResourceQuota(user, groups)
+	if err != nil {
+		http.Error(writer, errors.Wrapf(err, "error getting the resource quota for %s", user).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := i.resourceUsageForUser(user)
+	if err != nil {
+		http.Error(writer, errors.Wrapf(err, "error getting the resource usage for %s", user).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(&QuotaInfo{
+		User:  user,
+		Quota: *quota,
+		Usage: usage,
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
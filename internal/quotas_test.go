@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestDeploymentResources(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name: viceProxyContainerName,
+							Resources: apiv1.ResourceRequirements{
+								Limits: apiv1.ResourceList{
+									apiv1.ResourceCPU: resourcev1.MustParse("1"),
+								},
+							},
+						},
+						{
+							Name: analysisContainerName,
+							Resources: apiv1.ResourceRequirements{
+								Limits: apiv1.ResourceList{
+									apiv1.ResourceCPU:                   resourcev1.MustParse("1500m"),
+									apiv1.ResourceMemory:                resourcev1.MustParse("2Gi"),
+									apiv1.ResourceName(gpuResourceName): resourcev1.MustParse("1"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	actual := deploymentResources(deployment, []apiv1.ResourceName{gpuResourceName})
+	expected := ResourceAmounts{CPUCores: 1.5, MemoryBytes: 2147483648, GPUs: 1}
+	if actual != expected {
+		t.Errorf("deploymentResources returned %+v, not %+v", actual, expected)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	cpu := 4.0
+	gpus := int64(1)
+	quota := &ResourceQuota{CPUCores: &cpu, GPUs: &gpus}
+
+	if err := checkQuota("test", quota, ResourceAmounts{CPUCores: 4, MemoryBytes: 1 << 40, GPUs: 1}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err := checkQuota("test", quota, ResourceAmounts{CPUCores: 4.5}); err == nil {
+		t.Error("expected an error for exceeding the CPU quota")
+	}
+
+	if err := checkQuota("test", quota, ResourceAmounts{GPUs: 2}); err == nil {
+		t.Error("expected an error for exceeding the GPU quota")
+	}
+}
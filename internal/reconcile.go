@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// jobRecordFileName is the key in the job record Secret that holds the
+	// JSON for the VICEJob the analysis was launched from.
+	jobRecordFileName = "job.json"
+
+	// jobRecordLabel marks the Secrets that hold job records.
+	jobRecordLabel      = "vice-record"
+	jobRecordLabelValue = "job"
+
+	// driftEventReason is the reason of the Events recorded when a resource
+	// is repaired.
+	driftEventReason = "DriftRepaired"
+)
+
+// DriftRepair describes a resource that was missing or modified and was put
+// back the way the analysis was launched.
+type DriftRepair struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// jobRecordSecretName returns the name of the Secret that records the job the
+// analysis was launched from.
+func jobRecordSecretName(invocationID string) string {
+	return fmt.Sprintf("vice-job-%s", invocationID)
+}
+
+// jobRecordSecret assembles the Secret that records the job the analysis was
+// launched from, which is the desired state the analysis is reconciled
+// against. The job includes the environment of the analysis, so it's kept in
+// a Secret rather than a ConfigMap. It does not call the k8s API.
+func (i *Internal) jobRecordSecret(job *VICEJob) (*apiv1.Secret, error) {
+	labels, err := i.labelsFromJob(&job.Job)
+	if err != nil {
+		return nil, err
+	}
+	labels[jobRecordLabel] = jobRecordLabelValue
+
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   jobRecordSecretName(job.InvocationID),
+			Labels: labels,
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			jobRecordFileName: buf,
+		},
+	}, nil
+}
+
+// UpsertJobRecord creates or updates the Secret that records the job the
+// analysis was launched from.
+func (i *Internal) UpsertJobRecord(job *VICEJob) error {
+	secret, err := i.jobRecordSecret(job)
+	if err != nil {
+		return err
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+
+	_, err = secretclient.Get(secret.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = secretclient.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = secretclient.Update(secret)
+	return err
+}
+
+// jobFromRecord parses the job stored in a job record Secret.
+func jobFromRecord(secret *apiv1.Secret) (*VICEJob, error) {
+	job := &VICEJob{}
+	if err := json.Unmarshal(secret.Data[jobRecordFileName], job); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the job record in %s", secret.Name)
+	}
+	return job, nil
+}
+
+// jobRecord returns the job the analysis was launched from.
+func (i *Internal) jobRecord(externalID string) (*VICEJob, error) {
+	secret, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(jobRecordSecretName(externalID), metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the job for analysis %s", externalID)
+	}
+	return jobFromRecord(secret)
+}
+
+// servicePortsMatch returns true if the actual ports have the names, ports,
+// and targets that the desired ports do. Fields set by k8s are ignored.
+func servicePortsMatch(desired, actual []apiv1.ServicePort) bool {
+	if len(desired) != len(actual) {
+		return false
+	}
+	for idx := range desired {
+		d, a := desired[idx], actual[idx]
+		if d.Name != a.Name || d.Port != a.Port || d.Protocol != a.Protocol || d.TargetPort != a.TargetPort {
+			return false
+		}
+	}
+	return true
+}
+
+// ingressMatches returns true if the actual Ingress sends requests to the
+// same backends as the desired one. Fields set by k8s are ignored.
+func ingressMatches(desired, actual *extv1beta1.Ingress) bool {
+	if !apiequality.Semantic.DeepEqual(desired.Spec.Backend, actual.Spec.Backend) {
+		return false
+	}
+	if len(desired.Spec.Rules) != len(actual.Spec.Rules) {
+		return false
+	}
+	for idx := range desired.Spec.Rules {
+		d, a := desired.Spec.Rules[idx], actual.Spec.Rules[idx]
+		if d.Host != a.Host || (d.HTTP == nil) != (a.HTTP == nil) {
+			return false
+		}
+		if d.HTTP == nil {
+			continue
+		}
+		if len(d.HTTP.Paths) != len(a.HTTP.Paths) {
+			return false
+		}
+		for p := range d.HTTP.Paths {
+			if d.HTTP.Paths[p].Path != a.HTTP.Paths[p].Path || !apiequality.Semantic.DeepEqual(d.HTTP.Paths[p].Backend, a.HTTP.Paths[p].Backend) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reconcileService repairs the Service for the analysis.
+func (i *Internal) reconcileService(job *VICEJob, deployment *appsv1.Deployment) (*apiv1.Service, *DriftRepair, error) {
+	desired, err := i.getService(&job.Job, deployment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+
+	actual, err := svcclient.Get(desired.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err = svcclient.Create(desired); err != nil {
+			return nil, nil, err
+		}
+		return desired, &DriftRepair{Kind: "Service", Name: desired.Name, Action: "created"}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if servicePortsMatch(desired.Spec.Ports, actual.Spec.Ports) && apiequality.Semantic.DeepEqual(desired.Spec.Selector, actual.Spec.Selector) {
+		return actual, nil, nil
+	}
+
+	actual.Spec.Ports = desired.Spec.Ports
+	actual.Spec.Selector = desired.Spec.Selector
+	if _, err = svcclient.Update(actual); err != nil {
+		return nil, nil, err
+	}
+	return actual, &DriftRepair{Kind: "Service", Name: desired.Name, Action: "updated"}, nil
+}
+
+// reconcileIngress repairs the Ingress for the analysis.
+func (i *Internal) reconcileIngress(job *VICEJob, svc *apiv1.Service) (*DriftRepair, error) {
+	desired, err := i.getIngress(&job.Job, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+
+	actual, err := ingressclient.Get(desired.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err = ingressclient.Create(desired); err != nil {
+			return nil, err
+		}
+		return &DriftRepair{Kind: "Ingress", Name: desired.Name, Action: "created"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ingressMatches(desired, actual) {
+		return nil, nil
+	}
+
+	actual.Spec = desired.Spec
+	if _, err = ingressclient.Update(actual); err != nil {
+		return nil, err
+	}
+	return &DriftRepair{Kind: "Ingress", Name: desired.Name, Action: "updated"}, nil
+}
+
+// reconcileConfigMap repairs one of the ConfigMaps for the analysis. If
+// keepData is true, the data in an existing ConfigMap is left alone, which is
+// used for the ConfigMaps that change while the analysis runs.
+func (i *Internal) reconcileConfigMap(desired *apiv1.ConfigMap, keepData bool) (*DriftRepair, error) {
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	actual, err := cmclient.Get(desired.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err = cmclient.Create(desired); err != nil {
+			return nil, err
+		}
+		return &DriftRepair{Kind: "ConfigMap", Name: desired.Name, Action: "created"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if keepData || apiequality.Semantic.DeepEqual(desired.Data, actual.Data) {
+		return nil, nil
+	}
+
+	actual.Data = desired.Data
+	if _, err = cmclient.Update(actual); err != nil {
+		return nil, err
+	}
+	return &DriftRepair{Kind: "ConfigMap", Name: desired.Name, Action: "updated"}, nil
+}
+
+// reconcileNetworkPolicy repairs the NetworkPolicy for the analysis.
+func (i *Internal) reconcileNetworkPolicy(job *VICEJob) (*DriftRepair, error) {
+	desired, err := i.getNetworkPolicy(&job.Job)
+	if err != nil {
+		return nil, err
+	}
+
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+
+	actual, err := npclient.Get(desired.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err = npclient.Create(desired); err != nil {
+			return nil, err
+		}
+		return &DriftRepair{Kind: "NetworkPolicy", Name: desired.Name, Action: "created"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if apiequality.Semantic.DeepEqual(desired.Spec, actual.Spec) {
+		return nil, nil
+	}
+
+	actual.Spec = desired.Spec
+	if _, err = npclient.Update(actual); err != nil {
+		return nil, err
+	}
+	return &DriftRepair{Kind: "NetworkPolicy", Name: desired.Name, Action: "updated"}, nil
+}
+
+// reconcileAnalysis recomputes the resources for the analysis from the job it
+// was launched from and repairs the ones that are missing or have been
+// modified. The Deployment itself isn't touched. The repairs that were made
+// are returned.
+func (i *Internal) reconcileAnalysis(job *VICEJob, deployment *appsv1.Deployment) ([]DriftRepair, error) {
+	repairs := []DriftRepair{}
+
+	add := func(repair *DriftRepair) {
+		if repair != nil {
+			repairs = append(repairs, *repair)
+		}
+	}
+
+	svc, repair, err := i.reconcileService(job, deployment)
+	if err != nil {
+		return repairs, errors.Wrap(err, "error reconciling the service")
+	}
+	add(repair)
+
+	if repair, err = i.reconcileIngress(job, svc); err != nil {
+		return repairs, errors.Wrap(err, "error reconciling the ingress")
+	}
+	add(repair)
+
+	excludesCM, err := i.excludesConfigMap(&job.Job)
+	if err != nil {
+		return repairs, err
+	}
+	if repair, err = i.reconcileConfigMap(excludesCM, false); err != nil {
+		return repairs, errors.Wrap(err, "error reconciling the excludes config map")
+	}
+	add(repair)
+
+	inputCM, err := i.inputPathListConfigMap(&job.Job)
+	if err != nil {
+		return repairs, err
+	}
+	if repair, err = i.reconcileConfigMap(inputCM, false); err != nil {
+		return repairs, errors.Wrap(err, "error reconciling the input path list config map")
+	}
+	add(repair)
+
+	// The users an analysis is shared with change while it runs, so the
+	// sharing config map is only put back if it's gone.
+	sharingCM, err := i.sharingConfigMap(&job.Job)
+	if err != nil {
+		return repairs, err
+	}
+	if repair, err = i.reconcileConfigMap(sharingCM, true); err != nil {
+		return repairs, errors.Wrap(err, "error reconciling the sharing config map")
+	}
+	add(repair)
+
+	if i.NetworkPolicies.Enabled {
+		if repair, err = i.reconcileNetworkPolicy(job); err != nil {
+			return repairs, errors.Wrap(err, "error reconciling the network policy")
+		}
+		add(repair)
+	}
+
+	return repairs, nil
+}
+
+// recordDrift records an Event on the Deployment for the repair.
+func (i *Internal) recordDrift(deployment *appsv1.Deployment, repair DriftRepair) error {
+	now := metav1.NewTime(time.Now())
+
+	_, err := i.clientset.CoreV1().Events(i.ViceNamespace).Create(&apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-", deployment.Name),
+			Labels: map[string]string{
+				"external-id": deployment.Labels["external-id"],
+			},
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Namespace:  deployment.Namespace,
+			Name:       deployment.Name,
+			UID:        deployment.UID,
+		},
+		Reason:         driftEventReason,
+		Message:        fmt.Sprintf("%s %s was %s", repair.Kind, repair.Name, repair.Action),
+		Type:           apiv1.EventTypeWarning,
+		Source:         apiv1.EventSource{Component: "app-exposer"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	return err
+}
+
+// reconcileAnalyses reconciles every running analysis that has a job record.
+// Analyses without a Deployment are left to the orphan collector, and
+// analyses whose Deployment is being deleted are skipped so that their
+// resources aren't put back while they're being torn down.
+func (i *Internal) reconcileAnalyses() error {
+	set := labels.Set(map[string]string{
+		"app-type":     "interactive",
+		jobRecordLabel: jobRecordLabelValue,
+	})
+
+	secretlist, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+	for idx := range secretlist.Items {
+		record := &secretlist.Items[idx]
+		externalID := record.Labels["external-id"]
+
+		deployment, err := depclient.Get(externalID, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error getting the deployment for analysis %s", externalID))
+			continue
+		}
+		if deployment.DeletionTimestamp != nil {
+			continue
+		}
+
+		job, err := jobFromRecord(record)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		repairs, err := i.reconcileAnalysis(job, deployment)
+		for _, repair := range repairs {
+			log.Infof("repaired drift for analysis %s: %s %s was %s", externalID, repair.Kind, repair.Name, repair.Action)
+			if rerr := i.recordDrift(deployment, repair); rerr != nil {
+				log.Error(errors.Wrapf(rerr, "error recording drift for analysis %s", externalID))
+			}
+		}
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error reconciling analysis %s", externalID))
+		}
+	}
+
+	return nil
+}
+
+// ReconcileAnalyses fires up a goroutine that periodically repairs the
+// resources of running analyses that have gone missing or been modified.
+func (i *Internal) ReconcileAnalyses() {
+	go func() {
+		ticker := time.NewTicker(i.ReconcileInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.reconcileAnalyses(); err != nil {
+				log.Error(errors.Wrap(err, "error reconciling VICE analyses"))
+			}
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServicePortsMatch(t *testing.T) {
+	desired := []corev1.ServicePort{
+		{Name: fileTransfersPortName, Protocol: corev1.ProtocolTCP, Port: fileTransfersPort, TargetPort: intstr.FromString(fileTransfersPortName)},
+	}
+
+	actual := []corev1.ServicePort{desired[0]}
+	actual[0].NodePort = 30000
+	if !servicePortsMatch(desired, actual) {
+		t.Error("ports that only differ in fields set by k8s don't match")
+	}
+
+	actual[0].TargetPort = intstr.FromInt(8080)
+	if servicePortsMatch(desired, actual) {
+		t.Error("ports with a different target match")
+	}
+
+	if servicePortsMatch(desired, nil) {
+		t.Error("missing ports match")
+	}
+}
+
+func TestIngressMatches(t *testing.T) {
+	backend := &extv1beta1.IngressBackend{ServiceName: "vice-a", ServicePort: intstr.FromInt(int(viceProxyPort))}
+	desired := &extv1beta1.Ingress{Spec: extv1beta1.IngressSpec{Backend: backend}}
+	actual := desired.DeepCopy()
+
+	if !ingressMatches(desired, actual) {
+		t.Error("identical ingresses don't match")
+	}
+
+	actual.Spec.Backend.ServiceName = "somewhere-else"
+	if ingressMatches(desired, actual) {
+		t.Error("an ingress pointing somewhere else matches")
+	}
+}
+
+func TestReconcileConfigMap(t *testing.T) {
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-a", Namespace: "vice-apps"},
+		Data:       map[string]string{excludesFileName: "modified\n"},
+	}
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(existing),
+	}
+
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-a"},
+		Data:       map[string]string{excludesFileName: "original\n"},
+	}
+
+	repair, err := i.reconcileConfigMap(desired, true)
+	if err != nil || repair != nil {
+		t.Errorf("a config map whose data is kept was repaired: %+v, %v", repair, err)
+	}
+
+	repair, err = i.reconcileConfigMap(desired, false)
+	if err != nil || repair == nil || repair.Action != "updated" {
+		t.Fatalf("unexpected repair %+v, %v", repair, err)
+	}
+
+	cm, err := i.clientset.CoreV1().ConfigMaps("vice-apps").Get("excludes-file-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[excludesFileName] != "original\n" {
+		t.Errorf("the config map wasn't repaired: %v", cm.Data)
+	}
+
+	if repair, err = i.reconcileConfigMap(desired, false); err != nil || repair != nil {
+		t.Errorf("a config map without drift was repaired: %+v, %v", repair, err)
+	}
+
+	desired.Name = "input-path-list-a"
+	if repair, err = i.reconcileConfigMap(desired, false); err != nil || repair == nil || repair.Action != "created" {
+		t.Errorf("unexpected repair of a missing config map %+v, %v", repair, err)
+	}
+}
+
+func TestReconcileAnalysesSkipsDeletedDeployments(t *testing.T) {
+	record := func(id string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      jobRecordSecretName(id),
+				Namespace: "vice-apps",
+				Labels: map[string]string{
+					"app-type":     "interactive",
+					"external-id":  id,
+					jobRecordLabel: jobRecordLabelValue,
+				},
+			},
+			Data: map[string][]byte{jobRecordFileName: []byte(`{"uuid": "` + id + `"}`)},
+		}
+	}
+
+	deleting := metav1.Now()
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			record("deleting"),
+			record("gone"),
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "deleting",
+					Namespace:         "vice-apps",
+					DeletionTimestamp: &deleting,
+				},
+			},
+		),
+	}
+
+	if err := i.reconcileAnalyses(); err != nil {
+		t.Fatal(err)
+	}
+
+	svcs, err := i.clientset.CoreV1().Services("vice-apps").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs.Items) != 0 {
+		t.Errorf("services were created for analyses that are gone: %+v", svcs.Items)
+	}
+}
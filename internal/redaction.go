@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// redactedValue replaces the values that are hidden from listings.
+	redactedValue = "[redacted]"
+
+	// fullView is the value of the view query parameter that asks for the
+	// unredacted listings. Only admins can use it.
+	fullView = "full"
+
+	// defaultSensitivePattern matches the names of environment variables and
+	// command line flags that hide their values by default.
+	defaultSensitivePattern = `(?i)(token|secret|password|passwd|credential|api[-_]?key)`
+)
+
+// listingParams are the query parameters of the listing endpoints that aren't
+// label filters.
+var listingParams = []string{"view", "user"}
+
+// RedactionRules control what's hidden in the listing endpoints, unless the
+// full view is requested by an admin. The patterns are regular expressions.
+type RedactionRules struct {
+	// The names of environment variables whose values are hidden.
+	EnvNames []string `mapstructure:"env-names"`
+
+	// The names of command line flags whose values are hidden, for both the
+	// --flag value and --flag=value forms.
+	Arguments []string `mapstructure:"arguments"`
+
+	// The ConfigMap keys whose contents are hidden, like the input path list.
+	// These are key names, not patterns.
+	ConfigMapKeys []string `mapstructure:"configmap-keys"`
+}
+
+// redactor applies compiled redaction rules to listing info.
+type redactor struct {
+	envNames      []*regexp.Regexp
+	arguments     []*regexp.Regexp
+	configMapKeys map[string]bool
+
+	// Whether the args and environment of the analysis container are
+	// included, with their sensitive values redacted. Only admins see them.
+	containerConfig bool
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = []string{defaultSensitivePattern}
+	}
+
+	compiled := []*regexp.Regexp{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction pattern %s", p)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// compile returns a redactor for the rules. The default rules are used for
+// anything that isn't configured.
+func (r RedactionRules) compile() (*redactor, error) {
+	envNames, err := compilePatterns(r.EnvNames)
+	if err != nil {
+		return nil, err
+	}
+
+	arguments, err := compilePatterns(r.Arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := r.ConfigMapKeys
+	if len(keys) == 0 {
+		keys = []string{inputPathListFileName, inputTicketListFileName, excludesFileName, sharingFileName}
+	}
+
+	configMapKeys := map[string]bool{}
+	for _, k := range keys {
+		configMapKeys[k] = true
+	}
+
+	return &redactor{
+		envNames:      envNames,
+		arguments:     arguments,
+		configMapKeys: configMapKeys,
+	}, nil
+}
+
+// Validate returns an error if any of the patterns in the rules are invalid.
+func (r RedactionRules) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// command returns a copy of the command with the values of sensitive flags
+// hidden.
+func (r *redactor) command(command []string) []string {
+	redacted := make([]string, len(command))
+	copy(redacted, command)
+
+	for idx := 0; idx < len(redacted); idx++ {
+		arg := redacted[idx]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		if eq := strings.Index(arg, "="); eq >= 0 {
+			if matchesAny(r.arguments, arg[:eq]) {
+				redacted[idx] = arg[:eq+1] + redactedValue
+			}
+			continue
+		}
+
+		if matchesAny(r.arguments, arg) && idx+1 < len(redacted) && !strings.HasPrefix(redacted[idx+1], "-") {
+			redacted[idx+1] = redactedValue
+			idx++
+		}
+	}
+
+	return redacted
+}
+
+// environment returns a copy of the environment with the values of sensitive
+// variables hidden.
+func (r *redactor) environment(env map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for name, value := range env {
+		if matchesAny(r.envNames, name) {
+			value = redactedValue
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// containerStatuses returns copies of the statuses without the container and
+// image IDs or the messages from the containers, which may include output
+// from the app.
+func containerStatuses(statuses []corev1.ContainerStatus) []corev1.ContainerStatus {
+	redacted := []corev1.ContainerStatus{}
+	for _, s := range statuses {
+		s = *s.DeepCopy()
+		s.ContainerID = ""
+		s.ImageID = ""
+		for _, state := range []*corev1.ContainerState{&s.State, &s.LastTerminationState} {
+			if state.Waiting != nil && state.Waiting.Message != "" {
+				state.Waiting.Message = redactedValue
+			}
+			if state.Terminated != nil {
+				state.Terminated.ContainerID = ""
+				if state.Terminated.Message != "" {
+					state.Terminated.Message = redactedValue
+				}
+			}
+		}
+		redacted = append(redacted, s)
+	}
+	return redacted
+}
+
+func (r *redactor) deploymentInfo(info *DeploymentInfo) {
+	info.Command = r.command(info.Command)
+	if !r.containerConfig {
+		info.Args = nil
+		info.Environment = nil
+		return
+	}
+	info.Args = r.command(info.Args)
+	info.Environment = r.environment(info.Environment)
+}
+
+func (r *redactor) podInfo(info *PodInfo) {
+	info.ContainerStatuses = containerStatuses(info.ContainerStatuses)
+	info.InitContainerStatuses = containerStatuses(info.InitContainerStatuses)
+}
+
+func (r *redactor) configMapInfo(info *ConfigMapInfo) {
+	redacted := map[string]string{}
+	for key, value := range info.Data {
+		if r.configMapKeys[key] && value != "" {
+			value = fmt.Sprintf("[redacted %d lines]", len(strings.Split(strings.TrimSpace(value), "\n")))
+		}
+		redacted[key] = value
+	}
+	info.Data = redacted
+}
+
+// isAdmin returns true if the user is one of the configured admins. The user
+// comes from the user query parameter, which app-exposer doesn't authenticate.
+// The trusted front end in front of app-exposer has to set it to the user that
+// it authenticated, and must not pass along a value from the client.
+func (i *Internal) isAdmin(user string) bool {
+	if user == "" {
+		return false
+	}
+	for _, admin := range i.AdminUsers {
+		if slugString(admin) == slugString(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactor returns the redactor for the configured rules. The rules are only
+// compiled once.
+func (i *Internal) redactor() (*redactor, error) {
+	i.redactionOnce.Do(func() {
+		i.redaction, i.redactionErr = i.Redaction.compile()
+	})
+	return i.redaction, i.redactionErr
+}
+
+// listingRedactor returns the redactor for a listing request, or nil if the
+// full view was requested. Only admins can request the full view, and only
+// admins see the args and environment of analysis containers. The status code
+// to return is included with the error.
+func (i *Internal) listingRedactor(request *http.Request) (*redactor, int, error) {
+	query := request.URL.Query()
+	admin := i.isAdmin(query.Get("user"))
+
+	if query.Get("view") == fullView {
+		if !admin {
+			return nil, http.StatusForbidden, fmt.Errorf("only admins can request the full view")
+		}
+		return nil, http.StatusOK, nil
+	}
+
+	compiled, err := i.redactor()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	r := *compiled
+	r.containerConfig = admin
+	return &r, http.StatusOK, nil
+}
+
+// listingFilter returns the label filter for a listing request, which is made
+// up of the query parameters that aren't used for anything else.
+func listingFilter(request *http.Request) map[string]string {
+	filter := filterMap(request.URL.Query())
+	for _, p := range listingParams {
+		delete(filter, p)
+	}
+	return filter
+}
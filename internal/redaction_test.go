@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRedactCommand(t *testing.T) {
+	r, err := RedactionRules{}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := r.command([]string{"app", "--api-token", "abc", "--password=xyz", "--verbose", "--name", "test", "--secret"})
+	expected := []string{"app", "--api-token", redactedValue, "--password=" + redactedValue, "--verbose", "--name", "test", "--secret"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("command returned %v, not %v", actual, expected)
+	}
+
+	env := r.environment(map[string]string{"GITHUB_TOKEN": "abc", "HOME": "/home/user"})
+	if env["GITHUB_TOKEN"] != redactedValue || env["HOME"] != "/home/user" {
+		t.Errorf("unexpected environment %v", env)
+	}
+
+	if err = (RedactionRules{EnvNames: []string{"("}}).Validate(); err == nil {
+		t.Error("Validate didn't fail for an invalid pattern")
+	}
+}
+
+func TestDeploymentInfoRedaction(t *testing.T) {
+	i := &Internal{Init: Init{AdminUsers: []string{"admin"}}}
+
+	listingInfo := func(query string) *DeploymentInfo {
+		r, status, err := i.listingRedactor(httptest.NewRequest(http.MethodGet, "/vice/listing/deployments"+query, nil))
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("listingRedactor returned %d, %v", status, err)
+		}
+		info := &DeploymentInfo{
+			Args:        []string{"--token", "abc"},
+			Environment: map[string]string{"API_KEY": "abc", "HOME": "/home/user"},
+		}
+		r.deploymentInfo(info)
+		return info
+	}
+
+	if info := listingInfo("?user=someone"); info.Args != nil || info.Environment != nil {
+		t.Errorf("a non-admin got the args and environment: %+v", info)
+	}
+
+	info := listingInfo("?user=admin")
+	if !reflect.DeepEqual(info.Args, []string{"--token", redactedValue}) || info.Environment["API_KEY"] != redactedValue || info.Environment["HOME"] != "/home/user" {
+		t.Errorf("unexpected args and environment for an admin: %+v", info)
+	}
+}
+
+func TestFilterableConfigMapsRedaction(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+			AdminUsers:    []string{"admin"},
+		},
+		clientset: fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "input-path-list-job",
+				Namespace: "vice-apps",
+				Labels: map[string]string{
+					"app-type":    "interactive",
+					"external-id": "job",
+				},
+			},
+			Data: map[string]string{
+				inputPathListFileName: "/iplant/home/user/a\n/iplant/home/user/b\n",
+			},
+		}),
+	}
+
+	listing := func(query string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/vice/listing/configmaps"+query, nil)
+		rec := httptest.NewRecorder()
+		i.FilterableConfigMaps(rec, req)
+
+		var body map[string][]ConfigMapInfo
+		if rec.Code != http.StatusOK {
+			return rec.Code, ""
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body["configmaps"]) != 1 {
+			t.Fatalf("unexpected listing %v", body)
+		}
+		return rec.Code, body["configmaps"][0].Data[inputPathListFileName]
+	}
+
+	if _, data := listing("?external-id=job"); data != "[redacted 2 lines]" {
+		t.Errorf("the path list wasn't redacted: %s", data)
+	}
+
+	if code, _ := listing("?view=full&user=someone"); code != http.StatusForbidden {
+		t.Errorf("a non-admin got a %d for the full view", code)
+	}
+
+	if _, data := listing("?view=full&user=admin"); data != "/iplant/home/user/a\n/iplant/home/user/b\n" {
+		t.Errorf("the path list was redacted in the full view: %s", data)
+	}
+}
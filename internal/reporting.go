@@ -113,11 +113,13 @@ type MetaInfo struct {
 // DeploymentInfo contains information returned about a Deployment.
 type DeploymentInfo struct {
 	MetaInfo
-	Image   string   `json:"image"`
-	Command []string `json:"command"`
-	Port    int32    `json:"port"`
-	User    int64    `json:"user"`
-	Group   int64    `json:"group"`
+	Image       string            `json:"image"`
+	Command     []string          `json:"command"`
+	Args        []string          `json:"args,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Port        int32             `json:"port"`
+	User        int64             `json:"user"`
+	Group       int64             `json:"group"`
 }
 
 func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
@@ -127,6 +129,8 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 		image   string
 		port    int32
 		command []string
+		args    []string
+		env     = map[string]string{}
 	)
 
 	labels := deployment.GetObjectMeta().GetLabels()
@@ -136,6 +140,10 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 		if container.Name == "analysis" {
 			image = container.Image
 			command = container.Command
+			args = container.Args
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
 			port = container.Ports[0].ContainerPort
 			user = *container.SecurityContext.RunAsUser
 			group = *container.SecurityContext.RunAsGroup
@@ -156,11 +164,13 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 			CreationTimestamp: deployment.GetCreationTimestamp().String(),
 		},
 
-		Image:   image,
-		Command: command,
-		Port:    port,
-		User:    user,
-		Group:   group,
+		Image:       image,
+		Command:     command,
+		Args:        args,
+		Environment: env,
+		Port:        port,
+		User:        user,
+		Group:       group,
 	}
 }
 
@@ -303,7 +313,7 @@ func ingressInfo(ingress *extv1b1.Ingress) *IngressInfo {
 	}
 }
 
-func (i *Internal) getFilteredDeployments(filter map[string]string) ([]DeploymentInfo, error) {
+func (i *Internal) getFilteredDeployments(filter map[string]string, r *redactor) ([]DeploymentInfo, error) {
 	depList, err := i.deploymentList(i.ViceNamespace, filter)
 	if err != nil {
 		return nil, err
@@ -313,6 +323,9 @@ func (i *Internal) getFilteredDeployments(filter map[string]string) ([]Deploymen
 
 	for _, dep := range depList.Items {
 		info := deploymentInfo(&dep)
+		if r != nil {
+			r.deploymentInfo(info)
+		}
 		deployments = append(deployments, *info)
 	}
 
@@ -323,9 +336,15 @@ func (i *Internal) getFilteredDeployments(filter map[string]string) ([]Deploymen
 func (i *Internal) FilterableDeployments(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
+
+	r, status, err := i.listingRedactor(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
 
-	deployments, err := i.getFilteredDeployments(filter)
+	deployments, err := i.getFilteredDeployments(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
@@ -343,7 +362,7 @@ func (i *Internal) FilterableDeployments(writer http.ResponseWriter, request *ht
 	fmt.Fprintf(writer, string(buf))
 }
 
-func (i *Internal) getFilteredPods(filter map[string]string) ([]PodInfo, error) {
+func (i *Internal) getFilteredPods(filter map[string]string, r *redactor) ([]PodInfo, error) {
 	podList, err := i.podList(i.ViceNamespace, filter)
 	if err != nil {
 		return nil, err
@@ -353,6 +372,9 @@ func (i *Internal) getFilteredPods(filter map[string]string) ([]PodInfo, error)
 
 	for _, pod := range podList.Items {
 		info := podInfo(&pod)
+		if r != nil {
+			r.podInfo(info)
+		}
 		pods = append(pods, *info)
 	}
 
@@ -363,9 +385,15 @@ func (i *Internal) getFilteredPods(filter map[string]string) ([]PodInfo, error)
 func (i *Internal) FilterablePods(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
+
+	r, status, err := i.listingRedactor(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
 
-	pods, err := i.getFilteredPods(filter)
+	pods, err := i.getFilteredPods(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
@@ -383,7 +411,7 @@ func (i *Internal) FilterablePods(writer http.ResponseWriter, request *http.Requ
 	fmt.Fprintf(writer, string(buf))
 }
 
-func (i *Internal) getFilteredConfigMaps(filter map[string]string) ([]ConfigMapInfo, error) {
+func (i *Internal) getFilteredConfigMaps(filter map[string]string, r *redactor) ([]ConfigMapInfo, error) {
 	cmList, err := i.configmapsList(i.ViceNamespace, filter)
 	if err != nil {
 		return nil, err
@@ -393,6 +421,9 @@ func (i *Internal) getFilteredConfigMaps(filter map[string]string) ([]ConfigMapI
 
 	for _, cm := range cmList.Items {
 		info := configMapInfo(&cm)
+		if r != nil {
+			r.configMapInfo(info)
+		}
 		cms = append(cms, *info)
 	}
 
@@ -403,9 +434,15 @@ func (i *Internal) getFilteredConfigMaps(filter map[string]string) ([]ConfigMapI
 func (i *Internal) FilterableConfigMaps(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
+
+	r, status, err := i.listingRedactor(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
 
-	cms, err := i.getFilteredConfigMaps(filter)
+	cms, err := i.getFilteredConfigMaps(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
@@ -443,7 +480,7 @@ func (i *Internal) getFilteredServices(filter map[string]string) ([]ServiceInfo,
 func (i *Internal) FilterableServices(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
 
 	svcs, err := i.getFilteredServices(filter)
 	if err != nil {
@@ -483,7 +520,7 @@ func (i *Internal) getFilteredIngresses(filter map[string]string) ([]IngressInfo
 func (i *Internal) FilterableIngresses(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
 
 	ingresses, err := i.getFilteredIngresses(filter)
 	if err != nil {
@@ -517,21 +554,27 @@ type ResourceInfo struct {
 func (i *Internal) FilterableResources(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	filter := filterMap(request.URL.Query())
+	filter := listingFilter(request)
+
+	r, status, err := i.listingRedactor(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
 
-	deployments, err := i.getFilteredDeployments(filter)
+	deployments, err := i.getFilteredDeployments(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pods, err := i.getFilteredPods(filter)
+	pods, err := i.getFilteredPods(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	cms, err := i.getFilteredConfigMaps(filter)
+	cms, err := i.getFilteredConfigMaps(filter, r)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
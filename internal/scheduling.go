@@ -0,0 +1,518 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultNodePoolLabel is the node label that node pools are selected with if
+// the scheduling policy doesn't set one.
+const defaultNodePoolLabel = "vice-node-pool"
+
+// TolerationSpec is a toleration read from the scheduling policy.
+type TolerationSpec struct {
+	Key      string `mapstructure:"key" json:"key"`
+	Operator string `mapstructure:"operator" json:"operator,omitempty"`
+	Value    string `mapstructure:"value" json:"value,omitempty"`
+	Effect   string `mapstructure:"effect" json:"effect,omitempty"`
+}
+
+// toleration returns the apiv1.Toleration for the spec. The operator defaults
+// to Equal.
+func (t TolerationSpec) toleration() apiv1.Toleration {
+	operator := t.Operator
+	if operator == "" {
+		operator = string(apiv1.TolerationOpEqual)
+	}
+	return apiv1.Toleration{
+		Key:      t.Key,
+		Operator: apiv1.TolerationOperator(operator),
+		Value:    t.Value,
+		Effect:   apiv1.TaintEffect(t.Effect),
+	}
+}
+
+// TopologySpreadSpec is a topology spread constraint read from the scheduling
+// policy. The analysis pod is spread against the pods that have the same
+// values for the labels listed in LabelKeys, which defaults to app-type so
+// that all VICE analyses are spread evenly.
+type TopologySpreadSpec struct {
+	TopologyKey       string   `mapstructure:"topology-key" json:"topology_key"`
+	MaxSkew           int32    `mapstructure:"max-skew" json:"max_skew,omitempty"`
+	WhenUnsatisfiable string   `mapstructure:"when-unsatisfiable" json:"when_unsatisfiable,omitempty"`
+	LabelKeys         []string `mapstructure:"label-keys" json:"label_keys,omitempty"`
+}
+
+// constraint returns the apiv1.TopologySpreadConstraint for the spec, using
+// the pod labels to build the label selector.
+func (t TopologySpreadSpec) constraint(podLabels map[string]string) apiv1.TopologySpreadConstraint {
+	maxSkew := t.MaxSkew
+	if maxSkew < 1 {
+		maxSkew = 1
+	}
+
+	when := t.WhenUnsatisfiable
+	if when == "" {
+		when = string(apiv1.ScheduleAnyway)
+	}
+
+	keys := t.LabelKeys
+	if len(keys) == 0 {
+		keys = []string{"app-type"}
+	}
+
+	matchLabels := map[string]string{}
+	for _, key := range keys {
+		matchLabels[key] = podLabels[key]
+	}
+
+	return apiv1.TopologySpreadConstraint{
+		MaxSkew:           maxSkew,
+		TopologyKey:       t.TopologyKey,
+		WhenUnsatisfiable: apiv1.UnsatisfiableConstraintAction(when),
+		LabelSelector: &metav1.LabelSelector{
+			MatchLabels: matchLabels,
+		},
+	}
+}
+
+// SchedulingSettings controls where an analysis pod is placed in the cluster.
+type SchedulingSettings struct {
+	NodePool       string               `mapstructure:"node-pool" json:"node_pool,omitempty"`
+	Tolerations    []TolerationSpec     `mapstructure:"tolerations" json:"tolerations,omitempty"`
+	Affinity       []NodeAffinityTerm   `mapstructure:"affinity" json:"affinity,omitempty"`
+	PriorityClass  string               `mapstructure:"priority-class" json:"priority_class,omitempty"`
+	TopologySpread []TopologySpreadSpec `mapstructure:"topology-spread" json:"topology_spread,omitempty"`
+}
+
+// isEmpty returns true if none of the settings are set.
+func (s SchedulingSettings) isEmpty() bool {
+	return s.NodePool == "" &&
+		len(s.Tolerations) == 0 &&
+		len(s.Affinity) == 0 &&
+		s.PriorityClass == "" &&
+		len(s.TopologySpread) == 0
+}
+
+// merge returns the settings with the overrides applied on top of them. The
+// node pool and priority class are replaced if they're set in the overrides,
+// everything else is added to.
+func (s SchedulingSettings) merge(o SchedulingSettings) SchedulingSettings {
+	merged := SchedulingSettings{
+		NodePool:      s.NodePool,
+		PriorityClass: s.PriorityClass,
+	}
+
+	if o.NodePool != "" {
+		merged.NodePool = o.NodePool
+	}
+	if o.PriorityClass != "" {
+		merged.PriorityClass = o.PriorityClass
+	}
+
+	merged.Tolerations = append(append([]TolerationSpec{}, s.Tolerations...), o.Tolerations...)
+	merged.Affinity = append(append([]NodeAffinityTerm{}, s.Affinity...), o.Affinity...)
+	merged.TopologySpread = append(append([]TopologySpreadSpec{}, s.TopologySpread...), o.TopologySpread...)
+
+	return merged
+}
+
+// ResourceProfile describes the size of an analysis. Scheduling rules can
+// match on the profiles that a job falls into rather than on individual apps.
+type ResourceProfile struct {
+	MinCPUCores float64  `mapstructure:"min-cpu-cores" json:"min_cpu_cores,omitempty"`
+	MinMemory   string   `mapstructure:"min-memory" json:"min_memory,omitempty"`
+	GPU         bool     `mapstructure:"gpu" json:"gpu,omitempty"`
+	GPUModels   []string `mapstructure:"gpu-models" json:"gpu_models,omitempty"`
+}
+
+// matches returns true if an analysis with the given resource limits and GPU
+// model falls into the profile.
+func (p ResourceProfile) matches(resources ResourceAmounts, gpuModel string) bool {
+	if resources.CPUCores < p.MinCPUCores {
+		return false
+	}
+
+	if p.MinMemory != "" {
+		minMemory, err := resourcev1.ParseQuantity(p.MinMemory)
+		if err != nil || resources.MemoryBytes < minMemory.Value() {
+			return false
+		}
+	}
+
+	if (p.GPU || len(p.GPUModels) > 0) && resources.GPUs == 0 {
+		return false
+	}
+
+	if len(p.GPUModels) > 0 && !containsFold(p.GPUModels, gpuModel) {
+		return false
+	}
+
+	return true
+}
+
+// SchedulingRule applies its settings to the analyses that match all of the
+// criteria that are set. A rule without any criteria matches every analysis.
+type SchedulingRule struct {
+	Name     string   `mapstructure:"name" json:"name"`
+	AppIDs   []string `mapstructure:"app-ids" json:"app_ids,omitempty"`
+	Users    []string `mapstructure:"users" json:"users,omitempty"`
+	Profiles []string `mapstructure:"profiles" json:"profiles,omitempty"`
+
+	SchedulingSettings `mapstructure:",squash"`
+}
+
+// matches returns true if the rule applies to the analysis.
+func (r SchedulingRule) matches(appID, user string, profiles []string) bool {
+	if len(r.AppIDs) > 0 && !containsFold(r.AppIDs, appID) {
+		return false
+	}
+
+	if len(r.Users) > 0 {
+		found := false
+		for _, u := range r.Users {
+			if normalizeSharingUser(u) == normalizeSharingUser(user) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Profiles) > 0 {
+		found := false
+		for _, p := range profiles {
+			if containsFold(r.Profiles, p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SchedulingPolicy maps apps, users, and resource profiles to the node pools,
+// tolerations, node affinity, priority classes, and topology spread
+// constraints used for their analyses. The Default settings apply to every
+// analysis and the GPU settings apply to every analysis that uses a GPU. The
+// matching rules are then applied in order.
+type SchedulingPolicy struct {
+	NodePoolLabel string                     `mapstructure:"node-pool-label" json:"node_pool_label,omitempty"`
+	Default       SchedulingSettings         `mapstructure:"default" json:"default"`
+	GPU           SchedulingSettings         `mapstructure:"gpu" json:"gpu"`
+	Profiles      map[string]ResourceProfile `mapstructure:"profiles" json:"profiles,omitempty"`
+	Rules         []SchedulingRule           `mapstructure:"rules" json:"rules,omitempty"`
+}
+
+// builtinSchedulingPolicy returns the policy that's used if no policy file is
+// configured. VICE analyses go on the nodes set aside for VICE, and analyses
+// that use GPUs go on the GPU nodes.
+func builtinSchedulingPolicy() *SchedulingPolicy {
+	policy := &SchedulingPolicy{}
+	policy.applyDefaults()
+	return policy
+}
+
+// applyDefaults fills in the settings that the policy doesn't set with the
+// built-in ones.
+func (p *SchedulingPolicy) applyDefaults() {
+	if p.NodePoolLabel == "" {
+		p.NodePoolLabel = defaultNodePoolLabel
+	}
+
+	if p.Default.isEmpty() {
+		p.Default = SchedulingSettings{
+			Tolerations: []TolerationSpec{
+				{
+					Key:      viceTolerationKey,
+					Operator: viceTolerationOperator,
+					Value:    viceTolerationValue,
+					Effect:   viceTolerationEffect,
+				},
+			},
+			Affinity: []NodeAffinityTerm{
+				{
+					Key:      viceAffinityKey,
+					Operator: viceAffinityOperator,
+					Values:   []string{viceAffinityValue},
+				},
+			},
+		}
+	}
+
+	if p.GPU.isEmpty() {
+		p.GPU = SchedulingSettings{
+			Tolerations: []TolerationSpec{
+				{
+					Key:      gpuTolerationKey,
+					Operator: gpuTolerationOperator,
+					Value:    gpuTolerationValue,
+					Effect:   gpuTolerationEffect,
+				},
+			},
+			Affinity: []NodeAffinityTerm{
+				{
+					Key:      gpuAffinityKey,
+					Operator: gpuAffinityOperator,
+					Values:   []string{gpuAffinityValue},
+				},
+			},
+		}
+	}
+}
+
+var (
+	validTolerationOperators = []string{"", string(apiv1.TolerationOpEqual), string(apiv1.TolerationOpExists)}
+	validTaintEffects        = []string{"", string(apiv1.TaintEffectNoSchedule), string(apiv1.TaintEffectPreferNoSchedule), string(apiv1.TaintEffectNoExecute)}
+	validAffinityOperators   = []string{
+		"",
+		string(apiv1.NodeSelectorOpIn),
+		string(apiv1.NodeSelectorOpNotIn),
+		string(apiv1.NodeSelectorOpExists),
+		string(apiv1.NodeSelectorOpDoesNotExist),
+		string(apiv1.NodeSelectorOpGt),
+		string(apiv1.NodeSelectorOpLt),
+	}
+	validUnsatisfiableActions = []string{"", string(apiv1.DoNotSchedule), string(apiv1.ScheduleAnyway)}
+)
+
+func validateSchedulingSettings(name string, s SchedulingSettings) error {
+	for _, t := range s.Tolerations {
+		if !containsString(validTolerationOperators, t.Operator) {
+			return fmt.Errorf("%s: invalid toleration operator %s", name, t.Operator)
+		}
+		if !containsString(validTaintEffects, t.Effect) {
+			return fmt.Errorf("%s: invalid toleration effect %s", name, t.Effect)
+		}
+	}
+
+	for _, a := range s.Affinity {
+		if a.Key == "" {
+			return fmt.Errorf("%s: node affinity terms need a key", name)
+		}
+		if !containsString(validAffinityOperators, a.Operator) {
+			return fmt.Errorf("%s: invalid node affinity operator %s", name, a.Operator)
+		}
+	}
+
+	for _, t := range s.TopologySpread {
+		if t.TopologyKey == "" {
+			return fmt.Errorf("%s: topology spread constraints need a topology-key", name)
+		}
+		if !containsString(validUnsatisfiableActions, t.WhenUnsatisfiable) {
+			return fmt.Errorf("%s: invalid when-unsatisfiable value %s", name, t.WhenUnsatisfiable)
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if the policy contains settings that k8s would
+// reject or rules that refer to profiles that don't exist.
+func (p *SchedulingPolicy) validate() error {
+	if err := validateSchedulingSettings("default", p.Default); err != nil {
+		return err
+	}
+	if err := validateSchedulingSettings("gpu", p.GPU); err != nil {
+		return err
+	}
+
+	for name, profile := range p.Profiles {
+		if profile.MinMemory != "" {
+			if _, err := resourcev1.ParseQuantity(profile.MinMemory); err != nil {
+				return errors.Wrapf(err, "profile %s: invalid min-memory", name)
+			}
+		}
+	}
+
+	for idx, rule := range p.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", idx)
+		}
+		for _, profile := range rule.Profiles {
+			if _, ok := p.Profiles[strings.ToLower(profile)]; !ok {
+				return fmt.Errorf("%s: unknown profile %s", name, profile)
+			}
+		}
+		if err := validateSchedulingSettings(name, rule.SchedulingSettings); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// profilesFor returns the names of the resource profiles that a job using the
+// given resources falls into.
+func (p *SchedulingPolicy) profilesFor(resources ResourceAmounts, gpuModel string) []string {
+	profiles := []string{}
+	for name, profile := range p.Profiles {
+		if profile.matches(resources, gpuModel) {
+			profiles = append(profiles, name)
+		}
+	}
+	return profiles
+}
+
+// settingsFor returns the scheduling settings for the job after applying all
+// of the rules that match it. The gpu may be nil.
+func (p *SchedulingPolicy) settingsFor(job *VICEJob, gpu *GPURequest) SchedulingSettings {
+	settings := p.Default
+
+	var gpuModel string
+	if gpu != nil {
+		settings = settings.merge(p.GPU)
+		settings.Affinity = append(settings.Affinity, gpu.Model.Affinity...)
+		gpuModel = gpu.Name
+	}
+
+	profiles := p.profilesFor(jobResources(job), gpuModel)
+
+	for _, rule := range p.Rules {
+		if rule.matches(job.AppID, job.Submitter, profiles) {
+			settings = settings.merge(rule.SchedulingSettings)
+		}
+	}
+
+	if settings.NodePool != "" {
+		settings.Affinity = append(settings.Affinity, NodeAffinityTerm{
+			Key:      p.NodePoolLabel,
+			Operator: string(apiv1.NodeSelectorOpIn),
+			Values:   []string{settings.NodePool},
+		})
+	}
+
+	return settings
+}
+
+// readSchedulingPolicy reads the scheduling policy from the file at the path.
+// The format is determined by the file extension, like the config file.
+func readSchedulingPolicy(path string) (*SchedulingPolicy, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "error reading the scheduling policy from %s", path)
+	}
+
+	policy := &SchedulingPolicy{}
+	if err := v.Unmarshal(policy); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the scheduling policy in %s", path)
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid scheduling policy in %s", path)
+	}
+
+	policy.applyDefaults()
+
+	return policy, nil
+}
+
+// schedulingPolicy returns the scheduling policy currently in effect.
+func (i *Internal) schedulingPolicy() *SchedulingPolicy {
+	i.schedulingLock.RLock()
+	defer i.schedulingLock.RUnlock()
+
+	if i.scheduling == nil {
+		return builtinSchedulingPolicy()
+	}
+	return i.scheduling
+}
+
+// LoadSchedulingPolicy reads the scheduling policy file and puts it into
+// effect for the analyses launched afterwards. The policy in effect isn't
+// changed if the file can't be read or isn't valid.
+func (i *Internal) LoadSchedulingPolicy() error {
+	policy, err := readSchedulingPolicy(i.SchedulingPolicyFile)
+	if err != nil {
+		return err
+	}
+
+	i.schedulingLock.Lock()
+	defer i.schedulingLock.Unlock()
+	i.scheduling = policy
+
+	return nil
+}
+
+// WatchSchedulingPolicy fires up a goroutine that reloads the scheduling
+// policy whenever the file is modified. The file is polled rather than
+// watched so that updates to a mounted ConfigMap get picked up.
+func (i *Internal) WatchSchedulingPolicy() {
+	go func() {
+		var lastModified time.Time
+		if info, err := os.Stat(i.SchedulingPolicyFile); err == nil {
+			lastModified = info.ModTime()
+		}
+
+		ticker := time.NewTicker(i.SchedulingPolicyReloadInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			info, err := os.Stat(i.SchedulingPolicyFile)
+			if err != nil {
+				log.Error(errors.Wrapf(err, "error checking the scheduling policy file %s", i.SchedulingPolicyFile))
+				continue
+			}
+
+			if !info.ModTime().After(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+
+			if err = i.LoadSchedulingPolicy(); err != nil {
+				log.Error(errors.Wrap(err, "keeping the previous scheduling policy"))
+				continue
+			}
+			log.Infof("reloaded the scheduling policy from %s", i.SchedulingPolicyFile)
+		}
+	}()
+}
+
+// VICESchedulingPolicy returns the scheduling policy currently in effect.
+func (i *Internal) VICESchedulingPolicy(writer http.ResponseWriter, request *http.Request) {
+	buf, err := json.Marshal(i.schedulingPolicy())
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
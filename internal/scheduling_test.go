@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+func TestBuiltinSchedulingPolicy(t *testing.T) {
+	policy := builtinSchedulingPolicy()
+	job := &VICEJob{Job: *testJob(model.Container{})}
+
+	settings := policy.settingsFor(job, nil)
+	if len(settings.Tolerations) != 1 || settings.Tolerations[0].Key != viceTolerationKey {
+		t.Errorf("unexpected tolerations %+v", settings.Tolerations)
+	}
+	if len(settings.Affinity) != 1 || settings.Affinity[0].Key != viceAffinityKey {
+		t.Errorf("unexpected affinity %+v", settings.Affinity)
+	}
+
+	gpu := &GPURequest{
+		Name: "a100",
+		Model: GPUModel{
+			Resource: gpuResourceName,
+			Affinity: []NodeAffinityTerm{{Key: "nvidia.com/gpu.product", Values: []string{"A100"}}},
+		},
+		Count: 1,
+	}
+	settings = policy.settingsFor(job, gpu)
+	if len(settings.Tolerations) != 2 || settings.Tolerations[1].Key != gpuTolerationKey {
+		t.Errorf("unexpected tolerations %+v", settings.Tolerations)
+	}
+	if len(settings.Affinity) != 3 || settings.Affinity[2].Key != "nvidia.com/gpu.product" {
+		t.Errorf("unexpected affinity %+v", settings.Affinity)
+	}
+}
+
+func TestReadSchedulingPolicy(t *testing.T) {
+	policy, err := readSchedulingPolicy("../example-scheduling-policy.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(policy.Rules) != 4 {
+		t.Fatalf("read %d rules, not 4", len(policy.Rules))
+	}
+	if policy.Rules[0].NodePool != "highmem" {
+		t.Errorf("the first rule has node pool %q, not highmem", policy.Rules[0].NodePool)
+	}
+
+	job := &VICEJob{Job: *testJob(model.Container{MaxCPUCores: 32, MemoryLimit: 137438953472})}
+	job.Submitter = "ipcdev"
+
+	// The later matching rule's node pool wins.
+	settings := policy.settingsFor(job, nil)
+	if settings.NodePool != "benchmarking" {
+		t.Errorf("node pool is %q, not benchmarking", settings.NodePool)
+	}
+
+	last := settings.Affinity[len(settings.Affinity)-1]
+	if last.Key != "vice-node-pool" || last.Values[0] != "benchmarking" {
+		t.Errorf("unexpected node pool affinity %+v", last)
+	}
+
+	if len(settings.Tolerations) != 2 || settings.Tolerations[1].Key != "highmem" {
+		t.Errorf("unexpected tolerations %+v", settings.Tolerations)
+	}
+}
+
+func TestSchedulingPolicyValidate(t *testing.T) {
+	policy := &SchedulingPolicy{
+		Rules: []SchedulingRule{
+			{Name: "missing", Profiles: []string{"huge"}},
+		},
+	}
+	if err := policy.validate(); err == nil {
+		t.Error("validate didn't catch the unknown profile")
+	}
+
+	policy = &SchedulingPolicy{
+		Default: SchedulingSettings{
+			Tolerations: []TolerationSpec{{Key: "vice", Effect: "Sometimes"}},
+		},
+	}
+	if err := policy.validate(); err == nil {
+		t.Error("validate didn't catch the invalid toleration effect")
+	}
+}
@@ -0,0 +1,524 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// secretMountEnv and secretMountFile are the ways a user secret can be
+	// made available in the analysis container.
+	secretMountEnv  = "env"
+	secretMountFile = "file"
+
+	// secretMountsAnnotation is the annotation on a user's secret store that
+	// records how each of the secrets is mounted.
+	secretMountsAnnotation = "vice-secret-mounts"
+)
+
+var (
+	secretNameRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+	envVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// builtinEnvVars are the environment variables app-exposer sets in every
+// analysis container. Secrets can't be mounted as any of them.
+var builtinEnvVars = []string{
+	"REDIRECT_URL",
+	"IPLANT_USER",
+	"IPLANT_EXECUTION_ID",
+}
+
+// UserSecret is a named secret that a user has registered, like an API key or
+// a database password. The value is never returned by the API.
+type UserSecret struct {
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	MountAs string `json:"mount_as"`
+	EnvVar  string `json:"env_var,omitempty"`
+}
+
+// secretMount is how a secret is mounted, as recorded in the annotation on
+// the user's secret store.
+type secretMount struct {
+	MountAs string `json:"mount_as"`
+	EnvVar  string `json:"env_var,omitempty"`
+}
+
+// normalize fills in the defaults for the secret and validates it. The name
+// of the environment variable defaults to the upper-cased name of the secret.
+func (s *UserSecret) normalize() error {
+	if !secretNameRegexp.MatchString(s.Name) || s.Name == "." || s.Name == ".." {
+		return fmt.Errorf("secret names may only contain letters, digits, '-', '_', and '.', not %s", s.Name)
+	}
+
+	switch s.MountAs {
+	case "":
+		s.MountAs = secretMountEnv
+	case secretMountEnv, secretMountFile:
+	default:
+		return fmt.Errorf("secrets can be mounted as %s or %s, not %s", secretMountEnv, secretMountFile, s.MountAs)
+	}
+
+	if s.MountAs == secretMountFile {
+		s.EnvVar = ""
+		return nil
+	}
+
+	if s.EnvVar == "" {
+		s.EnvVar = strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(s.Name))
+	}
+	if !envVarNameRegexp.MatchString(s.EnvVar) {
+		return fmt.Errorf("%s is not a valid environment variable name", s.EnvVar)
+	}
+
+	return nil
+}
+
+// userSecretStoreName returns the name of the k8s Secret that holds the
+// secrets registered by the user. Different usernames can have the same slug,
+// so the name ends with a hash of the exact username. The slug is only there
+// to make the name readable.
+func userSecretStoreName(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	prefix := slugString(username)
+	if len(prefix) > 32 {
+		prefix = strings.Trim(prefix[:32], "-")
+	}
+	return fmt.Sprintf("vice-user-secrets-%s-%s", prefix, hex.EncodeToString(sum[:]))
+}
+
+// analysisSecretName returns the name of the k8s Secret that holds the user
+// secrets used by the analysis.
+func analysisSecretName(invocationID string) string {
+	return fmt.Sprintf("vice-secrets-%s", invocationID)
+}
+
+// secretsMountPath returns the directory that file secrets are mounted in in
+// the analysis container.
+func (i *Internal) secretsMountPath() string {
+	if i.SecretsMountPath != "" {
+		return i.SecretsMountPath
+	}
+	return defaultSecretsMountPath
+}
+
+// secretMounts returns the mount settings recorded on the secret store.
+func secretMounts(store *apiv1.Secret) (map[string]secretMount, error) {
+	mounts := map[string]secretMount{}
+	if value, ok := store.Annotations[secretMountsAnnotation]; ok && value != "" {
+		if err := json.Unmarshal([]byte(value), &mounts); err != nil {
+			return nil, errors.Wrapf(err, "error parsing the secret mounts for %s", store.Name)
+		}
+	}
+	return mounts, nil
+}
+
+// userSecrets returns the secrets in the user's secret store, sorted by name.
+// The values are only included if withValues is true.
+func userSecrets(store *apiv1.Secret, withValues bool) ([]UserSecret, error) {
+	mounts, err := secretMounts(store)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []UserSecret{}
+	for name, value := range store.Data {
+		s := UserSecret{
+			Name:    name,
+			MountAs: mounts[name].MountAs,
+			EnvVar:  mounts[name].EnvVar,
+		}
+		if withValues {
+			s.Value = string(value)
+		}
+		if err = s.normalize(); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, s)
+	}
+
+	sort.Slice(secrets, func(a, b int) bool {
+		return secrets[a].Name < secrets[b].Name
+	})
+
+	return secrets, nil
+}
+
+// secretsForJob looks up the user secrets requested by the job in the user's
+// secret store. It fails if any of them haven't been registered.
+func (i *Internal) secretsForJob(job *VICEJob) ([]UserSecret, error) {
+	if len(job.Secrets) == 0 {
+		return nil, nil
+	}
+
+	store, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(userSecretStoreName(job.Submitter), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%s has not registered any secrets", job.Submitter)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the secrets registered by %s", job.Submitter)
+	}
+
+	registered, err := userSecrets(store, true)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]UserSecret{}
+	for _, s := range registered {
+		byName[s.Name] = s
+	}
+
+	secrets := []UserSecret{}
+	for _, name := range job.Secrets {
+		s, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has not registered a secret named %s", job.Submitter, name)
+		}
+		if s.MountAs == secretMountEnv && setsEnvVar(&job.Job, s.EnvVar) {
+			return nil, fmt.Errorf("secret %s can't be mounted as %s, which is already set in the analysis", name, s.EnvVar)
+		}
+		secrets = append(secrets, s)
+	}
+
+	return secrets, nil
+}
+
+// setsEnvVar returns true if the environment variable is one that's set in the
+// analysis container regardless of the secrets the job asks for.
+func setsEnvVar(job *model.Job, name string) bool {
+	if containsString(builtinEnvVars, name) {
+		return true
+	}
+	for _, step := range job.Steps {
+		if _, ok := step.Environment[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getAnalysisSecret assembles the k8s Secret containing the user secrets for
+// the analysis. It does not call the k8s API.
+func (i *Internal) getAnalysisSecret(job *model.Job, secrets []UserSecret) (*apiv1.Secret, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{}
+	for _, s := range secrets {
+		data[s.Name] = []byte(s.Value)
+	}
+
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   analysisSecretName(job.InvocationID),
+			Labels: labels,
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: data,
+	}, nil
+}
+
+// UpsertAnalysisSecret copies the user secrets requested by the job into a
+// Secret for the analysis. The Secret is labeled with the external ID so it's
+// removed when the analysis exits.
+func (i *Internal) UpsertAnalysisSecret(job *VICEJob) error {
+	secrets, err := i.secretsForJob(job)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	secret, err := i.getAnalysisSecret(&job.Job, secrets)
+	if err != nil {
+		return err
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	_, err = secretclient.Get(secret.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = secretclient.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = secretclient.Update(secret)
+	return err
+}
+
+// secretEnvironment returns the environment variables for the user secrets
+// that are mounted as environment variables.
+func secretEnvironment(job *model.Job, secrets []UserSecret) []apiv1.EnvVar {
+	env := []apiv1.EnvVar{}
+	for _, s := range secrets {
+		if s.MountAs != secretMountEnv {
+			continue
+		}
+		env = append(env, apiv1.EnvVar{
+			Name: s.EnvVar,
+			ValueFrom: &apiv1.EnvVarSource{
+				SecretKeyRef: &apiv1.SecretKeySelector{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: analysisSecretName(job.InvocationID),
+					},
+					Key: s.Name,
+				},
+			},
+		})
+	}
+	return env
+}
+
+// secretsVolume returns the Volume for the user secrets that are mounted as
+// files, or nil if there aren't any.
+func secretsVolume(job *model.Job, secrets []UserSecret) *apiv1.Volume {
+	items := []apiv1.KeyToPath{}
+	for _, s := range secrets {
+		if s.MountAs == secretMountFile {
+			items = append(items, apiv1.KeyToPath{Key: s.Name, Path: s.Name})
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	return &apiv1.Volume{
+		Name: secretsVolumeName,
+		VolumeSource: apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{
+				SecretName: analysisSecretName(job.InvocationID),
+				Items:      items,
+			},
+		},
+	}
+}
+
+// usernameFromRequest returns the value of the user query parameter. An error
+// is written to the response and an empty string is returned if it's not set.
+func usernameFromRequest(writer http.ResponseWriter, request *http.Request) string {
+	user := request.URL.Query().Get("user")
+	if user == "" {
+		http.Error(writer, "user is not set", http.StatusForbidden)
+		return ""
+	}
+	return user
+}
+
+// VICEListSecrets lists the secrets registered by a user. The values of the
+// secrets are not included.
+//
+// Query Parameters:
+//   user - Required. The user that registered the secrets.
+func (i *Internal) VICEListSecrets(writer http.ResponseWriter, request *http.Request) {
+	username := usernameFromRequest(writer, request)
+	if username == "" {
+		return
+	}
+
+	secrets := []UserSecret{}
+
+	store, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(userSecretStoreName(username), metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		if secrets, err = userSecrets(store, false); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	buf, err := json.Marshal(map[string][]UserSecret{
+		"secrets": secrets,
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
+
+// VICEPutSecret registers a secret for a user, or replaces it if the user has
+// already registered a secret with the same name. Analyses that are already
+// running keep the old value.
+//
+// Query Parameters:
+//   user - Required. The user registering the secret.
+func (i *Internal) VICEPutSecret(writer http.ResponseWriter, request *http.Request) {
+	username := usernameFromRequest(writer, request)
+	if username == "" {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := UserSecret{}
+	if err = json.Unmarshal(body, &secret); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret.Name = mux.Vars(request)["name"]
+
+	if err = secret.normalize(); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if secret.Value == "" {
+		http.Error(writer, "value is not set", http.StatusBadRequest)
+		return
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	name := userSecretStoreName(username)
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		store, err := secretclient.Get(name, metav1.GetOptions{})
+		create := k8serrors.IsNotFound(err)
+		if err != nil && !create {
+			return err
+		}
+		if create {
+			store = &apiv1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Labels: map[string]string{
+						secretStoreLabel: secretStoreLabelValue,
+						"username":       slugString(username),
+					},
+				},
+				Type: apiv1.SecretTypeOpaque,
+			}
+		}
+
+		mounts, err := secretMounts(store)
+		if err != nil {
+			return err
+		}
+		mounts[secret.Name] = secretMount{MountAs: secret.MountAs, EnvVar: secret.EnvVar}
+
+		mountsJSON, err := json.Marshal(mounts)
+		if err != nil {
+			return err
+		}
+
+		if store.Annotations == nil {
+			store.Annotations = map[string]string{}
+		}
+		store.Annotations[secretMountsAnnotation] = string(mountsJSON)
+
+		if store.Data == nil {
+			store.Data = map[string][]byte{}
+		}
+		store.Data[secret.Name] = []byte(secret.Value)
+
+		if create {
+			_, err = secretclient.Create(store)
+		} else {
+			_, err = secretclient.Update(store)
+		}
+		return err
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secret.Value = ""
+	buf, err := json.Marshal(secret)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
+
+// VICEDeleteSecret removes a secret registered by a user. Analyses that are
+// already running keep their copy of it.
+//
+// Query Parameters:
+//   user - Required. The user that registered the secret.
+func (i *Internal) VICEDeleteSecret(writer http.ResponseWriter, request *http.Request) {
+	username := usernameFromRequest(writer, request)
+	if username == "" {
+		return
+	}
+
+	secretName := mux.Vars(request)["name"]
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	name := userSecretStoreName(username)
+
+	found := true
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		store, err := secretclient.Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			found = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, ok := store.Data[secretName]; !ok {
+			found = false
+			return nil
+		}
+		delete(store.Data, secretName)
+
+		mounts, err := secretMounts(store)
+		if err != nil {
+			return err
+		}
+		delete(mounts, secretName)
+
+		mountsJSON, err := json.Marshal(mounts)
+		if err != nil {
+			return err
+		}
+		if store.Annotations == nil {
+			store.Annotations = map[string]string{}
+		}
+		store.Annotations[secretMountsAnnotation] = string(mountsJSON)
+
+		_, err = secretclient.Update(store)
+		return err
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(writer, fmt.Sprintf("%s has not registered a secret named %s", username, secretName), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/cyverse-de/model.v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestUserSecretNormalize(t *testing.T) {
+	s := UserSecret{Name: "api-key.prod"}
+	if err := s.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if s.MountAs != secretMountEnv || s.EnvVar != "API_KEY_PROD" {
+		t.Errorf("unexpected defaults %+v", s)
+	}
+
+	s = UserSecret{Name: "db-password", MountAs: secretMountFile, EnvVar: "IGNORED"}
+	if err := s.normalize(); err != nil || s.EnvVar != "" {
+		t.Errorf("normalize returned %+v, %v for a file secret", s, err)
+	}
+
+	for _, bad := range []UserSecret{
+		{Name: "../etc"},
+		{Name: "."},
+		{Name: ".."},
+		{Name: "key", MountAs: "volume"},
+		{Name: "key", EnvVar: "1KEY"},
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Errorf("normalize didn't fail for %+v", bad)
+		}
+	}
+}
+
+func TestUserSecretStoreName(t *testing.T) {
+	// These usernames have the same slug.
+	a := userSecretStoreName("Tester")
+	b := userSecretStoreName("tester")
+	if a == b {
+		t.Errorf("the secret stores for different users are both named %s", a)
+	}
+	if !strings.HasPrefix(b, "vice-user-secrets-tester-") {
+		t.Errorf("unexpected secret store name %s", b)
+	}
+	if name := userSecretStoreName(strings.Repeat("a", 300)); len(name) > 253 {
+		t.Errorf("the secret store name %s is too long", name)
+	}
+}
+
+func TestRegisterAndMountSecrets(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+		},
+		clientset: fake.NewSimpleClientset(),
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/vice/secrets/{name}", i.VICEPutSecret).Methods("PUT")
+	router.HandleFunc("/vice/secrets/{name}", i.VICEDeleteSecret).Methods("DELETE")
+
+	for name, body := range map[string]string{
+		"token":    `{"value": "abc"}`,
+		"password": `{"value": "xyz", "mount_as": "file"}`,
+		"unused":   `{"value": "123"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/vice/secrets/"+name+"?user=tester", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("registering %s returned %d: %s", name, rec.Code, rec.Body.String())
+		}
+		if strings.Contains(rec.Body.String(), "value") {
+			t.Errorf("the value of %s was returned: %s", name, rec.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/vice/secrets/unused?user=tester", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deleting a secret returned %d", rec.Code)
+	}
+
+	job := &VICEJob{Job: *testJob(model.Container{}), Secrets: []string{"token", "password"}}
+	job.Submitter = "tester"
+	job.InvocationID = "job"
+
+	secrets, err := i.secretsForJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := secretEnvironment(&job.Job, secrets)
+	if len(env) != 1 || env[0].Name != "TOKEN" || env[0].ValueFrom.SecretKeyRef.Name != analysisSecretName("job") {
+		t.Errorf("unexpected environment %+v", env)
+	}
+
+	volume := secretsVolume(&job.Job, secrets)
+	if volume == nil || len(volume.Secret.Items) != 1 || volume.Secret.Items[0].Key != "password" {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+
+	job.Steps[0].Environment = map[string]string{"TOKEN": "from-the-job"}
+	if _, err = i.secretsForJob(job); err == nil {
+		t.Error("secretsForJob didn't fail for a secret overriding the job's environment")
+	}
+	job.Steps[0].Environment = nil
+
+	job.Secrets = []string{"unused"}
+	if _, err = i.secretsForJob(job); err == nil {
+		t.Error("secretsForJob didn't fail for a deleted secret")
+	}
+
+	store, err := i.clientset.CoreV1().Secrets("vice-apps").Get(userSecretStoreName("tester"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Labels[secretStoreLabel] != secretStoreLabelValue {
+		t.Errorf("unexpected labels %v", store.Labels)
+	}
+}
@@ -0,0 +1,389 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// The Pod Security Standards levels, from least to most restrictive.
+const (
+	securityLevelPrivileged = "privileged"
+	securityLevelBaseline   = "baseline"
+	securityLevelRestricted = "restricted"
+)
+
+// defaultSecurityProfileName is the profile used when neither the app nor the
+// config picks one. It leaves the security contexts that app-exposer has always
+// set on the containers alone, so the stricter profiles are opt-in.
+const defaultSecurityProfileName = "default"
+
+const (
+	seccompPodAnnotation             = "seccomp.security.alpha.kubernetes.io/pod"
+	seccompContainerAnnotationPrefix = "container.seccomp.security.alpha.kubernetes.io/"
+	appArmorAnnotationPrefix         = "container.apparmor.security.beta.kubernetes.io/"
+)
+
+// SecurityProfile is a named set of security settings that's applied to all
+// of the containers in an analysis pod. Level is the Pod Security Standard
+// that the pod has to meet, which is checked before it's launched.
+//
+// Seccomp is set with the seccomp annotations, so it takes values like
+// runtime/default or localhost/<profile>. AppArmor takes values like
+// runtime/default or localhost/<profile>.
+type SecurityProfile struct {
+	Level                    string   `mapstructure:"level"`
+	RunAsNonRoot             bool     `mapstructure:"run-as-non-root"`
+	AllowPrivilegeEscalation *bool    `mapstructure:"allow-privilege-escalation"`
+	ReadOnlyRootFilesystem   bool     `mapstructure:"read-only-root-filesystem"`
+	DropCapabilities         []string `mapstructure:"drop-capabilities"`
+	AddCapabilities          []string `mapstructure:"add-capabilities"`
+	Seccomp                  string   `mapstructure:"seccomp"`
+	AppArmor                 string   `mapstructure:"apparmor"`
+}
+
+// builtinSecurityProfiles returns the profiles that are available if none are
+// configured.
+func builtinSecurityProfiles() map[string]SecurityProfile {
+	return map[string]SecurityProfile{
+		defaultSecurityProfileName: {
+			Level: securityLevelBaseline,
+		},
+		"restricted": {
+			Level:                    securityLevelRestricted,
+			RunAsNonRoot:             true,
+			AllowPrivilegeEscalation: boolPtr(false),
+			DropCapabilities:         []string{"ALL"},
+			Seccomp:                  "runtime/default",
+		},
+		"baseline": {
+			Level: securityLevelBaseline,
+			DropCapabilities: []string{
+				"SETPCAP",
+				"AUDIT_WRITE",
+				"KILL",
+				"SYS_CHROOT",
+				"SETFCAP",
+				"FSETID",
+				"NET_RAW",
+			},
+		},
+		"legacy-root": {
+			Level: securityLevelBaseline,
+		},
+	}
+}
+
+// securityProfiles returns the configured security profiles, or the built-in
+// ones if none are configured.
+func (i *Internal) securityProfiles() map[string]SecurityProfile {
+	if len(i.SecurityProfiles) > 0 {
+		return i.SecurityProfiles
+	}
+	return builtinSecurityProfiles()
+}
+
+// securityProfileFor returns the name of the security profile for the job's
+// app along with the profile itself. Apps without a profile of their own get
+// the default profile.
+func (i *Internal) securityProfileFor(job *model.Job) (string, SecurityProfile, error) {
+	name, ok := i.SecurityAppProfiles[strings.ToLower(job.AppID)]
+	if !ok {
+		name = i.SecurityDefaultProfile
+	}
+	if name == "" {
+		name = defaultSecurityProfileName
+	}
+
+	profile, ok := i.securityProfiles()[strings.ToLower(name)]
+	if !ok {
+		return name, SecurityProfile{}, fmt.Errorf("security profile %s is not configured", name)
+	}
+
+	return name, profile, nil
+}
+
+// setsContainerContext returns true if the profile has any settings for the
+// containers. Profiles without any keep the containers' own security contexts.
+func (p SecurityProfile) setsContainerContext() bool {
+	return p.RunAsNonRoot ||
+		p.AllowPrivilegeEscalation != nil ||
+		p.ReadOnlyRootFilesystem ||
+		len(p.DropCapabilities) > 0 ||
+		len(p.AddCapabilities) > 0
+}
+
+// containerSecurityContext returns the SecurityContext for a container in an
+// analysis pod that runs as the given user and group.
+func (p SecurityProfile) containerSecurityContext(uid int64) *apiv1.SecurityContext {
+	ctx := &apiv1.SecurityContext{
+		RunAsUser:                int64Ptr(uid),
+		RunAsGroup:               int64Ptr(uid),
+		AllowPrivilegeEscalation: p.AllowPrivilegeEscalation,
+	}
+
+	if p.RunAsNonRoot {
+		ctx.RunAsNonRoot = boolPtr(true)
+	}
+
+	if p.ReadOnlyRootFilesystem {
+		ctx.ReadOnlyRootFilesystem = boolPtr(true)
+	}
+
+	if len(p.DropCapabilities) > 0 || len(p.AddCapabilities) > 0 {
+		ctx.Capabilities = &apiv1.Capabilities{}
+		for _, c := range p.DropCapabilities {
+			ctx.Capabilities.Drop = append(ctx.Capabilities.Drop, apiv1.Capability(strings.ToUpper(c)))
+		}
+		for _, c := range p.AddCapabilities {
+			ctx.Capabilities.Add = append(ctx.Capabilities.Add, apiv1.Capability(strings.ToUpper(c)))
+		}
+	}
+
+	return ctx
+}
+
+// podAnnotations returns the seccomp and AppArmor annotations for a pod with
+// the named containers.
+func (p SecurityProfile) podAnnotations(containerNames []string) map[string]string {
+	annotations := map[string]string{}
+
+	if p.Seccomp != "" {
+		annotations[seccompPodAnnotation] = p.Seccomp
+	}
+
+	if p.AppArmor != "" {
+		for _, name := range containerNames {
+			annotations[appArmorAnnotationPrefix+name] = p.AppArmor
+		}
+	}
+
+	return annotations
+}
+
+// applySecurityProfile sets the security contexts of the pod and all of its
+// containers according to the profile, and returns the annotations that need
+// to be added to the pod. The containers keep their own security contexts if
+// the profile doesn't have any settings for them.
+func applySecurityProfile(spec *apiv1.PodSpec, profile SecurityProfile, uid int64) map[string]string {
+	names := []string{}
+	override := profile.setsContainerContext()
+
+	for idx := range spec.InitContainers {
+		if override {
+			spec.InitContainers[idx].SecurityContext = profile.containerSecurityContext(uid)
+		}
+		names = append(names, spec.InitContainers[idx].Name)
+	}
+
+	for idx := range spec.Containers {
+		if override {
+			spec.Containers[idx].SecurityContext = profile.containerSecurityContext(uid)
+		}
+		names = append(names, spec.Containers[idx].Name)
+	}
+
+	spec.SecurityContext = &apiv1.PodSecurityContext{
+		RunAsUser:  int64Ptr(uid),
+		RunAsGroup: int64Ptr(uid),
+		FSGroup:    int64Ptr(uid),
+	}
+	if profile.RunAsNonRoot {
+		spec.SecurityContext.RunAsNonRoot = boolPtr(true)
+	}
+
+	return profile.podAnnotations(names)
+}
+
+// securityLevelRank returns the position of the level in the list of levels
+// from least to most restrictive, or -1 if the level isn't known.
+func securityLevelRank(level string) int {
+	switch strings.ToLower(level) {
+	case securityLevelPrivileged:
+		return 0
+	case securityLevelBaseline:
+		return 1
+	case securityLevelRestricted:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// The capabilities that containers may add under the baseline standard.
+var baselineCapabilities = []string{
+	"AUDIT_WRITE",
+	"CHOWN",
+	"DAC_OVERRIDE",
+	"FOWNER",
+	"FSETID",
+	"KILL",
+	"MKNOD",
+	"NET_BIND_SERVICE",
+	"SETFCAP",
+	"SETGID",
+	"SETPCAP",
+	"SETUID",
+	"SYS_CHROOT",
+}
+
+func allContainers(spec *apiv1.PodSpec) []apiv1.Container {
+	return append(append([]apiv1.Container{}, spec.InitContainers...), spec.Containers...)
+}
+
+// checkBaseline returns an error if the pod doesn't meet the baseline Pod
+// Security Standard.
+func checkBaseline(spec *apiv1.PodSpec, annotations map[string]string) error {
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		return fmt.Errorf("host namespaces are not allowed")
+	}
+
+	for _, v := range spec.Volumes {
+		if v.HostPath != nil {
+			return fmt.Errorf("volume %s is a hostPath volume, which is not allowed", v.Name)
+		}
+	}
+
+	for key, value := range annotations {
+		if key == seccompPodAnnotation || strings.HasPrefix(key, seccompContainerAnnotationPrefix) {
+			if value == "unconfined" {
+				return fmt.Errorf("the unconfined seccomp profile is not allowed")
+			}
+		}
+		if strings.HasPrefix(key, appArmorAnnotationPrefix) {
+			if value != "runtime/default" && !strings.HasPrefix(value, "localhost/") {
+				return fmt.Errorf("AppArmor profile %s is not allowed", value)
+			}
+		}
+	}
+
+	for _, c := range allContainers(spec) {
+		for _, p := range c.Ports {
+			if p.HostPort != 0 {
+				return fmt.Errorf("container %s uses a host port, which is not allowed", c.Name)
+			}
+		}
+
+		if c.SecurityContext == nil {
+			continue
+		}
+
+		if c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged {
+			return fmt.Errorf("container %s is privileged, which is not allowed", c.Name)
+		}
+
+		if c.SecurityContext.Capabilities != nil {
+			for _, add := range c.SecurityContext.Capabilities.Add {
+				if !containsString(baselineCapabilities, string(add)) {
+					return fmt.Errorf("container %s adds the %s capability, which is not allowed", c.Name, add)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRestricted returns an error if the pod doesn't meet the restricted Pod
+// Security Standard.
+func checkRestricted(spec *apiv1.PodSpec, annotations map[string]string) error {
+	if err := checkBaseline(spec, annotations); err != nil {
+		return err
+	}
+
+	for _, v := range spec.Volumes {
+		if v.ConfigMap == nil && v.EmptyDir == nil && v.PersistentVolumeClaim == nil &&
+			v.Secret == nil && v.Projected == nil && v.DownwardAPI == nil && v.CSI == nil {
+			return fmt.Errorf("volume %s has a type that is not allowed", v.Name)
+		}
+	}
+
+	podNonRoot := spec.SecurityContext != nil && spec.SecurityContext.RunAsNonRoot != nil && *spec.SecurityContext.RunAsNonRoot
+	if spec.SecurityContext != nil && spec.SecurityContext.RunAsUser != nil && *spec.SecurityContext.RunAsUser == 0 {
+		return fmt.Errorf("running as root is not allowed")
+	}
+
+	seccomp := annotations[seccompPodAnnotation]
+
+	for _, c := range allContainers(spec) {
+		ctx := c.SecurityContext
+		if ctx == nil {
+			return fmt.Errorf("container %s has no security context", c.Name)
+		}
+
+		if ctx.AllowPrivilegeEscalation == nil || *ctx.AllowPrivilegeEscalation {
+			return fmt.Errorf("container %s must set allowPrivilegeEscalation to false", c.Name)
+		}
+
+		if !podNonRoot && (ctx.RunAsNonRoot == nil || !*ctx.RunAsNonRoot) {
+			return fmt.Errorf("container %s must run as a non-root user", c.Name)
+		}
+
+		if ctx.RunAsUser != nil && *ctx.RunAsUser == 0 {
+			return fmt.Errorf("container %s runs as root, which is not allowed", c.Name)
+		}
+
+		containerSeccomp := seccomp
+		if s, ok := annotations[seccompContainerAnnotationPrefix+c.Name]; ok {
+			containerSeccomp = s
+		}
+		if containerSeccomp != "runtime/default" && containerSeccomp != "docker/default" && !strings.HasPrefix(containerSeccomp, "localhost/") {
+			return fmt.Errorf("container %s must use the runtime/default or a localhost seccomp profile", c.Name)
+		}
+
+		if ctx.Capabilities == nil || !containsString(capabilityStrings(ctx.Capabilities.Drop), "ALL") {
+			return fmt.Errorf("container %s must drop all capabilities", c.Name)
+		}
+		for _, add := range ctx.Capabilities.Add {
+			if add != "NET_BIND_SERVICE" {
+				return fmt.Errorf("container %s adds the %s capability, which is not allowed", c.Name, add)
+			}
+		}
+	}
+
+	return nil
+}
+
+func capabilityStrings(caps []apiv1.Capability) []string {
+	retval := []string{}
+	for _, c := range caps {
+		retval = append(retval, string(c))
+	}
+	return retval
+}
+
+// checkPodSecurity returns an error if the pod doesn't meet the Pod Security
+// Standard at the given level.
+func checkPodSecurity(level string, spec *apiv1.PodSpec, annotations map[string]string) error {
+	switch securityLevelRank(level) {
+	case 0:
+		return nil
+	case 1:
+		return checkBaseline(spec, annotations)
+	case 2:
+		return checkRestricted(spec, annotations)
+	default:
+		return fmt.Errorf("unknown pod security level %s", level)
+	}
+}
+
+// validatePodSecurity returns an error if the pod doesn't meet the level of
+// the security profile or the configured minimum level, whichever is more
+// restrictive.
+func (i *Internal) validatePodSecurity(profileName string, profile SecurityProfile, spec *apiv1.PodSpec, annotations map[string]string) error {
+	level := profile.Level
+	if level == "" {
+		level = securityLevelBaseline
+	}
+	if securityLevelRank(i.SecurityMinimumLevel) > securityLevelRank(level) {
+		level = i.SecurityMinimumLevel
+	}
+
+	if err := checkPodSecurity(level, spec, annotations); err != nil {
+		return fmt.Errorf("the analysis does not meet the %s pod security standard required by the %s security profile: %s", level, profileName, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func testPodSpec() *apiv1.PodSpec {
+	return &apiv1.PodSpec{
+		InitContainers: []apiv1.Container{{Name: fileTransfersInitContainerName}},
+		Containers: []apiv1.Container{
+			{Name: viceProxyContainerName},
+			{Name: fileTransfersContainerName},
+			{Name: analysisContainerName},
+		},
+		Volumes: []apiv1.Volume{
+			{Name: fileTransfersVolumeName, VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+		},
+	}
+}
+
+func TestApplySecurityProfile(t *testing.T) {
+	profile := builtinSecurityProfiles()["restricted"]
+	spec := testPodSpec()
+
+	annotations := applySecurityProfile(spec, profile, 1000)
+
+	for _, c := range allContainers(spec) {
+		if c.SecurityContext == nil || *c.SecurityContext.RunAsUser != 1000 {
+			t.Errorf("container %s doesn't run as 1000", c.Name)
+		}
+	}
+
+	if annotations[seccompPodAnnotation] != "runtime/default" {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+
+	if err := checkPodSecurity(securityLevelRestricted, spec, annotations); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyDefaultSecurityProfile(t *testing.T) {
+	profile := builtinSecurityProfiles()[defaultSecurityProfileName]
+	spec := testPodSpec()
+	spec.Containers[0].SecurityContext = &apiv1.SecurityContext{
+		Capabilities: &apiv1.Capabilities{Drop: []apiv1.Capability{"SETUID", "MKNOD"}},
+	}
+
+	annotations := applySecurityProfile(spec, profile, 1000)
+
+	ctx := spec.Containers[0].SecurityContext
+	if ctx == nil || len(ctx.Capabilities.Drop) != 2 {
+		t.Errorf("the default profile replaced the container's security context with %+v", ctx)
+	}
+	if spec.Containers[2].SecurityContext != nil {
+		t.Errorf("the default profile set a security context on the analysis container")
+	}
+	if spec.SecurityContext == nil || *spec.SecurityContext.RunAsUser != 1000 || *spec.SecurityContext.FSGroup != 1000 {
+		t.Errorf("unexpected pod security context %+v", spec.SecurityContext)
+	}
+	if len(annotations) != 0 {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+}
+
+func TestCheckPodSecurity(t *testing.T) {
+	profiles := builtinSecurityProfiles()
+
+	// Root is allowed under baseline, but not under restricted.
+	spec := testPodSpec()
+	annotations := applySecurityProfile(spec, profiles["restricted"], 0)
+	if err := checkPodSecurity(securityLevelRestricted, spec, annotations); err == nil {
+		t.Error("a pod running as root passed the restricted check")
+	}
+
+	spec = testPodSpec()
+	annotations = applySecurityProfile(spec, profiles["legacy-root"], 0)
+	if err := checkPodSecurity(securityLevelBaseline, spec, annotations); err != nil {
+		t.Error(err)
+	}
+	if err := checkPodSecurity(securityLevelRestricted, spec, annotations); err == nil {
+		t.Error("the legacy-root profile passed the restricted check")
+	}
+
+	spec = testPodSpec()
+	annotations = applySecurityProfile(spec, SecurityProfile{AddCapabilities: []string{"sys_admin"}}, 1000)
+	if err := checkPodSecurity(securityLevelBaseline, spec, annotations); err == nil {
+		t.Error("a pod adding SYS_ADMIN passed the baseline check")
+	}
+
+	spec = testPodSpec()
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name:         "host",
+		VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/"}},
+	})
+	if err := checkPodSecurity(securityLevelBaseline, spec, map[string]string{}); err == nil {
+		t.Error("a pod with a hostPath volume passed the baseline check")
+	}
+}
+
+func TestSecurityProfileFor(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			SecurityAppProfiles: map[string]string{"app": "legacy-root"},
+		},
+	}
+
+	job := testJob(model.Container{})
+	job.AppID = "app"
+	if name, _, err := i.securityProfileFor(job); err != nil || name != "legacy-root" {
+		t.Errorf("securityProfileFor returned %s, %v for the app with a profile", name, err)
+	}
+
+	job.AppID = "other"
+	if name, _, err := i.securityProfileFor(job); err != nil || name != defaultSecurityProfileName {
+		t.Errorf("securityProfileFor returned %s, %v for an app without a profile", name, err)
+	}
+
+	i.SecurityDefaultProfile = "missing"
+	if _, _, err := i.securityProfileFor(job); err == nil {
+		t.Error("securityProfileFor didn't fail for a missing profile")
+	}
+}
+
+func TestValidatePodSecurityMinimumLevel(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			SecurityMinimumLevel: securityLevelRestricted,
+		},
+	}
+
+	profile := builtinSecurityProfiles()["baseline"]
+	spec := testPodSpec()
+	annotations := applySecurityProfile(spec, profile, 1000)
+
+	if err := i.validatePodSecurity("baseline", profile, spec, annotations); err == nil {
+		t.Error("the baseline profile passed with a restricted minimum level")
+	}
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v4"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// SharingRequest is the body accepted by the endpoint that shares a running
+// VICE analysis with other users.
+type SharingRequest struct {
+	Users []string `json:"users"`
+}
+
+// SharingResponse contains the list of users that a running VICE analysis
+// has been shared with.
+type SharingResponse struct {
+	Users []string `json:"users"`
+}
+
+// sharingConfigMapName returns the name of the ConfigMap containing the list
+// of users that a VICE analysis has been shared with.
+func sharingConfigMapName(invocationID string) string {
+	return fmt.Sprintf("vice-sharing-%s", invocationID)
+}
+
+// sharingConfigMap returns the ConfigMap containing the list of users that
+// the VICE analysis has been shared with. The list starts out empty. This
+// does NOT call the k8s API to actually create the ConfigMap, just returns
+// the object that can be passed to the API.
+func (i *Internal) sharingConfigMap(job *model.Job) (*apiv1.ConfigMap, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   sharingConfigMapName(job.InvocationID),
+			Labels: labels,
+		},
+		Data: map[string]string{
+			sharingFileName: "",
+		},
+	}, nil
+}
+
+// CreateSharingConfigMap creates the ConfigMap that records the users a VICE
+// analysis is shared with. Unlike the other ConfigMaps, an existing one is
+// left alone so that relaunching the deployment doesn't drop any grants.
+func (i *Internal) CreateSharingConfigMap(job *model.Job) error {
+	sharingCM, err := i.sharingConfigMap(job)
+	if err != nil {
+		return err
+	}
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	_, err = cmclient.Get(sharingCM.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = cmclient.Create(sharingCM)
+	}
+	return err
+}
+
+// normalizeSharingUser strips whitespace and the domain suffix from a
+// username, since the vice-proxy compares against the bare CAS username.
+func normalizeSharingUser(user string) string {
+	return strings.TrimSuffix(strings.TrimSpace(user), "@iplantcollaborative.org")
+}
+
+// parseAllowedUsers converts the contents of the allowed users file into a
+// list of usernames.
+func parseAllowedUsers(contents string) []string {
+	users := []string{}
+	for _, line := range strings.Split(contents, "\n") {
+		if u := strings.TrimSpace(line); u != "" {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// formatAllowedUsers converts a list of usernames into the contents of the
+// allowed users file read by the vice-proxy. The usernames are deduplicated
+// and sorted so that the file contents are stable.
+func formatAllowedUsers(users []string) string {
+	seen := map[string]bool{}
+	uniq := []string{}
+	for _, u := range users {
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		uniq = append(uniq, u)
+	}
+	sort.Strings(uniq)
+
+	if len(uniq) == 0 {
+		return ""
+	}
+	return strings.Join(uniq, "\n") + "\n"
+}
+
+// updateAllowedUsers applies modify to the list of users stored in the
+// sharing ConfigMap for the analysis and returns the updated list. The
+// kubelet syncs the change into the running vice-proxy container, so the
+// pod doesn't need to be restarted.
+func (i *Internal) updateAllowedUsers(externalID string, modify func([]string) []string) ([]string, error) {
+	var users []string
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cmclient.Get(sharingConfigMapName(externalID), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+
+		contents := formatAllowedUsers(modify(parseAllowedUsers(cm.Data[sharingFileName])))
+		cm.Data[sharingFileName] = contents
+
+		if _, err = cmclient.Update(cm); err != nil {
+			return err
+		}
+
+		users = parseAllowedUsers(contents)
+		return nil
+	})
+
+	return users, err
+}
+
+// sharingExternalID looks up the external ID for the analysis ID in the
+// request path on behalf of the user in the query string. The returned status
+// code should be used if the error is not nil.
+func (i *Internal) sharingExternalID(request *http.Request) (string, int, error) {
+	analysisID, found := mux.Vars(request)["analysis-id"]
+	if !found || analysisID == "" {
+		return "", http.StatusBadRequest, errors.New("analysis-id parameter is empty")
+	}
+
+	users, found := request.URL.Query()["user"]
+	if !found || len(users) < 1 {
+		return "", http.StatusForbidden, errors.New("user is not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(users[0], analysisID)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	if len(externalIDs) < 1 {
+		return "", http.StatusNotFound, fmt.Errorf("no external-id found for analysis-id %s", analysisID)
+	}
+
+	// For now, just use the first external ID
+	return externalIDs[0], http.StatusOK, nil
+}
+
+func writeSharingResponse(writer http.ResponseWriter, users []string) {
+	if users == nil {
+		users = []string{}
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(&SharingResponse{Users: users}); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func sharingErrorStatus(err error) int {
+	if k8serrors.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// VICEGetSharing lists the users that a running VICE analysis has been shared
+// with.
+func (i *Internal) VICEGetSharing(writer http.ResponseWriter, request *http.Request) {
+	externalID, status, err := i.sharingExternalID(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+
+	cm, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Get(sharingConfigMapName(externalID), metav1.GetOptions{})
+	if err != nil {
+		http.Error(writer, err.Error(), sharingErrorStatus(err))
+		return
+	}
+
+	writeSharingResponse(writer, parseAllowedUsers(cm.Data[sharingFileName]))
+}
+
+// VICEShareAnalysis grants the users listed in the request body access to a
+// running VICE analysis. The users are added to the ones that already have
+// access.
+func (i *Internal) VICEShareAnalysis(writer http.ResponseWriter, request *http.Request) {
+	externalID, status, err := i.sharingExternalID(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sharingReq := &SharingRequest{}
+	if err = json.Unmarshal(buf, sharingReq); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	owner := normalizeSharingUser(request.URL.Query().Get("user"))
+	grants := []string{}
+	for _, u := range sharingReq.Users {
+		if u = normalizeSharingUser(u); u != "" && u != owner {
+			grants = append(grants, u)
+		}
+	}
+
+	if len(grants) == 0 {
+		http.Error(writer, "no users to share the analysis with were provided", http.StatusBadRequest)
+		return
+	}
+
+	users, err := i.updateAllowedUsers(externalID, func(current []string) []string {
+		return append(current, grants...)
+	})
+	if err != nil {
+		http.Error(writer, errors.Wrapf(err, "error sharing analysis %s", externalID).Error(), sharingErrorStatus(err))
+		return
+	}
+
+	log.Infof("analysis %s is now shared with %s", externalID, strings.Join(users, ", "))
+
+	writeSharingResponse(writer, users)
+}
+
+// VICEUnshareAnalysis revokes a user's access to a running VICE analysis.
+func (i *Internal) VICEUnshareAnalysis(writer http.ResponseWriter, request *http.Request) {
+	externalID, status, err := i.sharingExternalID(request)
+	if err != nil {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+
+	revoked := normalizeSharingUser(mux.Vars(request)["shared-user"])
+	if revoked == "" {
+		http.Error(writer, "shared-user parameter is empty", http.StatusBadRequest)
+		return
+	}
+
+	users, err := i.updateAllowedUsers(externalID, func(current []string) []string {
+		kept := []string{}
+		for _, u := range current {
+			if u != revoked {
+				kept = append(kept, u)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		http.Error(writer, errors.Wrapf(err, "error revoking access to analysis %s for %s", externalID, revoked).Error(), sharingErrorStatus(err))
+		return
+	}
+
+	log.Infof("revoked access to analysis %s for %s", externalID, revoked)
+
+	writeSharingResponse(writer, users)
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatAllowedUsers(t *testing.T) {
+	actual := formatAllowedUsers([]string{"bob", "alice", "", "bob"})
+	expected := "alice\nbob\n"
+	if actual != expected {
+		t.Errorf("formatAllowedUsers returned %q, not %q", actual, expected)
+	}
+
+	if actual = formatAllowedUsers([]string{}); actual != "" {
+		t.Errorf("formatAllowedUsers returned %q for an empty list", actual)
+	}
+}
+
+func TestParseAllowedUsers(t *testing.T) {
+	actual := parseAllowedUsers("alice\n\n bob \n")
+	expected := []string{"alice", "bob"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("parseAllowedUsers returned %v, not %v", actual, expected)
+	}
+}
+
+func TestNormalizeSharingUser(t *testing.T) {
+	if actual := normalizeSharingUser(" alice@iplantcollaborative.org"); actual != "alice" {
+		t.Errorf("normalizeSharingUser returned %q, not alice", actual)
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"github.com/cyverse-de/messaging"
 	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -25,6 +27,7 @@ type AnalysisStatusPublisher interface {
 	Fail(jobID, msg string) error
 	Success(jobID, msg string) error
 	Running(jobID, msg string) error
+	Queued(jobID, msg string) error
 }
 
 // JSLPublisher is a concrete implementation of AnalysisStatusPublisher that
@@ -116,8 +119,16 @@ func (j *JSLPublisher) Running(jobID, msg string) error {
 	return j.postStatus(jobID, msg, messaging.RunningState)
 }
 
+// Queued sends an analysis queued status update with the provided message. May be
+// sent multiple times while the analysis waits for capacity to free up.
+func (j *JSLPublisher) Queued(jobID, msg string) error {
+	log.Warnf("Sending queued job status update for external-id %s", jobID)
+	return j.postStatus(jobID, msg, messaging.QueuedState)
+}
+
 // MonitorVICEEvents fires up a goroutine that forwards events from the cluster
-// to the status receiving service (probably job-status-listener).
+// to the status receiving service (probably job-status-listener). It also
+// watches for VICE analysis pods being preempted by the scheduler.
 func (i *Internal) MonitorVICEEvents() {
 	go func(clientset kubernetes.Interface) {
 		for {
@@ -231,6 +242,37 @@ func (i *Internal) MonitorVICEEvents() {
 				},
 			})
 
+			// Events don't have the labels of the object they're about, so
+			// the preemption events get a separate informer.
+			eventFactory := informers.NewSharedInformerFactoryWithOptions(
+				clientset,
+				0,
+				informers.WithNamespace(i.ViceNamespace),
+				informers.WithTweakListOptions(func(listoptions *v1.ListOptions) {
+					listoptions.FieldSelector = fields.OneTermEqualSelector("reason", preemptedEventReason).String()
+				}),
+			)
+
+			eventInformer := eventFactory.Core().V1().Events().Informer()
+
+			eventInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) {
+					log.Debug("add a preemption event")
+
+					event, ok := obj.(*apiv1.Event)
+					if !ok {
+						log.Error(errors.New("unexpected type event object"))
+						return
+					}
+
+					if err := i.eventPreempted(event); err != nil {
+						log.Error(err)
+					}
+				},
+			})
+
+			go eventInformer.Run(deploymentInformerStop)
+
 			deploymentInformer.Run(deploymentInformerStop)
 		}
 	}(i.clientset)
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// The types of storage the file transfer service can download inputs from and
+// upload outputs to.
+const (
+	irodsStorageType = "irods"
+	s3StorageType    = "s3"
+	pvcStorageType   = "pvc"
+)
+
+// defaultStorageBackendName is the name of the storage backend used when a
+// job doesn't pick one and no default backend is configured.
+const defaultStorageBackendName = "irods"
+
+const (
+	storageVolumeName       = "storage"
+	defaultStorageMountPath = "/storage"
+
+	defaultS3AccessKeyKey = "access-key"
+	defaultS3SecretKeyKey = "secret-key"
+)
+
+// StorageBackend is a place the file transfer service running alongside an
+// analysis can move files to and from. Credentials come from a Secret in the
+// VICE namespace and are injected into the file transfer containers in the
+// way the type of backend expects.
+//
+// Every backend is addressed with data store paths, like the ones in the input
+// path list and the upload destination. The file transfer service maps them
+// onto the backend: in S3 the path without its leading slash is the object
+// key, and on a PVC the path is relative to the mount path. Tickets only work
+// with iRODS.
+type StorageBackend struct {
+	// One of irods, s3 or pvc.
+	Type string `mapstructure:"type"`
+
+	// The users who can pick the backend for their analyses. Anyone can use
+	// the default backend, but the others can only be picked by the users
+	// listed here.
+	Users []string `mapstructure:"users"`
+
+	// The Secret with the credentials. For iRODS, it contains the
+	// irods-config.properties file and defaults to porklock-config. For S3,
+	// it contains the access and secret keys. Not used for PVCs.
+	Secret string `mapstructure:"secret"`
+
+	// The S3 settings. Path-style requests and plain HTTP are usually needed
+	// for S3-compatible stand-ins like MinIO.
+	Endpoint     string `mapstructure:"endpoint"`
+	Region       string `mapstructure:"region"`
+	Bucket       string `mapstructure:"bucket"`
+	PathStyle    bool   `mapstructure:"path-style"`
+	Insecure     bool   `mapstructure:"insecure"`
+	AccessKeyKey string `mapstructure:"access-key-key"`
+	SecretKeyKey string `mapstructure:"secret-key-key"`
+
+	// The PersistentVolumeClaim for an NFS share or other volume that files
+	// are copied to and from, and where it's mounted in the file transfer
+	// containers. Each user gets their own directory on the volume, named
+	// after their username, and only that directory is mounted.
+	ClaimName string `mapstructure:"claim-name"`
+	MountPath string `mapstructure:"mount-path"`
+}
+
+// Validate returns an error if the backend is missing settings that its type
+// needs.
+func (b StorageBackend) Validate() error {
+	switch b.Type {
+	case irodsStorageType:
+		return nil
+	case s3StorageType:
+		if b.Bucket == "" {
+			return fmt.Errorf("S3 storage backends need a bucket")
+		}
+		if b.Secret == "" {
+			return fmt.Errorf("S3 storage backends need a secret with the credentials")
+		}
+		return nil
+	case pvcStorageType:
+		if b.ClaimName == "" {
+			return fmt.Errorf("PVC storage backends need a claim-name")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown storage backend type %q", b.Type)
+	}
+}
+
+func (b StorageBackend) secretName() string {
+	if b.Secret == "" && b.Type == irodsStorageType {
+		return porklockConfigSecretName
+	}
+	return b.Secret
+}
+
+func (b StorageBackend) mountPath() string {
+	if b.MountPath == "" {
+		return defaultStorageMountPath
+	}
+	return b.MountPath
+}
+
+// args returns the flags that point the file transfer service at the backend.
+// iRODS is what the service uses when it isn't told otherwise, so iRODS
+// backends only pass along the location of the config file.
+func (b StorageBackend) args() []string {
+	switch b.Type {
+	case s3StorageType:
+		args := []string{
+			"--storage-backend", s3StorageType,
+			"--s3-bucket", b.Bucket,
+		}
+		if b.Endpoint != "" {
+			args = append(args, "--s3-endpoint", b.Endpoint)
+		}
+		if b.Region != "" {
+			args = append(args, "--s3-region", b.Region)
+		}
+		if b.PathStyle {
+			args = append(args, "--s3-path-style")
+		}
+		if b.Insecure {
+			args = append(args, "--s3-insecure")
+		}
+		return args
+	case pvcStorageType:
+		return []string{
+			"--storage-backend", "local",
+			"--storage-root", b.mountPath(),
+		}
+	default:
+		return []string{"--irods-config", irodsConfigFilePath}
+	}
+}
+
+// env returns the environment variables for the file transfer containers. S3
+// credentials are passed in the variables the AWS SDKs read.
+func (b StorageBackend) env() []apiv1.EnvVar {
+	if b.Type != s3StorageType {
+		return nil
+	}
+
+	accessKeyKey := b.AccessKeyKey
+	if accessKeyKey == "" {
+		accessKeyKey = defaultS3AccessKeyKey
+	}
+	secretKeyKey := b.SecretKeyKey
+	if secretKeyKey == "" {
+		secretKeyKey = defaultS3SecretKeyKey
+	}
+
+	secretRef := func(key string) *apiv1.EnvVarSource {
+		return &apiv1.EnvVarSource{
+			SecretKeyRef: &apiv1.SecretKeySelector{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: b.Secret},
+				Key:                  key,
+			},
+		}
+	}
+
+	env := []apiv1.EnvVar{
+		{Name: "AWS_ACCESS_KEY_ID", ValueFrom: secretRef(accessKeyKey)},
+		{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: secretRef(secretKeyKey)},
+	}
+	if b.Region != "" {
+		env = append(env, apiv1.EnvVar{Name: "AWS_REGION", Value: b.Region})
+	}
+	return env
+}
+
+// volumes returns the Volumes the backend needs in the analysis pod.
+func (b StorageBackend) volumes() []apiv1.Volume {
+	switch b.Type {
+	case s3StorageType:
+		return nil
+	case pvcStorageType:
+		return []apiv1.Volume{
+			{
+				Name: storageVolumeName,
+				VolumeSource: apiv1.VolumeSource{
+					PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+						ClaimName: b.ClaimName,
+					},
+				},
+			},
+		}
+	default:
+		return []apiv1.Volume{
+			{
+				Name: porklockConfigVolumeName,
+				VolumeSource: apiv1.VolumeSource{
+					Secret: &apiv1.SecretVolumeSource{
+						SecretName: b.secretName(),
+					},
+				},
+			},
+		}
+	}
+}
+
+// volumeMounts returns the VolumeMounts for the file transfer containers of
+// the user's analysis. Each one corresponds to one of the Volumes returned by
+// volumes().
+func (b StorageBackend) volumeMounts(user string) []apiv1.VolumeMount {
+	switch b.Type {
+	case s3StorageType:
+		return nil
+	case pvcStorageType:
+		return []apiv1.VolumeMount{
+			{
+				Name:      storageVolumeName,
+				MountPath: b.mountPath(),
+				SubPath:   user,
+				ReadOnly:  false,
+			},
+		}
+	default:
+		return []apiv1.VolumeMount{
+			{
+				Name:      porklockConfigVolumeName,
+				MountPath: porklockConfigMountPath,
+				ReadOnly:  true,
+			},
+		}
+	}
+}
+
+// storageBackends returns the configured storage backends. If none are
+// configured, a single iRODS backend using the porklock-config secret is
+// returned.
+func (i *Internal) storageBackends() map[string]StorageBackend {
+	if len(i.StorageBackends) > 0 {
+		return i.StorageBackends
+	}
+	return map[string]StorageBackend{
+		defaultStorageBackendName: {Type: irodsStorageType},
+	}
+}
+
+// allows returns true if the user can pick the backend.
+func (b StorageBackend) allows(user string) bool {
+	for _, u := range b.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// storageBackend returns the storage backend the job picked, or the default
+// one. Returns an error if the job picks a backend that isn't configured or
+// that the submitter isn't allowed to use, or if the backend can't handle the
+// job's inputs.
+func (i *Internal) storageBackend(job *VICEJob) (StorageBackend, error) {
+	defaultName := strings.ToLower(i.StorageDefaultBackend)
+	if defaultName == "" {
+		defaultName = defaultStorageBackendName
+	}
+
+	name := strings.ToLower(job.StorageBackend)
+	if name == "" {
+		name = defaultName
+	}
+
+	backend, ok := i.storageBackends()[name]
+	if !ok {
+		return StorageBackend{}, fmt.Errorf("storage backend %s is not available", name)
+	}
+
+	if name != defaultName && !backend.allows(job.Submitter) {
+		return StorageBackend{}, fmt.Errorf("%s isn't allowed to use storage backend %s", job.Submitter, name)
+	}
+
+	// The volume is mounted at the directory named after the user, so the
+	// username has to be a single path element.
+	if backend.Type == pvcStorageType {
+		if job.Submitter == "" || job.Submitter == "." || job.Submitter == ".." || strings.Contains(job.Submitter, "/") {
+			return StorageBackend{}, fmt.Errorf("storage backend %s can't be used by %q", name, job.Submitter)
+		}
+	}
+
+	if backend.Type != irodsStorageType && len(job.FilterInputsWithTickets()) > 0 {
+		return StorageBackend{}, fmt.Errorf("inputs with tickets can't be downloaded from storage backend %s", name)
+	}
+
+	return backend, nil
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStorageBackendValidate(t *testing.T) {
+	valid := []StorageBackend{
+		{Type: irodsStorageType},
+		{Type: s3StorageType, Bucket: "vice-data", Secret: "minio-credentials"},
+		{Type: pvcStorageType, ClaimName: "vice-nfs-data"},
+	}
+	for _, b := range valid {
+		if err := b.Validate(); err != nil {
+			t.Errorf("valid %s backend rejected: %s", b.Type, err)
+		}
+	}
+
+	invalid := []StorageBackend{
+		{Type: "ftp"},
+		{Type: s3StorageType, Secret: "minio-credentials"},
+		{Type: s3StorageType, Bucket: "vice-data"},
+		{Type: pvcStorageType},
+	}
+	for _, b := range invalid {
+		if err := b.Validate(); err == nil {
+			t.Errorf("invalid backend accepted: %+v", b)
+		}
+	}
+}
+
+func TestStorageBackendDefault(t *testing.T) {
+	i := &Internal{}
+
+	backend, err := i.storageBackend(&VICEJob{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Join(backend.args(), " ")
+	if args != "--irods-config "+irodsConfigFilePath {
+		t.Errorf("unexpected args for the default backend: %s", args)
+	}
+
+	volumes := backend.volumes()
+	if len(volumes) != 1 || volumes[0].Secret == nil || volumes[0].Secret.SecretName != porklockConfigSecretName {
+		t.Errorf("unexpected volumes for the default backend: %+v", volumes)
+	}
+
+	if _, err = i.storageBackend(&VICEJob{StorageBackend: "minio"}); err == nil {
+		t.Error("a backend that isn't configured was returned")
+	}
+}
+
+func TestS3StorageBackend(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			StorageBackends: map[string]StorageBackend{
+				"minio": {
+					Type:      s3StorageType,
+					Endpoint:  "http://minio:9000",
+					Bucket:    "vice-data",
+					PathStyle: true,
+					Secret:    "minio-credentials",
+				},
+			},
+			StorageDefaultBackend: "minio",
+		},
+	}
+
+	backend, err := i.storageBackend(&VICEJob{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Join(backend.args(), " ")
+	for _, expected := range []string{"--storage-backend s3", "--s3-bucket vice-data", "--s3-endpoint http://minio:9000", "--s3-path-style"} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("%q is missing from the args %q", expected, args)
+		}
+	}
+
+	env := backend.env()
+	if len(env) != 2 {
+		t.Fatalf("unexpected env %+v", env)
+	}
+	ref := env[1].ValueFrom.SecretKeyRef
+	if env[1].Name != "AWS_SECRET_ACCESS_KEY" || ref.Name != "minio-credentials" || ref.Key != defaultS3SecretKeyKey {
+		t.Errorf("unexpected secret access key env %+v", env[1])
+	}
+
+	if len(backend.volumes()) != 0 || len(backend.volumeMounts("user")) != 0 {
+		t.Error("an S3 backend has volumes")
+	}
+}
+
+func TestPVCStorageBackend(t *testing.T) {
+	backend := StorageBackend{Type: pvcStorageType, ClaimName: "vice-nfs-data"}
+
+	volumes := backend.volumes()
+	if len(volumes) != 1 || volumes[0].PersistentVolumeClaim == nil || volumes[0].PersistentVolumeClaim.ClaimName != "vice-nfs-data" {
+		t.Errorf("unexpected volumes %+v", volumes)
+	}
+
+	mounts := backend.volumeMounts("user")
+	if len(mounts) != 1 || mounts[0].Name != volumes[0].Name || mounts[0].MountPath != defaultStorageMountPath || mounts[0].SubPath != "user" {
+		t.Errorf("unexpected volume mounts %+v", mounts)
+	}
+
+	if args := strings.Join(backend.args(), " "); args != "--storage-backend local --storage-root "+defaultStorageMountPath {
+		t.Errorf("unexpected args %s", args)
+	}
+}
+
+func TestStorageBackendUsers(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			StorageBackends: map[string]StorageBackend{
+				"irods": {Type: irodsStorageType},
+				"nfs":   {Type: pvcStorageType, ClaimName: "vice-nfs-data", Users: []string{"allowed"}},
+			},
+		},
+	}
+
+	job := func(user, backend string) *VICEJob {
+		j := &VICEJob{StorageBackend: backend}
+		j.Submitter = user
+		return j
+	}
+
+	if _, err := i.storageBackend(job("allowed", "nfs")); err != nil {
+		t.Errorf("a listed user couldn't pick the backend: %s", err)
+	}
+	if _, err := i.storageBackend(job("other", "nfs")); err == nil {
+		t.Error("a user who isn't listed picked the backend")
+	}
+	if _, err := i.storageBackend(job("other", "irods")); err != nil {
+		t.Errorf("the default backend was refused: %s", err)
+	}
+
+	// Anyone can use the default backend, but a PVC is only mounted at a
+	// directory named after the user.
+	i.StorageDefaultBackend = "nfs"
+	if _, err := i.storageBackend(job("other", "")); err != nil {
+		t.Errorf("the default backend was refused: %s", err)
+	}
+	if _, err := i.storageBackend(job("..", "")); err == nil {
+		t.Error("a username that isn't a single path element was accepted for a PVC backend")
+	}
+}
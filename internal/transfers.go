@@ -1,18 +1,22 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"gopkg.in/cyverse-de/model.v4"
 
-	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 
 	apiv1 "k8s.io/api/core/v1"
@@ -37,10 +41,145 @@ const (
 	CompletedStatus = "completed"
 )
 
-type transferResponse struct {
-	UUID   string `json:"uuid"`
-	Status string `json:"status"`
-	Kind   string `json:"kind"`
+// progressMilestoneStep is the percentage between the progress updates sent to
+// the job status listener while a transfer is running.
+const progressMilestoneStep = 25
+
+// TransferFileError is a file that couldn't be transferred.
+type TransferFileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Transfer contains the details of a file transfer reported by the file
+// transfer service running alongside an analysis. The progress fields are
+// only filled in by versions of the service that report them.
+type Transfer struct {
+	UUID        string              `json:"uuid"`
+	Status      string              `json:"status"`
+	Kind        string              `json:"kind"`
+	FilesTotal  int                 `json:"files_total,omitempty"`
+	FilesDone   int                 `json:"files_done,omitempty"`
+	BytesTotal  int64               `json:"bytes_total,omitempty"`
+	BytesDone   int64               `json:"bytes_done,omitempty"`
+	CurrentFile string              `json:"current_file,omitempty"`
+	FileErrors  []TransferFileError `json:"file_errors,omitempty"`
+	Percent     int                 `json:"percent"`
+}
+
+// percent returns how far along the transfer is. The byte counts are used if
+// they're available, otherwise the file counts are. Returns -1 if the transfer
+// service doesn't report either of them.
+func (t *Transfer) percent() int {
+	switch {
+	case t.Status == CompletedStatus:
+		return 100
+	case t.BytesTotal > 0:
+		return int(t.BytesDone * 100 / t.BytesTotal)
+	case t.FilesTotal > 0:
+		return t.FilesDone * 100 / t.FilesTotal
+	default:
+		return -1
+	}
+}
+
+// milestone returns the last milestone the transfer has reached, or 0 if it
+// hasn't reached one yet.
+func (t *Transfer) milestone() int {
+	pct := t.percent()
+	if pct < 0 {
+		return 0
+	}
+	return pct / progressMilestoneStep * progressMilestoneStep
+}
+
+// progressMessage returns the status message for a transfer that has reached
+// a milestone.
+func progressMessage(kind, id string, t *Transfer) string {
+	msg := fmt.Sprintf("%s is %d%% complete for job %s", kind, t.milestone(), id)
+	if t.FilesTotal > 0 {
+		msg = fmt.Sprintf("%s (%d of %d files)", msg, t.FilesDone, t.FilesTotal)
+	}
+	if len(t.FileErrors) > 0 {
+		msg = fmt.Sprintf("%s, %d failed", msg, len(t.FileErrors))
+	}
+	return msg
+}
+
+// UploadOptions narrows down the files uploaded by a save-output-files request
+// and where they go. The paths and globs are relative to the working directory
+// of the analysis. The files in the excludes file are never uploaded.
+type UploadOptions struct {
+	// Only the files matching at least one of these globs are uploaded.
+	Include []string `json:"include,omitempty"`
+
+	// The files matching any of these globs aren't uploaded.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Only these files and directories are uploaded.
+	Paths []string `json:"paths,omitempty"`
+
+	// The folder in the data store the files are uploaded to instead of the
+	// output folder of the analysis. It has to be in the home folder of the
+	// user that launched the analysis.
+	Destination string `json:"destination,omitempty"`
+}
+
+// validRelativePath returns an error if the path isn't relative to the
+// working directory or points outside of it.
+func validRelativePath(p string) error {
+	if p == "" || path.IsAbs(p) {
+		return fmt.Errorf("%q must be a path relative to the working directory", p)
+	}
+	if clean := path.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%q points outside of the working directory", p)
+	}
+	return nil
+}
+
+// validate returns an error if the options can't be passed along to the file
+// transfer service. The home folder is the data store folder of the user that
+// launched the analysis, which the destination has to be in.
+func (o *UploadOptions) validate(home string) error {
+	for _, glob := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if err := validRelativePath(glob); err != nil {
+			return err
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", glob)
+		}
+	}
+
+	for _, p := range o.Paths {
+		if err := validRelativePath(p); err != nil {
+			return err
+		}
+	}
+
+	if o.Destination != "" {
+		if !path.IsAbs(o.Destination) {
+			return fmt.Errorf("the destination %q must be an absolute path in the data store", o.Destination)
+		}
+		if !inFolder(path.Clean(o.Destination), home) {
+			return fmt.Errorf("the destination %q must be in the home folder of the user that launched the analysis", o.Destination)
+		}
+	}
+
+	return nil
+}
+
+// inFolder returns true if the cleaned path is the folder or is inside of it.
+func inFolder(p, folder string) bool {
+	if folder == "" || !path.IsAbs(folder) {
+		return false
+	}
+	folder = path.Clean(folder)
+	return p == folder || strings.HasPrefix(p, strings.TrimSuffix(folder, "/")+"/")
+}
+
+// empty returns true if none of the options are set.
+func (o *UploadOptions) empty() bool {
+	return len(o.Include) == 0 && len(o.Exclude) == 0 && len(o.Paths) == 0 && o.Destination == ""
 }
 
 // fileTransferMountPath returns the path to the directory containing file inputs.
@@ -49,7 +188,7 @@ func fileTransfersMountPath(job *model.Job) string {
 }
 
 // fileTransferCommand returns a []string containing the command to fire up the vice-file-transfers service.
-func fileTransferCommand(job *model.Job) []string {
+func fileTransferCommand(job *model.Job, backend StorageBackend) []string {
 	retval := []string{
 		"/vice-file-transfers",
 		"--listen-port", "60001",
@@ -57,9 +196,9 @@ func fileTransferCommand(job *model.Job) []string {
 		"--excludes-file", path.Join(excludesMountPath, excludesFileName),
 		"--path-list-file", path.Join(inputPathListMountPath, inputPathListFileName),
 		"--upload-destination", job.OutputDirectory(),
-		"--irods-config", irodsConfigFilePath,
-		"--invocation-id", job.InvocationID,
 	}
+	retval = append(retval, backend.args()...)
+	retval = append(retval, "--invocation-id", job.InvocationID)
 	for _, fm := range job.FileMetadata {
 		retval = append(retval, fm.Argument()...)
 	}
@@ -69,13 +208,8 @@ func fileTransferCommand(job *model.Job) []string {
 // fileTransferVolumeMounts returns the list of VolumeMounts needed by the fileTransfer
 // container in the VICE analysis pod. Each VolumeMount should correspond to one of the
 // Volumes returned by the deploymentVolumes() function. This does not call the k8s API.
-func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount {
-	retval := []apiv1.VolumeMount{
-		{
-			Name:      porklockConfigVolumeName,
-			MountPath: porklockConfigMountPath,
-			ReadOnly:  true,
-		},
+func (i *Internal) fileTransfersVolumeMounts(job *model.Job, backend StorageBackend) []apiv1.VolumeMount {
+	retval := append(backend.volumeMounts(job.Submitter), []apiv1.VolumeMount{
 		{
 			Name:      fileTransfersVolumeName,
 			MountPath: fileTransfersInputsMountPath,
@@ -86,7 +220,7 @@ func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount
 			MountPath: excludesMountPath,
 			ReadOnly:  true,
 		},
-	}
+	}...)
 
 	if len(job.FilterInputsWithoutTickets()) > 0 {
 		retval = append(retval, apiv1.VolumeMount{
@@ -99,84 +233,128 @@ func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount
 	return retval
 }
 
-func requestTransfer(svc apiv1.Service, reqpath string) (*transferResponse, error) {
-	var (
-		bodybytes []byte
-		bodyerr   error
-		jsonerr   error
-		err       error
-	)
+// transferServiceError is returned when the file transfer service responds
+// with an error status.
+type transferServiceError struct {
+	method     string
+	url        string
+	statusCode int
+}
 
-	xferresp := &transferResponse{}
-	svcurl := url.URL{}
+func (e *transferServiceError) Error() string {
+	return fmt.Sprintf("%s %s returned %d", e.method, e.url, e.statusCode)
+}
 
-	svcurl.Scheme = "http"
-	svcurl.Host = fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort)
-	svcurl.Path = reqpath
+// isTransferNotFound returns true if the file transfer service doesn't know
+// about the transfer.
+func isTransferNotFound(err error) bool {
+	serr, ok := errors.Cause(err).(*transferServiceError)
+	return ok && serr.statusCode == http.StatusNotFound
+}
 
-	resp, posterr := http.Post(svcurl.String(), "", nil)
-	if posterr != nil {
-		return nil, errors.Wrapf(posterr, "error POSTing to %s", svcurl.String())
-	}
-	if resp == nil {
-		return nil, fmt.Errorf("response from %s was nil", svcurl.String())
+// httpClient returns the client used to talk to the file transfer services.
+func (i *Internal) httpClient() *http.Client {
+	if i.transferClient != nil {
+		return i.transferClient
 	}
+	return http.DefaultClient
+}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 399 {
-		return nil, errors.Wrapf(posterr, "download request to %s returned %d", svcurl.String(), resp.StatusCode)
+// callTransferService sends a request to the file transfer service behind the
+// Service. If the body isn't nil, it's sent as JSON. If the result isn't nil,
+// the JSON response is decoded into it. Each request is limited to the
+// configured request timeout.
+func (i *Internal) callTransferService(ctx context.Context, method string, svc apiv1.Service, reqpath string, body, result interface{}) error {
+	svcurl := url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort),
+		Path:   reqpath,
 	}
 
-	if bodybytes, bodyerr = ioutil.ReadAll(resp.Body); err != nil {
-		return nil, errors.Wrapf(bodyerr, "reading body from %s failed", svcurl.String())
+	var reqbody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "error marshalling the transfer options")
+		}
+		reqbody = bytes.NewReader(buf)
 	}
 
-	if jsonerr = json.Unmarshal(bodybytes, xferresp); jsonerr != nil {
-		return nil, errors.Wrapf(jsonerr, "error unmarshalling json from %s", svcurl.String())
+	req, err := http.NewRequest(method, svcurl.String(), reqbody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	return xferresp, nil
-}
+	if i.TransferRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.TransferRequestTimeout)
+		defer cancel()
+	}
 
-func getTransferDetails(id string, svc apiv1.Service, reqpath string) (*transferResponse, error) {
-	var (
-		bodybytes []byte
-		bodyerr   error
-		jsonerr   error
-		err       error
-	)
+	resp, err := i.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "error on %s %s", method, svcurl.String())
+	}
+	defer resp.Body.Close()
 
-	xferresp := &transferResponse{}
-	svcurl := url.URL{}
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return &transferServiceError{method: method, url: svcurl.String(), statusCode: resp.StatusCode}
+	}
 
-	svcurl.Scheme = "http"
-	svcurl.Host = fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort)
-	svcurl.Path = reqpath
+	if result == nil {
+		return nil
+	}
 
-	resp, posterr := http.Get(svcurl.String())
-	if posterr != nil {
-		return nil, errors.Wrapf(posterr, "error on GET %s", svcurl.String())
+	respbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "reading body from %s failed", svcurl.String())
 	}
-	if resp == nil {
-		return nil, fmt.Errorf("response from GET %s was nil", svcurl.String())
+
+	if err = json.Unmarshal(respbody, result); err != nil {
+		return errors.Wrapf(err, "error unmarshalling json from %s", svcurl.String())
 	}
 
-	defer resp.Body.Close()
+	return nil
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 399 {
-		return nil, errors.Wrapf(posterr, "status request to %s returned %d", svcurl.String(), resp.StatusCode)
+// requestTransfer asks the file transfer service to start a transfer. If the
+// options aren't nil, they're sent as the JSON body of the request.
+func (i *Internal) requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string, options interface{}) (*Transfer, error) {
+	xferresp := &Transfer{}
+	if err := i.callTransferService(ctx, http.MethodPost, svc, reqpath, options, xferresp); err != nil {
+		return nil, err
 	}
+	return xferresp, nil
+}
 
-	if bodybytes, bodyerr = ioutil.ReadAll(resp.Body); err != nil {
-		return nil, errors.Wrapf(bodyerr, "reading body from %s failed", svcurl.String())
+// getTransferDetails returns the details of a transfer from the file transfer
+// service.
+func (i *Internal) getTransferDetails(ctx context.Context, svc apiv1.Service, reqpath string) (*Transfer, error) {
+	xferresp := &Transfer{}
+	if err := i.callTransferService(ctx, http.MethodGet, svc, reqpath, nil, xferresp); err != nil {
+		return nil, err
 	}
+	return xferresp, nil
+}
 
-	if jsonerr = json.Unmarshal(bodybytes, xferresp); jsonerr != nil {
-		return nil, errors.Wrapf(jsonerr, "error unmarshalling json from %s", svcurl.String())
+// listTransfers returns the transfers of one kind known to the file transfer
+// service.
+func (i *Internal) listTransfers(ctx context.Context, svc apiv1.Service, reqpath string) ([]Transfer, error) {
+	listing := struct {
+		Transfers []Transfer `json:"transfers"`
+	}{}
+	if err := i.callTransferService(ctx, http.MethodGet, svc, reqpath, nil, &listing); err != nil {
+		return nil, err
 	}
+	return listing.Transfers, nil
+}
 
-	return xferresp, nil
+// cancelTransfer asks the file transfer service to stop a transfer.
+func (i *Internal) cancelTransfer(ctx context.Context, svc apiv1.Service, reqpath string) error {
+	return i.callTransferService(ctx, http.MethodDelete, svc, reqpath, nil, nil)
 }
 
 func isFinished(status string) bool {
@@ -190,159 +368,466 @@ func isFinished(status string) bool {
 	}
 }
 
-// doFileTransfer handles requests to initial file transfers for a VICE
-// analysis. We only need the ID of the job, nothing is required in the
-// body of the request.
-func (i *Internal) doFileTransfer(request *http.Request, reqpath, kind string, async bool) error {
-	id := mux.Vars(request)["id"]
+// trackedTransfer is a transfer this app-exposer instance is following, along
+// with the analysis it belongs to.
+type trackedTransfer struct {
+	externalID string
+	cancel     context.CancelFunc
+}
 
-	log.Infof("starting %s transfers for job %s", kind, id)
+// trackTransfer records the function that cancels a running transfer for the
+// analysis.
+func (i *Internal) trackTransfer(externalID, uuid string, cancel context.CancelFunc) {
+	i.transfersLock.Lock()
+	defer i.transfersLock.Unlock()
 
-	// Make sure that the list of services only comes from the VICE namespace.
-	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+	if i.transfers == nil {
+		i.transfers = map[string]trackedTransfer{}
+	}
+	i.transfers[uuid] = trackedTransfer{externalID: externalID, cancel: cancel}
+}
 
-	// Filter the list of services so only those tagged with an external-id are
-	// returned. external-id is the job ID assigned by the apps service and is
-	// not the same as the analysis ID.
-	set := labels.Set(map[string]string{
-		"external-id": id,
-	})
+// untrackTransfer forgets a transfer that has stopped running.
+func (i *Internal) untrackTransfer(uuid string) {
+	i.transfersLock.Lock()
+	defer i.transfersLock.Unlock()
 
-	svclist, err := svcclient.List(metav1.ListOptions{
-		LabelSelector: set.AsSelector().String(),
-	})
+	delete(i.transfers, uuid)
+}
+
+// stopTransfer cancels the context of a transfer this app-exposer instance is
+// running for the analysis. Returns false if it isn't running one with the
+// UUID, or if the transfer belongs to a different analysis.
+func (i *Internal) stopTransfer(externalID, uuid string) bool {
+	i.transfersLock.Lock()
+	defer i.transfersLock.Unlock()
+
+	t, ok := i.transfers[uuid]
+	if !ok || t.externalID != externalID {
+		return false
+	}
+	t.cancel()
+	return true
+}
+
+// transferPollInterval returns how long to wait between checks on a running
+// transfer.
+func (i *Internal) transferPollInterval() time.Duration {
+	if i.TransferPollInterval > 0 {
+		return i.TransferPollInterval
+	}
+	return 5 * time.Second
+}
+
+// publishRunning sends a status update for the job, logging any errors.
+func (i *Internal) publishRunning(id, msg string) {
+	if err := i.statusPublisher.Running(id, msg); err != nil {
+		log.Error(err)
+	}
+}
+
+// transferTimeout returns how long a transfer can run before it's stopped.
+func (i *Internal) transferTimeout() time.Duration {
+	if i.TransferTimeout > 0 {
+		return i.TransferTimeout
+	}
+	return 12 * time.Hour
+}
+
+// transferContext returns the context a transfer runs in, which ends when the
+// transfer timeout passes.
+func (i *Internal) transferContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, i.transferTimeout())
+}
+
+// runTransfer starts a transfer in the file transfer service behind the
+// Service and polls it until it finishes, the configured transfer timeout
+// passes, or it's cancelled.
+func (i *Internal) runTransfer(ctx context.Context, svc apiv1.Service, id, reqpath, kind string, options interface{}) error {
+	ctx, cancel := i.transferContext(ctx)
+	defer cancel()
+
+	log.Infof("%s transfer for %s", kind, id)
+
+	transferObj, err := i.requestTransfer(ctx, svc, reqpath, options)
 	if err != nil {
 		return err
 	}
 
-	if len(svclist.Items) < 1 {
-		return fmt.Errorf("no services with a label of 'external-id=%s' were found", id)
-	}
+	return i.followTransfer(ctx, cancel, svc, id, reqpath, kind, transferObj)
+}
 
-	// It's technically possibly for multiple services to provide file transfer services,
-	// so we should block until all of them are complete. We're using a WaitGroup to
-	// coordinate the file transfers, since they occur in separate goroutines.
-	var wg sync.WaitGroup
+// resumeTransfer waits for the transfer of the kind that the file transfer
+// service behind the Service is already running, if there is one. Otherwise,
+// a new transfer is started.
+func (i *Internal) resumeTransfer(ctx context.Context, svc apiv1.Service, id, reqpath, kind string, options interface{}) error {
+	listed, err := i.listTransfers(ctx, svc, reqpath)
+	if err != nil {
+		return err
+	}
 
-	for _, svc := range svclist.Items {
-		if !async {
-			wg.Add(1)
+	for idx := range listed {
+		if !listed[idx].isRunning() {
+			continue
 		}
 
-		go func(svc apiv1.Service) {
-			if !async {
-				defer wg.Done()
-			}
+		log.Infof("waiting for the %s transfer %s already running for %s", kind, listed[idx].UUID, id)
 
-			log.Infof("%s transfer for %s", kind, id)
+		ctx, cancel := i.transferContext(ctx)
+		defer cancel()
+		return i.followTransfer(ctx, cancel, svc, id, reqpath, kind, &listed[idx])
+	}
 
-			transferObj, xfererr := requestTransfer(svc, reqpath)
-			if xfererr != nil {
-				log.Error(xfererr)
-				err = xfererr
-				return
-			}
+	return i.runTransfer(ctx, svc, id, reqpath, kind, options)
+}
 
-			currentStatus := transferObj.Status
+// followTransfer polls a transfer that the file transfer service has started
+// until it finishes or the context is done. The transfer can be stopped with
+// the cancel function while it's being followed.
+func (i *Internal) followTransfer(ctx context.Context, cancel context.CancelFunc, svc apiv1.Service, id, reqpath, kind string, transferObj *Transfer) error {
+	var err error
 
-			var (
-				sentUploadStatus   = false
-				sentDownloadStatus = false
-			)
+	uuid := transferObj.UUID
+	i.trackTransfer(id, uuid, cancel)
+	defer i.untrackTransfer(uuid)
 
-			for !isFinished(currentStatus) {
-				// Set it again here to catch the new values set farther down.
-				currentStatus = transferObj.Status
+	var (
+		sentUploadStatus   = false
+		sentDownloadStatus = false
+		lastMilestone      = 0
+	)
 
-				switch currentStatus {
-				case FailedStatus:
-					msg := fmt.Sprintf("%s failed for job %s", kind, id)
+	for {
+		switch transferObj.Status {
+		case FailedStatus:
+			msg := fmt.Sprintf("%s failed for job %s", kind, id)
+			log.Error(msg)
+			i.publishRunning(id, msg)
+			return errors.New(msg)
+
+		case CompletedStatus:
+			msg := fmt.Sprintf("%s succeeded for job %s", kind, id)
+			log.Info(msg)
+			i.publishRunning(id, msg)
+			return nil
+
+		case RequestedStatus:
+			i.publishRunning(id, fmt.Sprintf("%s requested for job %s", kind, id))
+
+		case UploadingStatus:
+			if !sentUploadStatus {
+				msg := fmt.Sprintf("%s is in progress for job %s", kind, id)
+				log.Info(msg)
+				i.publishRunning(id, msg)
+				sentUploadStatus = true
+			}
 
-					err = errors.New(msg)
+		case DownloadingStatus:
+			if !sentDownloadStatus {
+				msg := fmt.Sprintf("%s is in progress for job %s", kind, id)
+				log.Info(msg)
+				i.publishRunning(id, msg)
+				sentDownloadStatus = true
+			}
 
-					log.Error(err)
+		default:
+			return fmt.Errorf("unknown status from %s: %s", svc.Spec.ClusterIP, transferObj.Status)
+		}
 
-					if failerr := i.statusPublisher.Running(id, msg); failerr != nil {
-						log.Error(failerr)
-					}
+		if m := transferObj.milestone(); m > lastMilestone && m < 100 {
+			msg := progressMessage(kind, id, transferObj)
+			log.Info(msg)
+			i.publishRunning(id, msg)
+			lastMilestone = m
+		}
 
-					return
-				case CompletedStatus:
-					msg := fmt.Sprintf("%s succeeded for job %s", kind, id)
+		select {
+		case <-ctx.Done():
+			return i.abandonTransfer(ctx, svc, id, path.Join(reqpath, uuid), kind)
+		case <-time.After(i.transferPollInterval()):
+		}
 
-					log.Info(msg)
+		transferObj, err = i.getTransferDetails(ctx, svc, path.Join(reqpath, uuid))
+		if err != nil {
+			if ctx.Err() != nil {
+				return i.abandonTransfer(ctx, svc, id, path.Join(reqpath, uuid), kind)
+			}
+			return errors.Wrapf(err, "error getting transfer details for transfer %s", uuid)
+		}
+	}
+}
 
-					if successerr := i.statusPublisher.Running(id, msg); successerr != nil {
-						log.Error(successerr)
-					}
+// abandonTransfer asks the file transfer service to stop a transfer whose
+// context is done and returns the reason it was stopped.
+func (i *Internal) abandonTransfer(ctx context.Context, svc apiv1.Service, id, reqpath, kind string) error {
+	var msg string
+	if ctx.Err() == context.DeadlineExceeded {
+		msg = fmt.Sprintf("%s timed out for job %s", kind, id)
+	} else {
+		msg = fmt.Sprintf("%s was cancelled for job %s", kind, id)
+	}
 
-					return
-				case RequestedStatus:
-					msg := fmt.Sprintf("%s requested for job %s", kind, id)
+	log.Error(msg)
+	i.publishRunning(id, msg)
 
-					if requestederr := i.statusPublisher.Running(id, msg); requestederr != nil {
-						log.Error(err)
-					}
+	// The transfer's own context is done, so a new one is needed to tell
+	// the file transfer service to stop.
+	if err := i.cancelTransfer(context.Background(), svc, reqpath); err != nil && !isTransferNotFound(err) {
+		log.Error(errors.Wrapf(err, "error stopping %s %s for job %s", kind, reqpath, id))
+	}
 
-					break
-				case UploadingStatus:
-					if !sentUploadStatus {
-						msg := fmt.Sprintf("%s is in progress for job %s", kind, id)
+	return errors.New(msg)
+}
 
-						log.Info(msg)
+// transferErrors collects the errors from transfers running in separate
+// goroutines.
+type transferErrors struct {
+	lock sync.Mutex
+	errs []error
+}
 
-						if uploadingerr := i.statusPublisher.Running(id, msg); uploadingerr != nil {
-							log.Error(err)
-						}
+func (t *transferErrors) add(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.errs = append(t.errs, err)
+}
 
-						sentUploadStatus = true
-					}
-					break
-				case DownloadingStatus:
-					if !sentDownloadStatus {
-						msg := fmt.Sprintf("%s is in progress for job %s", kind, id)
+// err returns an error describing all of the failed transfers, or nil if none
+// of them failed.
+func (t *transferErrors) err(total int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-						log.Info(msg)
+	if len(t.errs) == 0 {
+		return nil
+	}
 
-						if downloadingerr := i.statusPublisher.Running(id, msg); downloadingerr != nil {
-							log.Error(err)
-						}
+	msgs := make([]string, len(t.errs))
+	for idx, err := range t.errs {
+		msgs[idx] = err.Error()
+	}
+	return fmt.Errorf("%d of %d transfers failed: %s", len(t.errs), total, strings.Join(msgs, "; "))
+}
 
-						sentDownloadStatus = true
-					}
-					break
-				default:
-					err = fmt.Errorf("unknown status from %s: %s", svc.Spec.ClusterIP, transferObj.Status)
+// doFileTransfer handles requests to initial file transfers for a VICE
+// analysis. We only need the ID of the job, nothing is required in the
+// body of the request. If async is true, the transfers keep running in the
+// background after it returns and their errors are only logged.
+func (i *Internal) doFileTransfer(id, reqpath, kind string, options interface{}, async bool) error {
+	log.Infof("starting %s transfers for job %s", kind, id)
+	return i.transferAll(id, kind, async, func(svc apiv1.Service) error {
+		return i.runTransfer(context.Background(), svc, id, reqpath, kind, options)
+	})
+}
 
-					log.Error(err)
+// resumeFileTransfer waits for the transfers of the kind that are already
+// running for the analysis, starting new ones for the file transfer services
+// that aren't running one. It's used to pick up where an app-exposer instance
+// that went away left off.
+func (i *Internal) resumeFileTransfer(id, reqpath, kind string) error {
+	log.Infof("resuming %s transfers for job %s", kind, id)
+	return i.transferAll(id, kind, false, func(svc apiv1.Service) error {
+		return i.resumeTransfer(context.Background(), svc, id, reqpath, kind, nil)
+	})
+}
 
-					return // return and not break because we want to fail out
-				}
+// transferAll calls run for each of the file transfer services for the
+// analysis in separate goroutines. If async is false, it waits for all of them
+// to finish and returns an error describing the ones that failed.
+func (i *Internal) transferAll(id, kind string, async bool, run func(apiv1.Service) error) error {
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		return err
+	}
 
-				fullreqpath := path.Join(reqpath, transferObj.UUID)
+	if len(svcs) < 1 {
+		return fmt.Errorf("no services with a label of 'external-id=%s' were found", id)
+	}
 
-				transferObj, xfererr = getTransferDetails(transferObj.UUID, svc, fullreqpath)
-				if xfererr != nil {
-					log.Error(errors.Wrapf(xfererr, "error gettinjg transfer details for transferObj %s", transferObj.UUID))
-					err = xfererr
-					return
-				}
+	// It's technically possibly for multiple services to provide file transfer services,
+	// so we should block until all of them are complete. We're using a WaitGroup to
+	// coordinate the file transfers, since they occur in separate goroutines.
+	var (
+		wg   sync.WaitGroup
+		errs transferErrors
+	)
 
-				if transferObj == nil {
-					log.Error("transferObj is nil")
-					return
-				}
+	for _, svc := range svcs {
+		wg.Add(1)
+
+		go func(svc apiv1.Service) {
+			defer wg.Done()
 
-				time.Sleep(5 * time.Second)
+			if xfererr := run(svc); xfererr != nil {
+				log.Error(errors.Wrapf(xfererr, "%s transfer for %s failed", kind, id))
+				errs.add(xfererr)
 			}
 		}(svc)
 	}
 
+	if async {
+		return nil
+	}
+
 	// Block until all of the file transfers are complete. There usually will only
 	// be a single goroutine to wait for, but we should support more.
-	if !async {
-		wg.Wait()
+	wg.Wait()
+
+	return errs.err(len(svcs))
+}
+
+// transferServices returns the Services for the analysis that provide file
+// transfers.
+func (i *Internal) transferServices(id string) ([]apiv1.Service, error) {
+	set := labels.Set(map[string]string{
+		"external-id": id,
+	})
+
+	svclist, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return svclist.Items, nil
+}
+
+// transferKinds maps the kinds of transfers to the paths they're requested
+// at in the file transfer service.
+var transferKinds = []struct {
+	kind    string
+	reqpath string
+}{
+	{uploadKind, uploadBasePath},
+	{downloadKind, downloadBasePath},
+}
+
+// VICEListTransfers lists the uploads and downloads for an analysis, along
+// with their progress.
+func (i *Internal) VICEListTransfers(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(svcs) == 0 {
+		http.Error(writer, fmt.Sprintf("no services found for analysis %s", id), http.StatusNotFound)
+		return
+	}
+
+	transfers := []Transfer{}
+	for _, svc := range svcs {
+		for _, tk := range transferKinds {
+			listed, err := i.listTransfers(request.Context(), svc, tk.reqpath)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, t := range listed {
+				if t.Kind == "" {
+					t.Kind = tk.kind
+				}
+				t.Percent = t.percent()
+				transfers = append(transfers, t)
+			}
+		}
+	}
+
+	buf, err := json.Marshal(map[string][]Transfer{"transfers": transfers})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(buf)
+}
+
+// VICEGetTransfer returns a single upload or download for an analysis, along
+// with its progress.
+func (i *Internal) VICEGetTransfer(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id := vars["id"]
+	uuid := vars["uuid"]
+
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, svc := range svcs {
+		for _, tk := range transferKinds {
+			t, err := i.getTransferDetails(request.Context(), svc, path.Join(tk.reqpath, uuid))
+			if isTransferNotFound(err) {
+				continue
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if t.Kind == "" {
+				t.Kind = tk.kind
+			}
+			t.Percent = t.percent()
+
+			buf, err := json.Marshal(t)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			writer.Header().Add("Content-Type", "application/json")
+			writer.Write(buf)
+			return
+		}
 	}
 
-	return err
+	http.Error(writer, fmt.Sprintf("transfer %s not found for analysis %s", uuid, id), http.StatusNotFound)
+}
+
+// VICECancelTransfer stops an upload or download for an analysis. The file
+// transfer service is asked to stop it, and if this app-exposer instance is
+// waiting on it, the wait ends with an error. A 404 is returned if neither of
+// them knows about the transfer.
+func (i *Internal) VICECancelTransfer(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id := vars["id"]
+	uuid := vars["uuid"]
+
+	svcs, err := i.transferServices(id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(svcs) == 0 {
+		http.Error(writer, fmt.Sprintf("no services found for analysis %s", id), http.StatusNotFound)
+		return
+	}
+
+	// Only the file transfer services for the analysis are asked to stop the
+	// transfer, and only a transfer this instance is following for the same
+	// analysis is cancelled, so a UUID from another analysis can't be stopped.
+	found := i.stopTransfer(id, uuid)
+
+	for _, svc := range svcs {
+		for _, tk := range transferKinds {
+			err = i.cancelTransfer(request.Context(), svc, path.Join(tk.reqpath, uuid))
+			if err == nil {
+				found = true
+				continue
+			}
+			if !isTransferNotFound(err) {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if !found {
+		http.Error(writer, fmt.Sprintf("transfer %s not found for analysis %s", uuid, id), http.StatusNotFound)
+		return
+	}
 }
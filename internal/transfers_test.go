@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTransferPercent(t *testing.T) {
+	xfer := &Transfer{Status: UploadingStatus}
+	if pct := xfer.percent(); pct != -1 {
+		t.Errorf("a transfer without counts is %d%% done", pct)
+	}
+	if m := xfer.milestone(); m != 0 {
+		t.Errorf("a transfer without counts is at milestone %d", m)
+	}
+
+	xfer.FilesTotal = 4
+	xfer.FilesDone = 1
+	if pct := xfer.percent(); pct != 25 {
+		t.Errorf("a transfer with 1 of 4 files done is %d%% done", pct)
+	}
+
+	// The byte counts win over the file counts.
+	xfer.BytesTotal = 1000
+	xfer.BytesDone = 740
+	if pct := xfer.percent(); pct != 74 {
+		t.Errorf("a transfer with 740 of 1000 bytes done is %d%% done", pct)
+	}
+	if m := xfer.milestone(); m != 50 {
+		t.Errorf("a transfer that's 74%% done is at milestone %d", m)
+	}
+
+	xfer.Status = CompletedStatus
+	if pct := xfer.percent(); pct != 100 {
+		t.Errorf("a completed transfer is %d%% done", pct)
+	}
+}
+
+func TestProgressMessage(t *testing.T) {
+	xfer := &Transfer{
+		Status:     UploadingStatus,
+		FilesTotal: 4,
+		FilesDone:  2,
+		FileErrors: []TransferFileError{{Path: "a.txt", Error: "permission denied"}},
+	}
+
+	msg := progressMessage(uploadKind, "job", xfer)
+	if !strings.Contains(msg, "50% complete") || !strings.Contains(msg, "2 of 4 files") || !strings.Contains(msg, "1 failed") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestUploadOptionsValidate(t *testing.T) {
+	home := "/iplant/home/user"
+
+	valid := []UploadOptions{
+		{},
+		{Include: []string{"results/*.csv"}, Exclude: []string{"results/tmp/*"}},
+		{Paths: []string{"results", "notebooks/analysis.ipynb"}, Destination: "/iplant/home/user/checkpoints"},
+		{Destination: "/iplant/home/user"},
+	}
+	for _, o := range valid {
+		if err := o.validate(home); err != nil {
+			t.Errorf("%+v is invalid: %s", o, err)
+		}
+	}
+
+	invalid := []UploadOptions{
+		{Include: []string{"results/[.csv"}},
+		{Exclude: []string{"/etc/*"}},
+		{Paths: []string{"../other-analysis"}},
+		{Paths: []string{"results/../../"}},
+		{Destination: "checkpoints"},
+		{Destination: "/iplant/home/other-user/checkpoints"},
+		{Destination: "/iplant/home/username"},
+		{Destination: "/iplant/home/user/../other-user"},
+	}
+	for _, o := range invalid {
+		if err := o.validate(home); err == nil {
+			t.Errorf("%+v is valid", o)
+		}
+	}
+
+	if err := (&UploadOptions{Destination: "/iplant/home/user"}).validate(""); err == nil {
+		t.Error("a destination was accepted without a home folder to check it against")
+	}
+}
+
+func TestTriggerUploadsCrossUserDestination(t *testing.T) {
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: jobRecordSecretName("a"), Namespace: "vice-apps"},
+			Data: map[string][]byte{
+				jobRecordFileName: []byte(`{"uuid": "a", "username": "user", "irods_base": "/iplant/home"}`),
+			},
+		}),
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/vice/{id}/save-output-files", i.VICETriggerUploads).Methods("POST")
+
+	body := `{"destination": "/iplant/home/other-user"}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/vice/a/save-output-files", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("an upload to another user's home folder got a %d", rec.Code)
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	var errs transferErrors
+	if err := errs.err(2); err != nil {
+		t.Errorf("no failures returned %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs.add(fmt.Errorf("service %d failed", n))
+		}(n)
+	}
+	wg.Wait()
+
+	err := errs.err(3)
+	if err == nil || !strings.HasPrefix(err.Error(), "2 of 3 transfers failed") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestStopTransfer(t *testing.T) {
+	i := &Internal{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.trackTransfer("analysis-a", "a", cancel)
+
+	if i.stopTransfer("analysis-a", "b") {
+		t.Error("an unknown transfer was stopped")
+	}
+	if i.stopTransfer("analysis-b", "a") {
+		t.Error("a transfer was stopped through another analysis")
+	}
+	if ctx.Err() != nil {
+		t.Error("the context was cancelled through another analysis")
+	}
+	if !i.stopTransfer("analysis-a", "a") {
+		t.Error("a running transfer wasn't stopped")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Error("the context of the stopped transfer wasn't cancelled")
+	}
+
+	i.untrackTransfer("a")
+	if i.stopTransfer("analysis-a", "a") {
+		t.Error("a finished transfer was stopped")
+	}
+}
+
+func TestIsTransferNotFound(t *testing.T) {
+	notFound := errors.Wrap(&transferServiceError{method: "GET", url: "http://vice-a", statusCode: 404}, "wrapped")
+	if !isTransferNotFound(notFound) {
+		t.Error("a 404 from the transfer service wasn't recognized")
+	}
+	if isTransferNotFound(&transferServiceError{statusCode: 500}) || isTransferNotFound(errors.New("boom")) {
+		t.Error("another error was treated as a 404")
+	}
+}
+
+func TestVICEGetTransferHandler(t *testing.T) {
+	i, _, _, transfers := testSaveAndExit(t)
+	transfers.set("GET /download/d", `{"uuid": "d", "status": "completed"}`)
+	transfers.fail("GET /upload/broken", http.StatusInternalServerError)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/vice/{id}/transfers/{uuid}", i.VICEGetTransfer).Methods("GET")
+
+	get := func(uuid string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/vice/a/transfers/"+uuid, nil))
+		return rec.Code
+	}
+
+	if code := get("d"); code != http.StatusOK {
+		t.Errorf("a transfer that the service knows about got a %d", code)
+	}
+	if code := get("missing"); code != http.StatusNotFound {
+		t.Errorf("a transfer that the service doesn't know about got a %d", code)
+	}
+	if code := get("broken"); code != http.StatusInternalServerError {
+		t.Errorf("an error from the service got a %d", code)
+	}
+}
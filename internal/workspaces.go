@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// workspaceBasePath is the path to the file transfer service endpoint that
+	// archives the whole working directory, including the excluded files, and
+	// uploads the archive.
+	workspaceBasePath = "/workspace"
+	workspaceKind     = "workspace save"
+
+	// workspaceArchiveName is the name of the workspace archive, which is
+	// saved in the output directory of the suspended analysis.
+	workspaceArchiveName = "vice-workspace.tar.gz"
+)
+
+// Workspace is the saved working directory of a suspended VICE analysis,
+// which a new analysis can be resumed from.
+type Workspace struct {
+	ExternalID  string    `json:"external_id"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	AppID       string    `json:"app_id"`
+	ArchivePath string    `json:"archive_path"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+const saveWorkspaceSQL = `
+	INSERT INTO vice_workspaces (external_id, user_id, username, app_id, archive_path)
+	VALUES ($1, $2, $3, $4, $5)
+	    ON CONFLICT (external_id) DO UPDATE
+	   SET archive_path = EXCLUDED.archive_path,
+	       suspended_at = now()
+`
+
+const getWorkspaceSQL = `
+	SELECT external_id, user_id, username, app_id, archive_path, suspended_at
+	  FROM vice_workspaces
+	 WHERE external_id = $1
+`
+
+const listWorkspacesSQL = `
+	SELECT external_id, user_id, username, app_id, archive_path, suspended_at
+	  FROM vice_workspaces
+	 WHERE username = $1
+  ORDER BY suspended_at DESC
+`
+
+// containerArg returns the value that follows the flag in the command of the
+// named container in the Deployment, or an empty string if it's not there.
+func containerArg(deployment *appsv1.Deployment, containerName, flag string) string {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != containerName {
+			continue
+		}
+		for idx, arg := range container.Command {
+			if arg == flag && idx+1 < len(container.Command) {
+				return container.Command[idx+1]
+			}
+		}
+	}
+	return ""
+}
+
+// workspaceForDeployment returns the Workspace that suspending the analysis
+// running in the Deployment will create. The archive goes into the output
+// directory that the file transfer service uploads to.
+func workspaceForDeployment(deployment *appsv1.Deployment) (*Workspace, error) {
+	outputDir := containerArg(deployment, fileTransfersContainerName, "--upload-destination")
+	if outputDir == "" {
+		return nil, fmt.Errorf("unable to find the output directory for deployment %s", deployment.Name)
+	}
+
+	return &Workspace{
+		ExternalID:  deployment.Labels["external-id"],
+		UserID:      deployment.Labels["user-id"],
+		Username:    deployment.Labels["username"],
+		AppID:       deployment.Labels["app-id"],
+		ArchivePath: path.Join(outputDir, workspaceArchiveName),
+	}, nil
+}
+
+func (i *Internal) getWorkspace(externalID string) (*Workspace, error) {
+	w := &Workspace{}
+	err := i.db.QueryRow(getWorkspaceSQL, externalID).Scan(
+		&w.ExternalID,
+		&w.UserID,
+		&w.Username,
+		&w.AppID,
+		&w.ArchivePath,
+		&w.SuspendedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// resumeWorkspace returns the workspace that the job should be resumed from,
+// or nil if the job isn't being resumed. Users can only resume from their own
+// workspaces.
+func (i *Internal) resumeWorkspace(job *VICEJob) (*Workspace, error) {
+	if job.ResumeFrom == "" {
+		return nil, nil
+	}
+
+	workspace, err := i.getWorkspace(job.ResumeFrom)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("analysis %s was not suspended, so it can't be resumed", job.ResumeFrom)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the workspace for analysis %s", job.ResumeFrom)
+	}
+
+	if workspace.UserID != job.UserID {
+		return nil, fmt.Errorf("analysis %s was not suspended by %s", job.ResumeFrom, job.Submitter)
+	}
+
+	return workspace, nil
+}
+
+// failSuspend marks the suspend operation as failed. The analysis keeps
+// running, so it's only told why it wasn't suspended.
+func (i *Internal) failSuspend(op *Operation, msg string) {
+	i.setOperationStatus(op, OperationFailed, msg)
+	i.publishRunning(op.ExternalID, fmt.Sprintf("the analysis could not be suspended: %s", msg))
+}
+
+// runSuspend saves the working directory of the analysis to the workspace
+// archive and then shuts the analysis down. The analysis is left running if
+// the workspace can't be saved. A resumed operation picks up at the step it
+// was on, like save-and-exit.
+func (i *Internal) runSuspend(op *Operation) {
+	stop := i.heartbeat(op)
+	defer stop()
+
+	id := op.ExternalID
+
+	if op.Status == OperationPending || op.Status == OperationUploading {
+		deployment, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Get(id, metav1.GetOptions{})
+		if err != nil {
+			i.failSuspend(op, fmt.Sprintf("unable to look up the analysis: %s", err.Error()))
+			return
+		}
+
+		workspace, err := workspaceForDeployment(deployment)
+		if err != nil {
+			i.failSuspend(op, err.Error())
+			return
+		}
+
+		if op.Status == OperationUploading {
+			err = i.resumeFileTransfer(id, workspaceBasePath, workspaceKind)
+		} else {
+			i.setOperationStatus(op, OperationUploading, "")
+			err = i.doFileTransfer(id, workspaceBasePath, workspaceKind, nil, false)
+		}
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error saving the workspace for job %s", id))
+			i.failSuspend(op, fmt.Sprintf("the workspace couldn't be saved: %s", err.Error()))
+			return
+		}
+
+		if _, err = i.db.Exec(saveWorkspaceSQL, id, workspace.UserID, workspace.Username, workspace.AppID, workspace.ArchivePath); err != nil {
+			log.Error(errors.Wrapf(err, "error recording the workspace for job %s", id))
+			i.failSuspend(op, fmt.Sprintf("the workspace couldn't be recorded: %s", err.Error()))
+			return
+		}
+
+		i.publishRunning(id, fmt.Sprintf("the workspace was saved to %s, suspending the analysis", workspace.ArchivePath))
+	}
+
+	i.setOperationStatus(op, OperationExiting, "")
+
+	result, err := i.exitAnalysis(id)
+	if err != nil {
+		i.failSuspend(op, fmt.Sprintf("the analysis couldn't be shut down: %s", err.Error()))
+		return
+	}
+	if len(result.Failed) > 0 {
+		i.failSuspend(op, fmt.Sprintf("the analysis couldn't be shut down: %s", exitSummary(result)))
+		return
+	}
+
+	i.setOperationStatus(op, OperationCompleted, exitSummary(result))
+}
+
+// VICESuspend handles requests to suspend a VICE analysis. The working
+// directory, including the files that are normally excluded from the outputs,
+// is saved to a workspace archive in the output directory and the analysis is
+// shut down. A new analysis can be launched from the workspace by setting
+// resume_from to the external ID of the suspended analysis. The suspend is
+// tracked as an operation, so a 202 is returned with the workspace and the
+// Location header points at the operation. A 404 is returned if the analysis
+// isn't running, and a 409 is returned if another operation is already
+// running for it.
+func (i *Internal) VICESuspend(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+
+	deployment, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Get(id, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		http.Error(writer, fmt.Sprintf("no running analysis found for %s", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	workspace, err := workspaceForDeployment(deployment)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	op, err := i.createOperation(id, suspendOperation)
+	if err == errOperationRunning {
+		http.Error(writer, fmt.Sprintf("analysis %s is already being saved and shut down or suspended", id), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(workspace)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go i.runSuspend(op)
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Header().Add("Location", fmt.Sprintf("/vice/%s/operations/%s", id, op.ID))
+	writer.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(writer, string(buf))
+}
+
+// VICEListWorkspaces lists the workspaces of a user's suspended analyses.
+//
+// Query Parameters:
+//   user - Required. The user that suspended the analyses.
+func (i *Internal) VICEListWorkspaces(writer http.ResponseWriter, request *http.Request) {
+	user := request.URL.Query().Get("user")
+	if user == "" {
+		http.Error(writer, "user is not set", http.StatusForbidden)
+		return
+	}
+
+	rows, err := i.db.Query(listWorkspacesSQL, slugString(user))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var w Workspace
+		if err = rows.Scan(&w.ExternalID, &w.UserID, &w.Username, &w.AppID, &w.ArchivePath, &w.SuspendedAt); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		workspaces = append(workspaces, w)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(map[string][]Workspace{
+		"workspaces": workspaces,
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(writer, string(buf))
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWorkspaceForDeployment(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "job",
+			Labels: map[string]string{
+				"external-id": "job",
+				"user-id":     "user",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name:    fileTransfersContainerName,
+							Command: []string{"/vice-file-transfers", "--upload-destination", "/iplant/home/ipcdev/analyses/job"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	workspace, err := workspaceForDeployment(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "/iplant/home/ipcdev/analyses/job/vice-workspace.tar.gz"
+	if workspace.ArchivePath != expected {
+		t.Errorf("archive path was %s, not %s", workspace.ArchivePath, expected)
+	}
+	if workspace.ExternalID != "job" || workspace.UserID != "user" {
+		t.Errorf("unexpected workspace %+v", workspace)
+	}
+
+	deployment.Spec.Template.Spec.Containers[0].Command = []string{"/vice-file-transfers", "--upload-destination"}
+	if _, err = workspaceForDeployment(deployment); err == nil {
+		t.Error("workspaceForDeployment didn't fail without an output directory")
+	}
+}
+
+// testSuspend returns an Internal with a running analysis called a that can be
+// suspended, along with the fakes it uses.
+func testSuspend(t *testing.T) (*Internal, *fakeDB, *recordingPublisher, *fakeTransferService) {
+	i, db, publisher, transfers := testSaveAndExit(t)
+
+	deployments := i.clientset.AppsV1().Deployments("vice-apps")
+	deployment, err := deployments.Get("a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Spec.Containers = []apiv1.Container{
+		{
+			Name:    fileTransfersContainerName,
+			Command: []string{"/vice-file-transfers", "--upload-destination", "/iplant/home/user/analyses/a"},
+		},
+	}
+	if _, err = deployments.Update(deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	return i, db, publisher, transfers
+}
+
+func TestRunSuspend(t *testing.T) {
+	i, db, _, transfers := testSuspend(t)
+	transfers.set("POST /workspace", `{"uuid": "w", "status": "requested"}`)
+	transfers.set("GET /workspace/w", `{"uuid": "w", "status": "completed"}`)
+
+	i.runSuspend(&Operation{ID: "op", ExternalID: "a", Kind: suspendOperation, Status: OperationPending})
+
+	expected := []string{OperationUploading, OperationExiting, OperationCompleted}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+	saved := db.called("INSERT INTO vice_workspaces")
+	if len(saved) != 1 || saved[0][4] != "/iplant/home/user/analyses/a/vice-workspace.tar.gz" {
+		t.Errorf("unexpected workspaces recorded: %v", saved)
+	}
+	if _, err := i.clientset.AppsV1().Deployments("vice-apps").Get("a", metav1.GetOptions{}); err == nil {
+		t.Error("the analysis is still running")
+	}
+}
+
+func TestRunSuspendSaveFailed(t *testing.T) {
+	i, db, publisher, transfers := testSuspend(t)
+	transfers.set("POST /workspace", `{"uuid": "w", "status": "requested"}`)
+	transfers.set("GET /workspace/w", `{"uuid": "w", "status": "failed"}`)
+
+	i.runSuspend(&Operation{ID: "op", ExternalID: "a", Kind: suspendOperation, Status: OperationPending})
+
+	expected := []string{OperationUploading, OperationFailed}
+	if statuses := operationStatuses(db); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the operation went through %v, not %v", statuses, expected)
+	}
+	if fails := publisher.sent("failed"); len(fails) != 0 {
+		t.Errorf("the analysis was marked as failed: %v", fails)
+	}
+	if _, err := i.clientset.AppsV1().Deployments("vice-apps").Get("a", metav1.GetOptions{}); err != nil {
+		t.Error("the analysis was shut down after its workspace couldn't be saved")
+	}
+}
+
+func TestVICESuspendHandler(t *testing.T) {
+	i, db, _, _ := testSuspend(t)
+	i.clientset.(*fake.Clientset).PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() == "broken" {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/vice/{id}/suspend", i.VICESuspend).Methods("POST")
+
+	suspend := func(id string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/vice/"+id+"/suspend", nil))
+		return rec.Code
+	}
+
+	if code := suspend("missing"); code != http.StatusNotFound {
+		t.Errorf("an analysis that isn't running got a %d", code)
+	}
+	if code := suspend("broken"); code != http.StatusInternalServerError {
+		t.Errorf("a failed lookup got a %d", code)
+	}
+
+	// The insert doesn't return anything when there's already an operation
+	// running for the analysis.
+	if code := suspend("a"); code != http.StatusConflict {
+		t.Errorf("an analysis that's already being saved got a %d", code)
+	}
+	if created := db.called("INSERT INTO vice_operations"); len(created) != 1 || created[0][1] != suspendOperation {
+		t.Errorf("unexpected operations created: %v", created)
+	}
+}
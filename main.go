@@ -9,13 +9,17 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 
+	"github.com/cyverse-de/app-exposer/internal"
 	"github.com/cyverse-de/configurate"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -134,6 +138,14 @@ func main() {
 		log.Fatal(errors.Wrap(err, "error creating clientset from config"))
 	}
 
+	var dynamicClient dynamic.Interface
+	if cfg.GetBool("vice.operator.enabled") {
+		dynamicClient, err = dynamic.NewForConfig(config)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "error creating the dynamic client from config"))
+		}
+	}
+
 	jobStatusURL := cfg.GetString("vice.job-status.base")
 	if jobStatusURL == "" {
 		jobStatusURL = "http://job-status-listener"
@@ -152,6 +164,144 @@ func main() {
 		proxyImage = fmt.Sprintf("%s:%s", *viceProxy, proxyTag)
 	}
 
+	launchQueueInterval := cfg.GetDuration("vice.queue.interval")
+	if launchQueueInterval <= 0 {
+		launchQueueInterval = 30 * time.Second
+	}
+
+	launchQueueGroupPriorities := map[string]int{}
+	if err = cfg.UnmarshalKey("vice.queue.group-priorities", &launchQueueGroupPriorities); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.queue.group-priorities in the config file"))
+	}
+
+	gpuModels := map[string]internal.GPUModel{}
+	if err = cfg.UnmarshalKey("vice.gpus.models", &gpuModels); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.gpus.models in the config file"))
+	}
+
+	schedulingPolicyReloadInterval := cfg.GetDuration("vice.scheduling.reload-interval")
+	if schedulingPolicyReloadInterval <= 0 {
+		schedulingPolicyReloadInterval = time.Minute
+	}
+
+	priorityClassUserTiers := map[string]string{}
+	if err = cfg.UnmarshalKey("vice.priority.user-tiers", &priorityClassUserTiers); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.priority.user-tiers in the config file"))
+	}
+
+	priorityClassAppCategories := map[string]string{}
+	if err = cfg.UnmarshalKey("vice.priority.app-categories", &priorityClassAppCategories); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.priority.app-categories in the config file"))
+	}
+
+	homeVolumeCleanupInterval := cfg.GetDuration("vice.home-volumes.cleanup-interval")
+	if homeVolumeCleanupInterval <= 0 {
+		homeVolumeCleanupInterval = time.Hour
+	}
+
+	securityProfiles := map[string]internal.SecurityProfile{}
+	if err = cfg.UnmarshalKey("vice.security.profiles", &securityProfiles); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.security.profiles in the config file"))
+	}
+
+	securityAppProfiles := map[string]string{}
+	if err = cfg.UnmarshalKey("vice.security.app-profiles", &securityAppProfiles); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.security.app-profiles in the config file"))
+	}
+
+	networkPolicies := internal.NetworkPolicyConfig{}
+	if err = cfg.UnmarshalKey("vice.network-policies", &networkPolicies); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.network-policies in the config file"))
+	}
+	if len(networkPolicies.IngressController.PodLabels) == 0 {
+		networkPolicies.IngressController.PodLabels = map[string]string{
+			"app.kubernetes.io/name": "ingress-nginx",
+		}
+	}
+	if len(networkPolicies.AppExposer.PodLabels) == 0 {
+		networkPolicies.AppExposer.PodLabels = map[string]string{
+			"de-app": "app-exposer",
+		}
+	}
+	if err = networkPolicies.Validate(); err != nil {
+		log.Fatal(errors.Wrap(err, "invalid vice.network-policies in the config file"))
+	}
+
+	orphanGCInterval := cfg.GetDuration("vice.orphans.gc-interval")
+	if orphanGCInterval <= 0 {
+		orphanGCInterval = 10 * time.Minute
+	}
+
+	orphanGracePeriod := cfg.GetDuration("vice.orphans.grace-period")
+	if orphanGracePeriod <= 0 {
+		orphanGracePeriod = time.Hour
+	}
+
+	transferRequestTimeout := cfg.GetDuration("vice.transfers.request-timeout")
+	if transferRequestTimeout <= 0 {
+		transferRequestTimeout = 30 * time.Second
+	}
+
+	transferTimeout := cfg.GetDuration("vice.transfers.timeout")
+	if transferTimeout <= 0 {
+		transferTimeout = 12 * time.Hour
+	}
+
+	transferPollInterval := cfg.GetDuration("vice.transfers.poll-interval")
+	if transferPollInterval <= 0 {
+		transferPollInterval = 5 * time.Second
+	}
+
+	storageBackends := map[string]internal.StorageBackend{}
+	if err = cfg.UnmarshalKey("vice.storage.backends", &storageBackends); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.storage.backends in the config file"))
+	}
+	for name, backend := range storageBackends {
+		if err = backend.Validate(); err != nil {
+			log.Fatal(errors.Wrapf(err, "invalid storage backend %s in vice.storage.backends", name))
+		}
+	}
+	storageDefaultBackend := cfg.GetString("vice.storage.default-backend")
+	defaultBackendName := strings.ToLower(storageDefaultBackend)
+	if defaultBackendName == "" {
+		defaultBackendName = "irods"
+	}
+	if len(storageBackends) > 0 {
+		if _, ok := storageBackends[defaultBackendName]; !ok {
+			log.Fatalf("the default storage backend %s isn't one of the backends in vice.storage.backends", defaultBackendName)
+		}
+	} else if defaultBackendName != "irods" {
+		log.Fatalf("the default storage backend %s isn't configured; only irods is available without vice.storage.backends", defaultBackendName)
+	}
+
+	checkpointMinInterval := cfg.GetDuration("vice.checkpoints.min-interval")
+	if checkpointMinInterval <= 0 {
+		checkpointMinInterval = 15 * time.Minute
+	}
+
+	checkpointCheckInterval := cfg.GetDuration("vice.checkpoints.check-interval")
+	if checkpointCheckInterval <= 0 {
+		checkpointCheckInterval = time.Minute
+	}
+
+	operatorResyncInterval := cfg.GetDuration("vice.operator.resync-interval")
+	if operatorResyncInterval <= 0 {
+		operatorResyncInterval = 30 * time.Second
+	}
+
+	reconcileInterval := cfg.GetDuration("vice.reconcile.interval")
+	if reconcileInterval <= 0 {
+		reconcileInterval = 5 * time.Minute
+	}
+
+	redaction := internal.RedactionRules{}
+	if err = cfg.UnmarshalKey("vice.redaction", &redaction); err != nil {
+		log.Fatal(errors.Wrap(err, "Can't parse vice.redaction in the config file"))
+	}
+	if err = redaction.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	dbURI := cfg.GetString("db.uri")
 	// connect to the database. or not, I don't really care.
 	db, err = sql.Open("postgres", dbURI)
@@ -164,27 +314,99 @@ func main() {
 	}
 
 	exposerInit := &ExposerAppInit{
-		Namespace:                     *namespace,
-		ViceNamespace:                 *viceNamespace,
-		PorklockImage:                 cfg.GetString("vice.file-transfers.image"),
-		PorklockTag:                   cfg.GetString("vice.file-transfers.tag"),
-		InputPathListIdentifier:       cfg.GetString("path_list.file_identifier"),
-		TicketInputPathListIdentifier: cfg.GetString("tickets_path_list.file_identifier"),
-		JobStatusURL:                  jobStatusURL,
-		ViceProxyImage:                proxyImage,
-		CASBaseURL:                    cfg.GetString("cas.base"),
-		FrontendBaseURL:               cfg.GetString("k8s.frontend.base"),
-		ViceDefaultBackendService:     *viceDefaultBackendService,
-		ViceDefaultBackendServicePort: *viceDefaultBackendServicePort,
-		GetAnalysisIDService:          *getAnalysisIDService,
-		CheckResourceAccessService:    *checkResourceAccessService,
-		VICEBackendNamespace:          cfg.GetString("vice.backend-namespace"),
-		AppsServiceBaseURL:            appsServiceBaseURL,
-		db:                            db,
+		Namespace:                      *namespace,
+		ViceNamespace:                  *viceNamespace,
+		PorklockImage:                  cfg.GetString("vice.file-transfers.image"),
+		PorklockTag:                    cfg.GetString("vice.file-transfers.tag"),
+		InputPathListIdentifier:        cfg.GetString("path_list.file_identifier"),
+		TicketInputPathListIdentifier:  cfg.GetString("tickets_path_list.file_identifier"),
+		JobStatusURL:                   jobStatusURL,
+		ViceProxyImage:                 proxyImage,
+		CASBaseURL:                     cfg.GetString("cas.base"),
+		FrontendBaseURL:                cfg.GetString("k8s.frontend.base"),
+		ViceDefaultBackendService:      *viceDefaultBackendService,
+		ViceDefaultBackendServicePort:  *viceDefaultBackendServicePort,
+		GetAnalysisIDService:           *getAnalysisIDService,
+		CheckResourceAccessService:     *checkResourceAccessService,
+		VICEBackendNamespace:           cfg.GetString("vice.backend-namespace"),
+		AppsServiceBaseURL:             appsServiceBaseURL,
+		LaunchQueueEnabled:             cfg.GetBool("vice.queue.enabled"),
+		LaunchQueueInterval:            launchQueueInterval,
+		LaunchQueueGroupPriorities:     launchQueueGroupPriorities,
+		ResourceRequestRatio:           cfg.GetFloat64("vice.resources.request-ratio"),
+		EphemeralStorageLimit:          cfg.GetString("vice.resources.ephemeral-storage-limit"),
+		GPUModels:                      gpuModels,
+		GPUDefaultModel:                cfg.GetString("vice.gpus.default-model"),
+		SchedulingPolicyFile:           cfg.GetString("vice.scheduling.policy-file"),
+		SchedulingPolicyReloadInterval: schedulingPolicyReloadInterval,
+		PriorityClassDefault:           cfg.GetString("vice.priority.default-class"),
+		PriorityClassUserTiers:         priorityClassUserTiers,
+		PriorityClassAppCategories:     priorityClassAppCategories,
+		TerminationGracePeriod:         cfg.GetDuration("vice.termination-grace-period"),
+		HomeVolumesEnabled:             cfg.GetBool("vice.home-volumes.enabled"),
+		HomeVolumeMountPath:            cfg.GetString("vice.home-volumes.mount-path"),
+		HomeVolumeStorageClass:         cfg.GetString("vice.home-volumes.storage-class"),
+		HomeVolumeAccessMode:           cfg.GetString("vice.home-volumes.access-mode"),
+		HomeVolumeDefaultSize:          cfg.GetString("vice.home-volumes.default-size"),
+		HomeVolumeRetention:            cfg.GetDuration("vice.home-volumes.retention"),
+		HomeVolumeCleanupInterval:      homeVolumeCleanupInterval,
+		SecurityProfiles:               securityProfiles,
+		SecurityDefaultProfile:         cfg.GetString("vice.security.default-profile"),
+		SecurityAppProfiles:            securityAppProfiles,
+		SecurityMinimumLevel:           cfg.GetString("vice.security.minimum-level"),
+		NetworkPolicies:                networkPolicies,
+		SecretsMountPath:               cfg.GetString("vice.secrets.mount-path"),
+		AdminUsers:                     cfg.GetStringSlice("vice.admin.users"),
+		Redaction:                      redaction,
+		OrphanGCEnabled:                cfg.GetBool("vice.orphans.gc-enabled"),
+		OrphanGCInterval:               orphanGCInterval,
+		OrphanGracePeriod:              orphanGracePeriod,
+		ReconcileEnabled:               cfg.GetBool("vice.reconcile.enabled"),
+		ReconcileInterval:              reconcileInterval,
+		OperatorEnabled:                cfg.GetBool("vice.operator.enabled"),
+		OperatorResyncInterval:         operatorResyncInterval,
+		TransferTimeout:                transferTimeout,
+		TransferRequestTimeout:         transferRequestTimeout,
+		TransferPollInterval:           transferPollInterval,
+		CheckpointMinInterval:          checkpointMinInterval,
+		CheckpointCheckInterval:        checkpointCheckInterval,
+		StorageBackends:                storageBackends,
+		StorageDefaultBackend:          storageDefaultBackend,
+		db:                             db,
+		dynamicClient:                  dynamicClient,
 	}
 
 	app := NewExposerApp(exposerInit, *ingressClass, clientset)
+
+	if exposerInit.SchedulingPolicyFile != "" {
+		if err = app.internal.LoadSchedulingPolicy(); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("loaded the scheduling policy from %s", exposerInit.SchedulingPolicyFile)
+		app.internal.WatchSchedulingPolicy()
+	}
+
 	log.Printf("listening on port %d", *listenPort)
 	app.internal.MonitorVICEEvents()
+	app.internal.ResumeOperations()
+	app.internal.RunCheckpoints()
+	if exposerInit.LaunchQueueEnabled {
+		app.internal.ProcessLaunchQueue()
+	}
+	if exposerInit.HomeVolumesEnabled && exposerInit.HomeVolumeRetention > 0 {
+		app.internal.CleanupHomeVolumes()
+	}
+	if exposerInit.OrphanGCEnabled {
+		app.internal.CollectOrphans()
+	}
+	if exposerInit.OperatorEnabled {
+		if err = app.internal.RunOperator(); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("running in operator mode")
+	}
+	if exposerInit.ReconcileEnabled {
+		app.internal.ReconcileAnalyses()
+	}
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.router))
 }
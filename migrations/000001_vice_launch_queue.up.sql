@@ -0,0 +1,15 @@
+-- VICE analyses waiting for the user or the cluster to have the capacity to
+-- run them. See internal/queue.go.
+CREATE TABLE IF NOT EXISTS vice_launch_queue (
+    external_id text PRIMARY KEY,
+    username    text NOT NULL,
+    priority    integer NOT NULL DEFAULT 0,
+    job         jsonb NOT NULL,
+    queued_at   timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_launch_queue_order_index
+    ON vice_launch_queue (priority DESC, queued_at ASC);
+
+CREATE INDEX IF NOT EXISTS vice_launch_queue_username_index
+    ON vice_launch_queue (username);
@@ -0,0 +1,13 @@
+-- The saved working directories of suspended VICE analyses, which new
+-- analyses can be resumed from. See internal/workspaces.go.
+CREATE TABLE IF NOT EXISTS vice_workspaces (
+    external_id  text PRIMARY KEY,
+    user_id      text NOT NULL,
+    username     text NOT NULL,
+    app_id       text NOT NULL,
+    archive_path text NOT NULL,
+    suspended_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_workspaces_username_index
+    ON vice_workspaces (username, suspended_at DESC);
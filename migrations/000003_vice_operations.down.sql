@@ -0,0 +1 @@
+DROP TABLE IF EXISTS vice_operations;
@@ -0,0 +1,23 @@
+-- Long-running operations on VICE analyses, like save-and-exit. See
+-- internal/operations.go.
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS vice_operations (
+    id          uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    external_id text NOT NULL,
+    kind        text NOT NULL,
+    status      text NOT NULL,
+    message     text,
+    created_at  timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at  timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Only one operation can be running for an analysis at a time, since both
+-- save-and-exit and suspend shut the analysis down.
+CREATE UNIQUE INDEX IF NOT EXISTS vice_operations_running_index
+    ON vice_operations (external_id)
+ WHERE status NOT IN ('completed', 'failed');
+
+CREATE INDEX IF NOT EXISTS vice_operations_updated_at_index
+    ON vice_operations (updated_at)
+ WHERE status NOT IN ('completed', 'failed');
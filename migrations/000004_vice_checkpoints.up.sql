@@ -0,0 +1,13 @@
+-- Schedules for periodically uploading the output files of VICE analyses. See
+-- internal/checkpoints.go.
+CREATE TABLE IF NOT EXISTS vice_checkpoints (
+    external_id      text PRIMARY KEY,
+    interval_seconds bigint NOT NULL CHECK (interval_seconds > 0),
+    next_run_at      timestamp with time zone NOT NULL,
+    last_run_at      timestamp with time zone,
+    last_status      text,
+    last_message     text
+);
+
+CREATE INDEX IF NOT EXISTS vice_checkpoints_next_run_at_index
+    ON vice_checkpoints (next_run_at);
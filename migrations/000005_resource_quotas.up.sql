@@ -0,0 +1,20 @@
+-- The VICE resource quotas for users and groups. See internal/quotas.go.
+--
+-- A row with launcher set is the quota for that user, where launcher is the
+-- username with the characters that aren't allowed in labels replaced, as in
+-- the username label on the analyses. A row with group_name set is the quota
+-- for the members of the group. The row with neither set is the default quota
+-- for everyone else. A null limit means there is no limit.
+CREATE TABLE IF NOT EXISTS resource_quotas (
+    launcher      text,
+    group_name    text,
+    max_cpu_cores double precision,
+    max_memory    bigint,
+    max_gpus      bigint,
+    CHECK (launcher IS NULL OR group_name IS NULL)
+);
+
+-- There's at most one quota for each user, one for each group, and one default
+-- quota.
+CREATE UNIQUE INDEX IF NOT EXISTS resource_quotas_unique_index
+    ON resource_quotas ((COALESCE(launcher, '')), (COALESCE(group_name, '')));
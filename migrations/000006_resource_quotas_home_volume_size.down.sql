@@ -0,0 +1 @@
+ALTER TABLE resource_quotas DROP COLUMN IF EXISTS home_volume_size;
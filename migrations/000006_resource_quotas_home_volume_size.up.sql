@@ -0,0 +1,3 @@
+-- The size of the home volume created for the user, in bytes. See
+-- internal/homevolumes.go. A null size means the configured default size.
+ALTER TABLE resource_quotas ADD COLUMN IF NOT EXISTS home_volume_size bigint;